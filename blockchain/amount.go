@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// Amount is a value in base units, wallet.Coin of them make a coin
+type Amount int64
+
+const (
+	Coin = Amount(wallet.Coin)
+	// No output or sum of outputs may be worth more
+	MaxMoney       = 21000000 * Coin
+	CoinbaseReward = 100 * Coin
+
+	// Outputs worth less are not relayed, data outputs excepted
+	DustThreshold = Amount(1000)
+)
+
+var ErrAmountRange = errors.New("amount out of range")
+
+func (a Amount) IsValid() bool {
+	return a >= 0 && a <= MaxMoney
+}
+
+// AddAmounts sums valid amounts and fails if the sum leaves the valid range
+func AddAmounts(amounts ...Amount) (Amount, error) {
+	var total Amount
+	for _, amount := range amounts {
+		if !amount.IsValid() {
+			return 0, ErrAmountRange
+		}
+		total += amount
+		if !total.IsValid() {
+			return 0, ErrAmountRange
+		}
+	}
+	return total, nil
+}
+
+func (a Amount) String() string {
+	return wallet.FormatAmount(int64(a))
+}
+
+func ParseAmount(s string) (Amount, error) {
+	units, err := wallet.ParseAmount(s)
+	if err != nil {
+		return 0, err
+	}
+	if !Amount(units).IsValid() {
+		return 0, ErrAmountRange
+	}
+	return Amount(units), nil
+}
+
+// IsDust reports whether an output is too small to be worth relaying
+func (out *TransactionOutput) IsDust() bool {
+	return !out.LockingScript.IsUnspendable() && out.Value < DustThreshold
+}
+
+// fee is the native coin a transaction with checked amounts leaves to the
+// miner
+func (tx *Transaction) fee(previousTxs map[string]Transaction) Amount {
+	var fee Amount
+	for _, in := range tx.Inputs {
+		out := previousTxs[hex.EncodeToString(in.ID)].Outputs[in.Output]
+		if len(out.Asset) == 0 {
+			fee += out.Value
+		}
+	}
+	for _, out := range tx.Outputs {
+		if len(out.Asset) == 0 {
+			fee -= out.Value
+		}
+	}
+	return fee
+}
+
+func (tx *Transaction) HasDust() bool {
+	for _, out := range tx.Outputs {
+		if out.IsDust() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+const MaxAssetNameSize = 32
+
+// AssetIssuance creates a new asset. The issuing transaction mints any
+// amount of it, the asset is identified by its name and issuer key.
+type AssetIssuance struct {
+	Name      string
+	Issuer    []byte
+	Signature []byte
+}
+
+func (i *AssetIssuance) AssetID() []byte {
+	hash := sha512.Sum512(append([]byte(i.Name), i.Issuer...))
+	return hash[:32]
+}
+
+// IssuanceHash is what the issuer signs, it commits to the whole transaction
+// except signatures
+func (tx *Transaction) IssuanceHash() []byte {
+	return tx.Hash()
+}
+
+func NewAssetTxOutput(value Amount, address string, asset []byte) *TransactionOutput {
+	txo := NewTxOutput(value, address)
+	txo.Asset = asset
+	return txo
+}
+
+// NewIssuanceTransaction mints amount of a new asset to an address. Issuing
+// spends at least one native coin of the wallet, which is returned as change.
+func NewIssuanceTransaction(w *wallet.Wallet, name string, amount Amount, to string, UTXOs *UTXOSet) *Transaction {
+	if len(name) == 0 || len(name) > MaxAssetNameSize {
+		panic("invalid asset name")
+	}
+	issuance := AssetIssuance{name, w.PublicKey, nil}
+	publicKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	acc, validOutputs := UTXOs.FindSpendableOutputs(publicKeyHash, 1)
+	if acc < 1 {
+		panic("Fund error")
+	}
+	inputs, lockTime := spendOutputs(validOutputs, UTXOs)
+	outputs := []TransactionOutput{
+		*NewAssetTxOutput(amount, to, issuance.AssetID()),
+		*NewTxOutput(acc, string(w.Address())),
+	}
+	tx := Transaction{nil, inputs, outputs, lockTime, &issuance, nil, 0}
+	tx.Issuance.Signature = SignHash(w.PrivateKey, tx.IssuanceHash())
+	tx.ID = tx.Hash()
+	UTXOs.Chain.SignTransaction(&tx, w.PrivateKey, w.PublicKey)
+
+	return &tx
+}
+
+// CheckAssets makes sure no asset is created or destroyed, except for the
+// asset minted by an issuance, which may also spend earlier units of it. Native coins may be left as fees. Every value
+// and every sum must be within MaxMoney.
+func (tx *Transaction) CheckAssets(previousTxs map[string]Transaction) error {
+	inputs := make(map[string]Amount)
+	for _, in := range tx.Inputs {
+		previousTx := previousTxs[hex.EncodeToString(in.ID)]
+		if in.Output < 0 || in.Output >= len(previousTx.Outputs) {
+			return errors.New("transaction input references missing output")
+		}
+		out := previousTx.Outputs[in.Output]
+		asset := hex.EncodeToString(out.Asset)
+		sum, err := AddAmounts(inputs[asset], out.Value)
+		if err != nil {
+			return errors.New("transaction inputs out of range")
+		}
+		inputs[asset] = sum
+	}
+	var issued string
+	if tx.Issuance != nil {
+		if len(tx.Issuance.Name) == 0 || len(tx.Issuance.Name) > MaxAssetNameSize {
+			return errors.New("transaction issues an asset with an invalid name")
+		}
+		issued = hex.EncodeToString(tx.Issuance.AssetID())
+	}
+	outputs := make(map[string]Amount)
+	for _, out := range tx.Outputs {
+		if out.Value < 0 {
+			return errors.New("transaction output has negative value")
+		}
+		asset := hex.EncodeToString(out.Asset)
+		sum, err := AddAmounts(outputs[asset], out.Value)
+		if err != nil {
+			return errors.New("transaction outputs out of range")
+		}
+		outputs[asset] = sum
+	}
+	for asset, output := range outputs {
+		if len(asset) > 0 && asset == issued {
+			continue
+		}
+		if output > inputs[asset] {
+			return errors.New("transaction spends more than its inputs")
+		}
+	}
+	// The issuer may add to the supply of an existing asset but not burn it
+	for asset, input := range inputs {
+		if asset == "" || (asset == issued && outputs[asset] >= input) {
+			continue
+		}
+		if input != outputs[asset] {
+			return errors.New("transaction burns an asset")
+		}
+	}
+	return nil
+}
+
+// checkCoinbase rejects coinbases minting assets, they only create the
+// native coin, and returns the value they create
+func (tx *Transaction) checkCoinbase() (Amount, error) {
+	if tx.Issuance != nil {
+		return 0, errors.New("coinbase issues an asset")
+	}
+	var value Amount
+	for _, out := range tx.Outputs {
+		if len(out.Asset) > 0 {
+			return 0, errors.New("coinbase creates an asset")
+		}
+		sum, err := AddAmounts(value, out.Value)
+		if err != nil {
+			return 0, errors.New("coinbase outputs out of range")
+		}
+		value = sum
+	}
+	return value, nil
+}
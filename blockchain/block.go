@@ -2,10 +2,24 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"math"
 	"time"
 )
 
+const (
+	// Nonces are 32 bits, miners roll the timestamp once they are used up
+	MaxNonce = math.MaxUint32
+	// Seconds a block may be ahead of the clock of the node
+	MaxFutureBlockTime = 2 * 60 * 60
+	// The nonce is the last field of the header
+	HeaderNonceOffset = 32 + 64 + 64 + 8 + 8 + 8
+	HeaderLength      = HeaderNonceOffset + 4
+)
+
 type Block struct {
 	Timestamp    int64
 	Hash         []byte
@@ -16,28 +30,104 @@ type Block struct {
 }
 
 func NewBlock(c *Chain, txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, height, 0}
+	block, err := NewBlockContext(context.Background(), c, txs, prevHash, height)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// NewBlockContext mines a block until it is found or the context is canceled
+func NewBlockContext(ctx context.Context, c *Chain, txs []*Transaction, prevHash []byte, height int) (*Block, error) {
+	block := &Block{blockTime(c, prevHash), []byte{}, txs, prevHash, height, 0}
 	pow := NewProof(c, block, true)
-	nonce, hash := pow.Run()
-	pow.Destroy()
+	defer pow.Destroy()
+	nonce, hash, err := pow.Mine(ctx, MinerThreads)
+	if err != nil {
+		return nil, err
+	}
 
 	block.Hash = hash
 	block.Nonce = nonce
 
-	return block
+	return block, nil
+}
+
+// Header serializes every field the proof of work commits to: the previous
+// hash, the transaction and witness roots, timestamp, height, difficulty and
+// nonce
+func (b *Block) Header() []byte {
+	header := make([]byte, HeaderLength)
+	copy(header[:32], b.PrevHash)
+	copy(header[32:96], b.HashTransactions())
+	copy(header[96:160], b.HashWitnesses())
+	binary.BigEndian.PutUint64(header[160:], uint64(b.Timestamp))
+	binary.BigEndian.PutUint64(header[168:], uint64(b.Height))
+	binary.BigEndian.PutUint64(header[176:], difficulty)
+	binary.BigEndian.PutUint32(header[HeaderNonceOffset:], uint32(b.Nonce))
+	return header
+}
+
+// Coinbase is the last transaction of the block
+func (b *Block) Coinbase() *Transaction {
+	if len(b.Transactions) == 0 {
+		return nil
+	}
+	if tx := b.Transactions[len(b.Transactions)-1]; tx.IsCoinbaseTransaction() {
+		return tx
+	}
+	return nil
+}
+
+// WithExtranonce copies the block with the extranonce of its coinbase set
+func (b *Block) WithExtranonce(extranonce uint64) *Block {
+	block := *b
+	block.Transactions = append([]*Transaction{}, b.Transactions...)
+	if coinbase := b.Coinbase(); coinbase != nil {
+		tx := *coinbase
+		tx.Extranonce = extranonce
+		tx.ID = tx.Hash()
+		block.Transactions[len(block.Transactions)-1] = &tx
+	}
+	return &block
+}
+
+// checkHeader rejects nonces outside the nonce space and timestamps too far in
+// the future
+func (b *Block) checkHeader() error {
+	if b.Nonce < 0 || b.Nonce > MaxNonce {
+		return errors.New("block nonce out of range")
+	}
+	if b.Timestamp > time.Now().Unix()+MaxFutureBlockTime {
+		return errors.New("block timestamp too far in the future")
+	}
+	return nil
 }
 
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txHashes = append(txHashes, tx.Hash())
 	}
 	tree := NewMerkleTree(txHashes)
 
 	return tree.RootNode.Data
 }
 
+// HashWitnesses is the merkle root committing to the signatures of the
+// transactions, which their IDs leave out
+func (b *Block) HashWitnesses() []byte {
+	var witnessHashes [][]byte
+
+	for _, tx := range b.Transactions {
+		witnessHashes = append(witnessHashes, tx.WitnessHash())
+	}
+	tree := NewMerkleTree(witnessHashes)
+
+	return tree.RootNode.Data
+}
+
 func (b *Block) Serialize() []byte {
 	var res bytes.Buffer
 	encoder := gob.NewEncoder(&res)
@@ -2,7 +2,7 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,7 +10,9 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
+	"github.com/JI-0/private-cryptocurrency/wallet"
 	"github.com/dgraph-io/badger"
 )
 
@@ -18,9 +20,25 @@ const (
 	dbPath = "./tmp/blocks_%s"
 )
 
+var (
+	ErrStaleTip     = errors.New("chain tip changed while mining")
+	ErrInvalidProof = errors.New("block has an invalid proof of work")
+	ErrTimeTooOld   = errors.New("block timestamp is not after the median time past")
+)
+
 type Chain struct {
 	LastHash []byte
 	Database *badger.DB
+	// Guards LastHash while blocks are added
+	tipMutex sync.RWMutex
+	// Set while the blocks below a loaded UTXO snapshot are not validated
+	snapshotBase  []byte
+	snapshotMutex sync.RWMutex
+	// Seed block hashes found in the ancestry of blocks
+	seedMutex  sync.Mutex
+	seedHashes map[seedLookup][]byte
+	// Cache of the unspent outputs validation looks inputs up in, if any
+	UTXOCache *UTXOCache
 }
 
 func Genesis(coinbase *Transaction) *Block {
@@ -68,7 +86,7 @@ func NewChain(address, path string) *Chain {
 	}
 
 	var lastHash []byte
-	opts := badger.DefaultOptions(dbPath)
+	opts := badger.DefaultOptions(path)
 
 	db, err := DBOpen(path, opts)
 	if err != nil {
@@ -94,7 +112,10 @@ func NewChain(address, path string) *Chain {
 		panic(err)
 	}
 
-	blockchain := Chain{lastHash, db}
+	blockchain := Chain{LastHash: lastHash, Database: db}
+	if (UTXOSet{Chain: &blockchain}).Migrate() {
+		fmt.Println("UTXO set migrated to outpoint records")
+	}
 	return &blockchain
 }
 
@@ -106,7 +127,7 @@ func ContinueChain(path string) *Chain {
 	}
 
 	var lastHash []byte
-	opts := badger.DefaultOptions(dbPath)
+	opts := badger.DefaultOptions(path)
 
 	db, err := DBOpen(path, opts)
 	if err != nil {
@@ -127,46 +148,55 @@ func ContinueChain(path string) *Chain {
 		panic(err)
 	}
 
-	blockchain := Chain{lastHash, db}
+	blockchain := Chain{LastHash: lastHash, Database: db, snapshotBase: loadSnapshotBase(db)}
+	UTXOs := UTXOSet{Chain: &blockchain}
+	if UTXOs.Migrate() {
+		fmt.Println("UTXO set migrated to outpoint records")
+	}
+	UTXOs.Recover()
 	return &blockchain
 }
 
-func (c *Chain) AddBlock(block *Block) {
+// StoreBlock stores a block that is not validated, such as the history below
+// a snapshot. It never moves the tip and keeps a block already stored.
+func (c *Chain) StoreBlock(block *Block) {
 	if err := c.Database.Update(func(txn *badger.Txn) error {
 		if _, err := txn.Get(block.Hash); err == nil {
 			return nil
 		}
-		blockData := block.Serialize()
-		if err := txn.Set(block.Hash, blockData); err != nil {
-			return err
-		}
+		return txn.Set(block.Hash, block.Serialize())
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// AddBlock stores a block validated against the tip and moves the tip to it.
+// A block that no longer extends the tip is only stored, as by StoreBlock.
+func (c *Chain) AddBlock(block *Block) {
+	if err := c.Database.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		if err != nil {
 			return err
 		}
-		var lastHash []byte
-		item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
-		item, err = txn.Get(lastHash)
+		lastHash, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
-		var lastBlock *Block
-		if err := item.Value(func(val []byte) error {
-			lastBlock = lastBlock.Deserialize(val)
-			return nil
-		}); err != nil {
-			return err
+		if !bytes.Equal(block.PrevHash, lastHash) {
+			if _, err := txn.Get(block.Hash); err == nil {
+				return nil
+			}
+			return txn.Set(block.Hash, block.Serialize())
 		}
 
-		if block.Height > lastBlock.Height {
-			if err := txn.Set([]byte("lh"), block.Hash); err != nil {
-				return err
-			}
-			c.LastHash = block.Hash
+		// A validated block replaces whatever was stored under its hash
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+			return err
 		}
+		c.setTip(block.Hash)
 		return nil
 	}); err != nil {
 		panic(err)
@@ -199,7 +229,7 @@ func (c *Chain) GetBlockHashes() [][]byte {
 	for {
 		block := iter.Next()
 		blocks = append(blocks, block.Hash)
-		if len(block.PrevHash) == 0 {
+		if c.IsFirstBlock(block) {
 			break
 		}
 	}
@@ -231,6 +261,29 @@ func (c *Chain) GetTopHeight() int {
 }
 
 func (c *Chain) MineBlock(transactions []*Transaction) *Block {
+	block, err := c.MineBlockContext(context.Background(), transactions)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// MineBlockContext mines on the tip until a block is found or the context is
+// canceled. The block is not stored if the tip changed in the meantime.
+func (c *Chain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	lastHash, lastHeight := c.tip()
+	newBlock, err := NewBlockContext(ctx, c, transactions, lastHash, lastHeight+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.storeOnTip(newBlock, lastHash); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
+}
+
+// tip returns the hash and height of the last block
+func (c *Chain) tip() ([]byte, int) {
 	var lastHash []byte
 	var lastHeight int
 	if err := c.Database.View(func(txn *badger.Txn) error {
@@ -256,74 +309,143 @@ func (c *Chain) MineBlock(transactions []*Transaction) *Block {
 	}); err != nil {
 		panic(err)
 	}
+	return lastHash, lastHeight
+}
 
-	newBlock := NewBlock(c, transactions, lastHash, lastHeight+1)
-
-	if err := c.Database.Update(func(txn *badger.Txn) error {
-		if err := txn.Set(newBlock.Hash, newBlock.Serialize()); err != nil {
+// storeOnTip stores a block as the new tip unless the tip is no longer
+// lastHash
+func (c *Chain) storeOnTip(block *Block, lastHash []byte) error {
+	return c.Database.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		if tip, err := item.ValueCopy(nil); err != nil {
 			return err
+		} else if !bytes.Equal(tip, lastHash) {
+			return ErrStaleTip
 		}
-		if err := txn.Set([]byte("lh"), newBlock.Hash); err != nil {
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
 			return err
 		}
-		c.LastHash = newBlock.Hash
+		if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+			return err
+		}
+		c.setTip(block.Hash)
 		return nil
-	}); err != nil {
-		panic(err)
-	}
-
-	return newBlock
+	})
 }
 
 func (c *Chain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := c.FindTransactionBlock(ID)
+	return tx, err
+}
+
+// FindTransactionBlock also returns the block the transaction was mined in
+func (c *Chain) FindTransactionBlock(ID []byte) (Transaction, *Block, error) {
 	iter := c.Iterator()
 	for {
 		block := iter.Next()
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return *tx, block, nil
 			}
 		}
 
-		if len(block.PrevHash) == 0 {
+		if c.IsFirstBlock(block) {
 			break
 		}
 	}
-	return Transaction{}, errors.New("transaction does not exist")
+	return Transaction{}, nil, errors.New("transaction does not exist")
 }
 
-func (c *Chain) FindUTXOs() map[string]TransactionOutputs {
-	UTXOs := make(map[string]TransactionOutputs)
-	spentTxs := make(map[string][]int)
+// previousTransaction finds the transaction and block an input spends from.
+// Below the base of a snapshot only the unspent outputs are known, the
+// transaction then holds the spent outputs and the block only its height.
+func (c *Chain) previousTransaction(in TransactionInput, previousTxs map[string]Transaction) (Transaction, *Block, error) {
+	tx, block, err := c.FindTransactionBlock(in.ID)
+	if err == nil || c.SnapshotBase() == nil {
+		return tx, block, err
+	}
+	utxo, ok := (UTXOSet{Chain: c}).GetUTXO(Outpoint{in.ID, in.Output})
+	if !ok {
+		return Transaction{}, nil, err
+	}
+	if _, isTime, enabled := in.RelativeLock(); enabled && isTime {
+		return Transaction{}, nil, errors.New("time of the block below the snapshot is unknown")
+	}
+	return spentTransaction(in, utxo.Output, previousTxs), &Block{Height: utxo.Height}, nil
+}
+
+// spentTransaction returns the transaction an input spends from when only its
+// unspent outputs are known, the output is added to those already found
+func spentTransaction(in TransactionInput, out TransactionOutput, previousTxs map[string]Transaction) Transaction {
+	tx := previousTxs[hex.EncodeToString(in.ID)]
+	tx.ID = in.ID
+	for len(tx.Outputs) <= in.Output {
+		tx.Outputs = append(tx.Outputs, TransactionOutput{})
+	}
+	tx.Outputs[in.Output] = out
+	return tx
+}
+
+// FindSpendingTransaction returns the transaction spending an output
+func (c *Chain) FindSpendingTransaction(ID []byte, output int) (Transaction, error) {
 	iter := c.Iterator()
+	for {
+		block := iter.Next()
+
+		for _, tx := range block.Transactions {
+			for _, in := range tx.Inputs {
+				if bytes.Compare(in.ID, ID) == 0 && in.Output == output {
+					return *tx, nil
+				}
+			}
+		}
+
+		if c.IsFirstBlock(block) {
+			break
+		}
+	}
+	return Transaction{}, errors.New("output is not spent")
+}
+
+func (c *Chain) FindUTXOs() []UTXO {
+	return c.FindUTXOsAt(c.TipHash())
+}
+
+// FindUTXOsAt returns the outputs unspent after the given block
+func (c *Chain) FindUTXOsAt(blockHash []byte) []UTXO {
+	return c.findUTXOs(blockHash, c.IsFirstBlock)
+}
+
+func (c *Chain) findUTXOs(blockHash []byte, isFirst func(block *Block) bool) []UTXO {
+	var UTXOs []UTXO
+	spentOuts := make(map[string]bool)
+	iter := &ChainIterator{blockHash, c.Database}
 
 	for {
 		block := iter.Next()
 
 		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-		Outputs:
+			coinbase := tx.IsCoinbaseTransaction()
 			for outIdx, out := range tx.Outputs {
-				if spentTxs[txID] != nil {
-					for _, spentOut := range spentTxs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
+				if out.LockingScript.IsUnspendable() {
+					continue
+				}
+				if spentOuts[fmt.Sprintf("%x:%d", tx.ID, outIdx)] {
+					continue
 				}
-				outs := UTXOs[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXOs[txID] = outs
+				UTXOs = append(UTXOs, UTXO{Outpoint{tx.ID, outIdx}, out, block.Height, coinbase})
 			}
-			if tx.IsCoinbaseTransaction() == false {
+			if !coinbase {
 				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					spentTxs[inTxID] = append(spentTxs[inTxID], in.Output)
+					spentOuts[fmt.Sprintf("%x:%d", in.ID, in.Output)] = true
 				}
 			}
 		}
-		if len(block.PrevHash) == 0 {
+		if isFirst(block) {
 			break
 		}
 	}
@@ -331,16 +453,21 @@ func (c *Chain) FindUTXOs() map[string]TransactionOutputs {
 	return UTXOs
 }
 
-func (c *Chain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+func (c *Chain) SignTransaction(tx *Transaction, privateKey wallet.PrivateKey, publicKey []byte) {
 	previousTxs := make(map[string]Transaction)
 	for _, input := range tx.Inputs {
-		previousTx, err := c.FindTransaction(input.ID)
+		previousTx, _, err := c.previousTransaction(input, previousTxs)
 		if err != nil {
 			panic(err)
 		}
 		previousTxs[hex.EncodeToString(previousTx.ID)] = previousTx
 	}
-	tx.Sign(privateKey, previousTxs)
+	// Schnorr wallets sign multi-input transactions once
+	if privateKey.Type == wallet.KeyTypeSchnorr && len(tx.Inputs) > 1 {
+		tx.SignAggregated([]wallet.PrivateKey{privateKey}, previousTxs)
+		return
+	}
+	tx.Sign(privateKey, publicKey, previousTxs)
 }
 
 func (c *Chain) VerifyTransaction(tx *Transaction) bool {
@@ -351,7 +478,7 @@ func (c *Chain) VerifyTransaction(tx *Transaction) bool {
 
 	previousTxs := make(map[string]Transaction)
 	for _, input := range tx.Inputs {
-		previousTx, err := c.FindTransaction(input.ID)
+		previousTx, _, err := c.previousTransaction(input, previousTxs)
 		if err != nil {
 			panic(err)
 		}
@@ -360,6 +487,214 @@ func (c *Chain) VerifyTransaction(tx *Transaction) bool {
 	return tx.Verify(previousTxs)
 }
 
+// ValidateTransaction applies the consensus rules for including a transaction
+// in a block at the given height and time
+func (c *Chain) ValidateTransaction(tx *Transaction, height int, timestamp int64) error {
+	previousTxs, err := c.checkTransaction(tx, height, timestamp)
+	if err != nil || tx.IsCoinbaseTransaction() {
+		return err
+	}
+	if !tx.Verify(previousTxs) {
+		return errors.New("transaction scripts failed")
+	}
+	return nil
+}
+
+// AdmitTransaction validates a transaction entering the memory pool and
+// caches its signatures, so they are not verified again in a block
+func (c *Chain) AdmitTransaction(tx *Transaction, height int, timestamp int64) error {
+	previousTxs, err := c.checkTransaction(tx, height, timestamp)
+	if err != nil || tx.IsCoinbaseTransaction() {
+		return err
+	}
+	if !tx.verify(previousTxs, nil, true) {
+		return errors.New("transaction scripts failed")
+	}
+	return nil
+}
+
+// checkTransaction applies every rule except for signatures and scripts and
+// returns the transactions spent by tx
+func (c *Chain) checkTransaction(tx *Transaction, height int, timestamp int64) (map[string]Transaction, error) {
+	return c.checkTransactionWith(tx, height, timestamp, c.spendable)
+}
+
+// outputLookup finds the transaction and block of the unspent output an
+// input spends
+type outputLookup func(in TransactionInput, previousTxs map[string]Transaction) (Transaction, *Block, error)
+
+// spendable looks the inputs of transactions on the tip up in the UTXO set
+func (c *Chain) spendable(in TransactionInput, previousTxs map[string]Transaction) (Transaction, *Block, error) {
+	utxos := UTXOSet{Chain: c, Cache: c.UTXOCache}
+	if _, ok := utxos.GetUTXO(Outpoint{in.ID, in.Output}); !ok {
+		return Transaction{}, nil, errors.New("transaction input is spent or does not exist")
+	}
+	return c.previousTransaction(in, previousTxs)
+}
+
+func (c *Chain) checkTransactionWith(tx *Transaction, height int, timestamp int64, lookup outputLookup) (map[string]Transaction, error) {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return nil, errors.New("transaction ID does not match its contents")
+	}
+	if tx.IsCoinbaseTransaction() {
+		_, err := tx.checkCoinbase()
+		return nil, err
+	}
+	if tx.Extranonce != 0 {
+		return nil, errors.New("extranonce outside the coinbase")
+	}
+	if !tx.IsFinal(height, timestamp) {
+		return nil, errors.New("transaction lock time not reached")
+	}
+	dataOutputs := 0
+	for _, out := range tx.Outputs {
+		if !out.LockingScript.IsUnspendable() {
+			continue
+		}
+		// Scripts that are not a single push carry everything after OP_RETURN
+		data, ok := out.LockingScript.NullData()
+		if !ok {
+			data = out.LockingScript[1:]
+		}
+		dataOutputs++
+		if len(data) > MaxDataCarrierSize || out.Value != 0 {
+			return nil, errors.New("transaction data output too large or carries value")
+		}
+	}
+	if dataOutputs > 1 {
+		return nil, errors.New("transaction has more than one data output")
+	}
+
+	spent := make(map[string]bool)
+	previousTxs := make(map[string]Transaction)
+	for _, input := range tx.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", input.ID, input.Output)
+		if spent[outpoint] {
+			return nil, errors.New("transaction spends an output twice")
+		}
+		spent[outpoint] = true
+		previousTx, previousBlock, err := lookup(input, previousTxs)
+		if err != nil {
+			return nil, err
+		}
+		if !RelativeLockSatisfied(input, previousBlock, height, timestamp) {
+			return nil, errors.New("transaction input relative lock not reached")
+		}
+		previousTxs[hex.EncodeToString(previousTx.ID)] = previousTx
+	}
+	if err := tx.CheckAssets(previousTxs); err != nil {
+		return nil, err
+	}
+	return previousTxs, nil
+}
+
+// ValidateBlock checks the header, proof of work and transactions of a block
+// that extends the chain. The scripts of all inputs are run by a pool of workers.
+func (c *Chain) ValidateBlock(block *Block) error {
+	return c.validateBlock(block, c.spendable)
+}
+
+func (c *Chain) validateBlock(block *Block, lookup outputLookup) error {
+	if err := block.checkHeader(); err != nil {
+		return err
+	}
+	if err := c.checkTimestamp(block); err != nil {
+		return err
+	}
+	if !VerifyProof(c, block) {
+		return ErrInvalidProof
+	}
+	return c.validateTransactionsWith(block, lookup)
+}
+
+func (c *Chain) validateTransactions(block *Block) error {
+	return c.validateTransactionsWith(block, c.spendable)
+}
+
+func (c *Chain) validateTransactionsWith(block *Block, lookup outputLookup) error {
+	var checks []func() error
+	batch := wallet.NewSchnorrBatch()
+	spent := make(map[string]bool)
+	var coinbase *Transaction
+	var fees Amount
+	for _, tx := range block.Transactions {
+		previousTxs, err := c.checkTransactionWith(tx, block.Height, block.Timestamp, lookup)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %s", tx.ID, err)
+		}
+		if tx.IsCoinbaseTransaction() {
+			if coinbase != nil {
+				return errors.New("block has more than one coinbase")
+			}
+			coinbase = tx
+			continue
+		}
+		if fees, err = AddAmounts(fees, tx.fee(previousTxs)); err != nil {
+			return fmt.Errorf("transaction %x: fees out of range", tx.ID)
+		}
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Output)
+			if spent[outpoint] {
+				return fmt.Errorf("transaction %x: output spent twice in the block", tx.ID)
+			}
+			spent[outpoint] = true
+		}
+		for _, check := range tx.scriptChecks(previousTxs, batch, false) {
+			check, id := check, tx.ID
+			checks = append(checks, func() error {
+				if err := check(); err != nil {
+					return fmt.Errorf("transaction %x: %s", id, err)
+				}
+				return nil
+			})
+		}
+	}
+	// The coinbase may claim the reward and the fees of the block
+	if coinbase == nil {
+		return errors.New("block has no coinbase")
+	}
+	value, _ := coinbase.checkCoinbase()
+	if limit, err := AddAmounts(CoinbaseReward, fees); err != nil || value > limit {
+		return errors.New("coinbase creates more than the reward and fees")
+	}
+	if err := runChecks(checks); err != nil {
+		return err
+	}
+	if !batch.Verify() {
+		return errors.New("block has an invalid schnorr signature")
+	}
+	return nil
+}
+
 func (c *Chain) Iterator() *ChainIterator {
-	return &ChainIterator{c.LastHash, c.Database}
+	return &ChainIterator{c.TipHash(), c.Database}
+}
+
+// TipHash returns the hash of the last block. Unlike LastHash it may be read
+// while other goroutines add blocks.
+func (c *Chain) TipHash() []byte {
+	c.tipMutex.RLock()
+	defer c.tipMutex.RUnlock()
+	return c.LastHash
+}
+
+func (c *Chain) setTip(hash []byte) {
+	c.tipMutex.Lock()
+	defer c.tipMutex.Unlock()
+	c.LastHash = hash
+}
+
+// IsFirstBlock reports whether iterating backwards ends at a block, which is
+// the genesis block or the base of an unvalidated snapshot
+func (c *Chain) IsFirstBlock(block *Block) bool {
+	base := c.SnapshotBase()
+	return len(block.PrevHash) == 0 || (base != nil && bytes.Equal(block.Hash, base))
+}
+
+// SnapshotBase is the base block of a loaded UTXO snapshot while the blocks
+// below it are not validated
+func (c *Chain) SnapshotBase() []byte {
+	c.snapshotMutex.RLock()
+	defer c.snapshotMutex.RUnlock()
+	return c.snapshotBase
 }
@@ -0,0 +1,225 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const bnbMaxTries = 100000
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrNoExactMatch      = errors.New("no selection of outputs matches the amount")
+
+	// DefaultCoinSelector avoids change when outputs add up to the amount
+	DefaultCoinSelector CoinSelector = FirstOf{BranchAndBound{}, LargestFirst{}}
+)
+
+// CoinSelector picks outputs worth at least target from the candidates
+type CoinSelector interface {
+	Select(candidates []UTXO, target Amount) ([]UTXO, error)
+}
+
+func sumValues(UTXOs []UTXO) Amount {
+	var total Amount
+	for _, utxo := range UTXOs {
+		total += utxo.Output.Value
+	}
+	return total
+}
+
+// takeUntil selects outputs in order until they reach the target
+func takeUntil(candidates []UTXO, target Amount) ([]UTXO, error) {
+	var selected []UTXO
+	var total Amount
+	for _, utxo := range candidates {
+		if total >= target {
+			break
+		}
+		selected = append(selected, utxo)
+		total += utxo.Output.Value
+	}
+	if total < target {
+		return nil, ErrInsufficientFunds
+	}
+	return selected, nil
+}
+
+// LargestFirst uses the fewest outputs
+type LargestFirst struct{}
+
+func (LargestFirst) Select(candidates []UTXO, target Amount) ([]UTXO, error) {
+	sorted := append([]UTXO{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Output.Value > sorted[j].Output.Value
+	})
+	return takeUntil(sorted, target)
+}
+
+// OldestFirst spends the outputs mined first, consolidating old coins
+type OldestFirst struct{}
+
+func (OldestFirst) Select(candidates []UTXO, target Amount) ([]UTXO, error) {
+	sorted := append([]UTXO{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Height < sorted[j].Height
+	})
+	return takeUntil(sorted, target)
+}
+
+// BranchAndBound searches for outputs adding up to the target without
+// change. A surplus up to CostOfChange is accepted.
+type BranchAndBound struct {
+	CostOfChange Amount
+}
+
+func (s BranchAndBound) Select(candidates []UTXO, target Amount) ([]UTXO, error) {
+	sorted := append([]UTXO{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Output.Value > sorted[j].Output.Value
+	})
+	// remaining[i] is the value of the outputs from i on
+	remaining := make([]Amount, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+	if remaining[0] < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	var best []bool
+	bestSurplus := s.CostOfChange + 1
+	chosen := make([]bool, len(sorted))
+	tries := 0
+	var search func(i int, total Amount)
+	search = func(i int, total Amount) {
+		tries++
+		if tries > bnbMaxTries || total+remaining[i] < target || total > target+s.CostOfChange {
+			return
+		}
+		if total >= target {
+			if surplus := total - target; surplus < bestSurplus {
+				bestSurplus = surplus
+				best = append([]bool{}, chosen...)
+			}
+			return
+		}
+		if i == len(sorted) {
+			return
+		}
+		chosen[i] = true
+		search(i+1, total+sorted[i].Output.Value)
+		chosen[i] = false
+		if bestSurplus == 0 {
+			return
+		}
+		// Leaving out an output and taking an equal one instead gives sums
+		// already searched
+		j := i + 1
+		for j < len(sorted) && sorted[j].Output.Value == sorted[i].Output.Value {
+			j++
+		}
+		search(j, total)
+	}
+	search(0, 0)
+
+	if best == nil {
+		return nil, ErrNoExactMatch
+	}
+	var selected []UTXO
+	for i, ok := range best {
+		if ok {
+			selected = append(selected, sorted[i])
+		}
+	}
+	return selected, nil
+}
+
+// FirstOf uses the first selector that succeeds
+type FirstOf []CoinSelector
+
+func (f FirstOf) Select(candidates []UTXO, target Amount) ([]UTXO, error) {
+	err := ErrInsufficientFunds
+	for _, selector := range f {
+		var selected []UTXO
+		if selected, err = selector.Select(candidates, target); err == nil {
+			return selected, nil
+		}
+	}
+	return nil, err
+}
+
+// ManualSelector always spends the pinned outpoints. Outputs still missing
+// are picked by Fallback, without one the pinned outputs must be enough.
+type ManualSelector struct {
+	Outpoints []Outpoint
+	Fallback  CoinSelector
+}
+
+func (s ManualSelector) Select(candidates []UTXO, target Amount) ([]UTXO, error) {
+	var selected, rest []UTXO
+	pinned := make(map[string]bool)
+	for _, outpoint := range s.Outpoints {
+		pinned[string(coinKey(outpoint))] = true
+	}
+	for _, utxo := range candidates {
+		key := string(coinKey(utxo.Outpoint))
+		if pinned[key] {
+			selected = append(selected, utxo)
+			delete(pinned, key)
+		} else {
+			rest = append(rest, utxo)
+		}
+	}
+	if len(pinned) > 0 {
+		return nil, errors.New("pinned output is not spendable by the wallet")
+	}
+	total := sumValues(selected)
+	if total >= target {
+		return selected, nil
+	}
+	if s.Fallback == nil {
+		return nil, ErrInsufficientFunds
+	}
+	more, err := s.Fallback.Select(rest, target-total)
+	if err != nil {
+		return nil, err
+	}
+	return append(selected, more...), nil
+}
+
+// ParseCoinSelector returns the selector for a policy name
+func ParseCoinSelector(name string) (CoinSelector, error) {
+	switch name {
+	case "", "default":
+		return DefaultCoinSelector, nil
+	case "bnb":
+		return BranchAndBound{}, nil
+	case "largest":
+		return LargestFirst{}, nil
+	case "oldest":
+		return OldestFirst{}, nil
+	}
+	return nil, fmt.Errorf("unknown coin selection %q", name)
+}
+
+// ParseOutpoint reads an outpoint written as TXID:INDEX
+func ParseOutpoint(s string) (Outpoint, error) {
+	txid, index, ok := strings.Cut(s, ":")
+	if !ok {
+		return Outpoint{}, errors.New("outpoint must be TXID:INDEX")
+	}
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		return Outpoint{}, err
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		return Outpoint{}, errors.New("invalid outpoint index")
+	}
+	return Outpoint{id, i}, nil
+}
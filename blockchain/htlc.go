@@ -0,0 +1,140 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// Secrets are 32 bytes hashed with SHA-256 so the same hash can lock
+// contracts on other ledgers
+const HTLCSecretSize = 32
+
+// HTLC is a hash time locked contract. The recipient can claim the output
+// with the secret, the sender can take it back once the lock time passed.
+type HTLC struct {
+	SecretHash    []byte
+	RecipientHash []byte
+	RefundHash    []byte
+	LockTime      uint32
+}
+
+func (h HTLC) Script() Script {
+	return Script{}.
+		AddOp(OpIf).
+		AddOp(OpSize).AddInt(HTLCSecretSize).AddOp(OpEqualVerify).
+		AddOp(OpSHA256).AddData(h.SecretHash).AddOp(OpEqualVerify).
+		AddOp(OpDup).AddOp(OpHash160).AddData(h.RecipientHash).
+		AddOp(OpElse).
+		AddData(EncodeScriptNum(int64(h.LockTime))).AddOp(OpCheckLockTimeVerify).AddOp(OpDrop).
+		AddOp(OpDup).AddOp(OpHash160).AddData(h.RefundHash).
+		AddOp(OpEndIf).
+		AddOp(OpEqualVerify).
+		AddOp(OpCheckSig)
+}
+
+// ParseHTLC recognizes a locking script built by HTLC.Script
+func (s Script) ParseHTLC() (HTLC, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 20 {
+		return HTLC{}, false
+	}
+	lockTime, err := DecodeScriptNum(ops[11].push(), 5)
+	if err != nil || lockTime < 0 || lockTime > 0xffffffff {
+		return HTLC{}, false
+	}
+	h := HTLC{ops[5].Data, ops[9].Data, ops[16].Data, uint32(lockTime)}
+	if h.SecretHash == nil || h.RecipientHash == nil || h.RefundHash == nil {
+		return HTLC{}, false
+	}
+	if !bytes.Equal(h.Script(), s) {
+		return HTLC{}, false
+	}
+	return h, true
+}
+
+func NewHTLC(secretHash []byte, recipient, refund string, lockTime uint32) HTLC {
+	_, recipientHash := wallet.DecodeAddress(recipient)
+	_, refundHash := wallet.DecodeAddress(refund)
+	return HTLC{secretHash, recipientHash, refundHash, lockTime}
+}
+
+func HTLCSecretHash(secret []byte) []byte {
+	hash := sha256.Sum256(secret)
+	return hash[:]
+}
+
+// FindHTLC returns the first contract output of a transaction
+func (tx *Transaction) FindHTLC() (int, HTLC, bool) {
+	for outId, out := range tx.Outputs {
+		if h, ok := out.LockingScript.ParseHTLC(); ok {
+			return outId, h, true
+		}
+	}
+	return 0, HTLC{}, false
+}
+
+// NewHTLCRedeemTransaction claims a contract with the secret
+func NewHTLCRedeemTransaction(w *wallet.Wallet, contractTx *Transaction, secret []byte) (*Transaction, error) {
+	outId, h, ok := contractTx.FindHTLC()
+	if !ok {
+		return nil, errors.New("transaction has no contract output")
+	}
+	if !bytes.Equal(HTLCSecretHash(secret), h.SecretHash) {
+		return nil, errors.New("secret does not match the contract")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), h.RecipientHash) {
+		return nil, errors.New("wallet is not the contract recipient")
+	}
+	tx := newHTLCSpend(w, contractTx, outId, 0, SequenceFinal)
+	signature, err := tx.SignInput(0, w.PrivateKey, contractTx.Outputs[outId].LockingScript, SigHashAll)
+	if err != nil {
+		return nil, err
+	}
+	tx.Inputs[0].UnlockingScript = Script{}.AddData(signature).AddData(w.PublicKey).AddData(secret).AddInt(1)
+	return tx, nil
+}
+
+// NewHTLCRefundTransaction returns a contract to the sender after the lock time
+func NewHTLCRefundTransaction(w *wallet.Wallet, contractTx *Transaction) (*Transaction, error) {
+	outId, h, ok := contractTx.FindHTLC()
+	if !ok {
+		return nil, errors.New("transaction has no contract output")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), h.RefundHash) {
+		return nil, errors.New("wallet is not the contract sender")
+	}
+	tx := newHTLCSpend(w, contractTx, outId, h.LockTime, SequenceFinal-1)
+	signature, err := tx.SignInput(0, w.PrivateKey, contractTx.Outputs[outId].LockingScript, SigHashAll)
+	if err != nil {
+		return nil, err
+	}
+	tx.Inputs[0].UnlockingScript = Script{}.AddData(signature).AddData(w.PublicKey).AddInt(0)
+	return tx, nil
+}
+
+func newHTLCSpend(w *wallet.Wallet, contractTx *Transaction, outId int, lockTime uint32, sequence uint32) *Transaction {
+	input := TransactionInput{contractTx.ID, outId, nil, sequence}
+	contract := contractTx.Outputs[outId]
+	output := NewAssetTxOutput(contract.Value, string(w.Address()), contract.Asset)
+	tx := Transaction{nil, []TransactionInput{input}, []TransactionOutput{*output}, lockTime, nil, nil, 0}
+	tx.ID = tx.Hash()
+	return &tx
+}
+
+// ExtractHTLCSecret finds the secret revealed by a transaction redeeming
+// the contract output of contractID
+func ExtractHTLCSecret(tx *Transaction, contractID []byte) ([]byte, error) {
+	for _, in := range tx.Inputs {
+		if !bytes.Equal(in.ID, contractID) {
+			continue
+		}
+		data := in.UnlockingScript.PushedData()
+		if len(data) == 4 && asBool(data[3]) {
+			return data[2], nil
+		}
+	}
+	return nil, errors.New("transaction does not redeem the contract")
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Lock times below the threshold are block heights, above are unix times
+	LockTimeThreshold = 500000000
+
+	// A final sequence disables both the absolute lock time and the relative
+	// lock of an input
+	SequenceFinal = 0xffffffff
+
+	// Relative locks are encoded in the input sequence. The type flag selects
+	// units of 512 seconds instead of blocks.
+	SequenceLockTimeDisabled    = 1 << 31
+	SequenceLockTimeTypeFlag    = 1 << 22
+	SequenceLockTimeMask        = 0x0000ffff
+	SequenceLockTimeGranularity = 9
+
+	// Blocks must be later than the median time of the blocks before them,
+	// which keeps miners from satisfying time locks with an early timestamp
+	MedianTimeBlocks = 11
+)
+
+// MedianTimePast returns the median timestamp of the last MedianTimeBlocks
+// blocks ending at a block
+func (c *Chain) MedianTimePast(blockHash []byte) int64 {
+	var timestamps []int64
+	iter := &ChainIterator{blockHash, c.Database}
+	for len(timestamps) < MedianTimeBlocks {
+		block := iter.Next()
+		timestamps = append(timestamps, block.Timestamp)
+		if c.IsFirstBlock(block) {
+			break
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// checkTimestamp rejects blocks not later than the median time past of the
+// block they extend
+func (c *Chain) checkTimestamp(b *Block) error {
+	if b.Timestamp <= c.MedianTimePast(b.PrevHash) {
+		return ErrTimeTooOld
+	}
+	return nil
+}
+
+// blockTime returns the time of a new block on prevHash, the clock unless it
+// is behind the median time past
+func blockTime(c *Chain, prevHash []byte) int64 {
+	now := time.Now().Unix()
+	if c == nil || len(prevHash) == 0 {
+		return now
+	}
+	if median := c.MedianTimePast(prevHash); now <= median {
+		return median + 1
+	}
+	return now
+}
+
+// IsFinal reports whether the lock time of a transaction allows it to be
+// included in a block at the given height and time
+func (tx *Transaction) IsFinal(height int, timestamp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		limit = timestamp
+	}
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+// RelativeLock returns the blocks or seconds an input must wait after the
+// output it spends was mined
+func (in *TransactionInput) RelativeLock() (int64, bool, bool) {
+	if in.Sequence&SequenceLockTimeDisabled != 0 {
+		return 0, false, false
+	}
+	value := int64(in.Sequence & SequenceLockTimeMask)
+	if in.Sequence&SequenceLockTimeTypeFlag != 0 {
+		return value << SequenceLockTimeGranularity, true, true
+	}
+	return value, false, true
+}
+
+func RelativeLockSatisfied(in TransactionInput, previousBlock *Block, height int, timestamp int64) bool {
+	value, isTime, enabled := in.RelativeLock()
+	if !enabled {
+		return true
+	}
+	if isTime {
+		return timestamp >= previousBlock.Timestamp+value
+	}
+	return int64(height) >= int64(previousBlock.Height)+value
+}
+
+func (c inputChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.tx.LockTime)
+	// Both must be heights or both must be timestamps
+	if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+	// A final input would bypass the lock time of the transaction
+	return c.tx.Inputs[c.inId].Sequence != SequenceFinal
+}
+
+func (c inputChecker) CheckSequence(sequence int64) bool {
+	if sequence&SequenceLockTimeDisabled != 0 {
+		return true
+	}
+	inSequence := int64(c.tx.Inputs[c.inId].Sequence)
+	if inSequence&SequenceLockTimeDisabled != 0 {
+		return false
+	}
+	if (sequence&SequenceLockTimeTypeFlag != 0) != (inSequence&SequenceLockTimeTypeFlag != 0) {
+		return false
+	}
+	return sequence&SequenceLockTimeMask <= inSequence&SequenceLockTimeMask
+}
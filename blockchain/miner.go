@@ -0,0 +1,142 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JI-0/private-cryptocurrency/randomx"
+)
+
+var (
+	// Number of VMs mining a block, they share the dataset of the seed
+	MinerThreads = runtime.NumCPU()
+	// How often the hashrate is printed while mining, 0 disables it
+	HashrateInterval = 10 * time.Second
+
+	ErrMiningCanceled = errors.New("mining canceled")
+)
+
+type mineResult struct {
+	nonce int
+	hash  []byte
+}
+
+// Mine searches for a nonce on threads VMs, each on its own range of nonces,
+// until one is found or the context is canceled. Once every nonce is tried
+// the timestamp of the block is rolled forward.
+func (pow *ProofOfWork) Mine(ctx context.Context, threads int) (int, []byte, error) {
+	if threads < 1 {
+		threads = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	vms := []*randomx.RxVM{pow.VM}
+	defer func() {
+		for _, vm := range vms[1:] {
+			pow.epoch.release(vm)
+		}
+	}()
+	for len(vms) < threads {
+		vm, err := pow.epoch.acquire()
+		if err != nil {
+			return 0, nil, err
+		}
+		vms = append(vms, vm)
+	}
+
+	var hashes uint64
+	if HashrateInterval > 0 {
+		go reportHashrate(ctx, &hashes)
+	}
+	for {
+		if nonce, hash, ok := pow.round(ctx, vms, &hashes); ok {
+			return nonce, hash, nil
+		}
+		if ctx.Err() != nil {
+			return 0, nil, ErrMiningCanceled
+		}
+		pow.Block.Timestamp++
+		if now := time.Now().Unix(); now > pow.Block.Timestamp {
+			pow.Block.Timestamp = now
+		}
+	}
+}
+
+// round searches every nonce for the current timestamp
+func (pow *ProofOfWork) round(ctx context.Context, vms []*randomx.RxVM, hashes *uint64) (int, []byte, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	header := pow.Block.Header()
+	results := make(chan mineResult, len(vms))
+	var wg sync.WaitGroup
+	span := (MaxNonce + 1) / len(vms)
+	for i, vm := range vms {
+		end := (i + 1) * span
+		if i == len(vms)-1 {
+			end = MaxNonce + 1
+		}
+		wg.Add(1)
+		go func(vm *randomx.RxVM, start, end int) {
+			defer wg.Done()
+			if nonce, hash, ok := pow.search(ctx, vm, append([]byte{}, header...), start, end, hashes); ok {
+				results <- mineResult{nonce, hash}
+				cancel()
+			}
+		}(vm, i*span, end)
+	}
+	wg.Wait()
+	select {
+	case result := <-results:
+		return result.nonce, result.hash, true
+	default:
+		return 0, nil, false
+	}
+}
+
+// search hashes the nonces in [start, end) on one VM. Hashes are pipelined,
+// each call returns the hash of the previous nonce.
+func (pow *ProofOfWork) search(ctx context.Context, vm *randomx.RxVM, header []byte, start, end int, hashes *uint64) (int, []byte, bool) {
+	var intHash big.Int
+	nonce := header[HeaderNonceOffset:]
+	binary.BigEndian.PutUint32(nonce, uint32(start))
+	hash := make([]byte, randomx.RxHashSize)
+	vm.HashFirst(header)
+	for n := start + 1; n <= end; n++ {
+		if ctx.Err() != nil {
+			return 0, nil, false
+		}
+		binary.BigEndian.PutUint32(nonce, uint32(n))
+		vm.HashNext(header, hash)
+		atomic.AddUint64(hashes, 1)
+		intHash.SetBytes(hash)
+		if intHash.Cmp(pow.Target) == -1 {
+			return n - 1, hash, true
+		}
+	}
+	return 0, nil, false
+}
+
+func reportHashrate(ctx context.Context, hashes *uint64) {
+	ticker := time.NewTicker(HashrateInterval)
+	defer ticker.Stop()
+	last := uint64(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count := atomic.LoadUint64(hashes)
+			fmt.Printf("Hashrate: %.2f H/s\n", float64(count-last)/HashrateInterval.Seconds())
+			last = count
+		}
+	}
+}
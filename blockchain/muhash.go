@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+const muHashSize = 384
+
+// 2^3072 - 1103717, the largest 3072 bit safe prime
+var muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+// MuHash is a set hash, elements are multiplied modulo a prime so the result
+// does not depend on the order of insertion. Removed elements are collected
+// in the denominator and divided out when the hash is finalized.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+func NewMuHash() *MuHash {
+	return &MuHash{big.NewInt(1), big.NewInt(1)}
+}
+
+// muHashElement expands the data to a field element with sha512 in counter
+// mode
+func muHashElement(data []byte) *big.Int {
+	seed := sha512.Sum512(data)
+	expanded := make([]byte, 0, muHashSize)
+	block := make([]byte, 4+len(seed))
+	copy(block[4:], seed[:])
+	for i := uint32(0); len(expanded) < muHashSize; i++ {
+		binary.BigEndian.PutUint32(block, i)
+		hash := sha512.Sum512(block)
+		expanded = append(expanded, hash[:]...)
+	}
+	element := new(big.Int).SetBytes(expanded)
+	return element.Mod(element, muHashPrime)
+}
+
+func (m *MuHash) Insert(data []byte) {
+	m.numerator.Mul(m.numerator, muHashElement(data))
+	m.numerator.Mod(m.numerator, muHashPrime)
+}
+
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, muHashElement(data))
+	m.denominator.Mod(m.denominator, muHashPrime)
+}
+
+// Combine adds every element of another set
+func (m *MuHash) Combine(other *MuHash) {
+	m.numerator.Mul(m.numerator, other.numerator)
+	m.numerator.Mod(m.numerator, muHashPrime)
+	m.denominator.Mul(m.denominator, other.denominator)
+	m.denominator.Mod(m.denominator, muHashPrime)
+}
+
+func (m *MuHash) Copy() *MuHash {
+	return &MuHash{new(big.Int).Set(m.numerator), new(big.Int).Set(m.denominator)}
+}
+
+// Finalize returns the 64 byte hash of the set
+func (m *MuHash) Finalize() []byte {
+	value := new(big.Int).ModInverse(m.denominator, muHashPrime)
+	value.Mul(value, m.numerator)
+	value.Mod(value, muHashPrime)
+	hash := sha512.Sum512(value.FillBytes(make([]byte, muHashSize)))
+	return hash[:]
+}
+
+func (m *MuHash) Serialize() []byte {
+	data := make([]byte, 2*muHashSize)
+	m.numerator.FillBytes(data[:muHashSize])
+	m.denominator.FillBytes(data[muHashSize:])
+	return data
+}
+
+func DeserializeMuHash(data []byte) (*MuHash, error) {
+	if len(data) != 2*muHashSize {
+		return nil, errors.New("invalid MuHash encoding")
+	}
+	m := &MuHash{new(big.Int).SetBytes(data[:muHashSize]), new(big.Int).SetBytes(data[muHashSize:])}
+	if m.numerator.Cmp(muHashPrime) >= 0 || m.denominator.Cmp(muHashPrime) >= 0 || m.denominator.Sign() == 0 {
+		return nil, errors.New("invalid MuHash encoding")
+	}
+	return m, nil
+}
@@ -0,0 +1,381 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// PartialTransaction is a multisig spend passed between cosigners. It carries
+// the outputs being spent so it can be signed without access to the chain.
+type PartialTransaction struct {
+	Transaction     Transaction
+	PreviousOutputs []TransactionOutput
+	RedeemScript    Script
+	// Per input signatures keyed by hex encoded public key
+	Signatures []map[string][]byte
+}
+
+func NewMultisigTransaction(multisig *wallet.MultisigWallet, to string, amount Amount, UTXOs *UTXOSet) *PartialTransaction {
+	var inputs []TransactionInput
+	var outputs []TransactionOutput
+	var previousOutputs []TransactionOutput
+
+	scriptHash := wallet.PublicKeyHash(multisig.RedeemScript)
+
+	acc, validOutputs := UTXOs.FindSpendableOutputs(scriptHash, amount)
+	if acc < amount {
+		panic("Fund error")
+	}
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			panic(err)
+		}
+		previousTx, err := UTXOs.Chain.FindTransaction(txID)
+		if err != nil {
+			panic(err)
+		}
+		for _, out := range outs {
+			inputs = append(inputs, TransactionInput{txID, out, nil, SequenceFinal})
+			previousOutputs = append(previousOutputs, previousTx.Outputs[out])
+		}
+	}
+	outputs = append(outputs, *NewTxOutput(amount, to))
+	// Dust change is left as fee
+	if acc-amount >= DustThreshold {
+		outputs = append(outputs, *NewTxOutput(acc-amount, string(multisig.Address())))
+	}
+	tx := Transaction{nil, inputs, outputs, 0, nil, nil, 0}
+	tx.ID = tx.Hash()
+
+	signatures := make([]map[string][]byte, len(inputs))
+	for i := range signatures {
+		signatures[i] = make(map[string][]byte)
+	}
+	return &PartialTransaction{tx, previousOutputs, multisig.RedeemScript, signatures}
+}
+
+// Sign adds the signatures of one cosigner to every input
+func (ptx *PartialTransaction) Sign(privateKey wallet.PrivateKey, publicKey []byte) error {
+	_, keys, ok := ptx.RedeemScript.ParseMultisigScript()
+	if !ok {
+		return errors.New("redeem script is not a multisig script")
+	}
+	known := false
+	for _, key := range keys {
+		if bytes.Equal(key, publicKey) {
+			known = true
+		}
+	}
+	if !known {
+		return errors.New("key is not part of the multisig address")
+	}
+
+	for inId := range ptx.Transaction.Inputs {
+		signature, err := ptx.Transaction.SignInput(inId, privateKey, ptx.PreviousOutputs[inId].LockingScript, SigHashAll)
+		if err != nil {
+			return err
+		}
+		ptx.addSignature(inId, hex.EncodeToString(publicKey), signature)
+	}
+	return nil
+}
+
+// Combine merges the signatures collected by another cosigner
+func (ptx *PartialTransaction) Combine(other *PartialTransaction) error {
+	if !bytes.Equal(ptx.Transaction.ID, other.Transaction.ID) {
+		return errors.New("partial transactions spend different transactions")
+	}
+	for inId, signatures := range other.Signatures {
+		for key, signature := range signatures {
+			ptx.addSignature(inId, key, signature)
+		}
+	}
+	return nil
+}
+
+func (ptx *PartialTransaction) addSignature(inId int, key string, signature []byte) {
+	// Empty maps do not survive gob encoding
+	if ptx.Signatures[inId] == nil {
+		ptx.Signatures[inId] = make(map[string][]byte)
+	}
+	ptx.Signatures[inId][key] = signature
+}
+
+// Finalize builds the unlocking scripts once enough signatures are present
+func (ptx *PartialTransaction) Finalize() (*Transaction, error) {
+	required, keys, ok := ptx.RedeemScript.ParseMultisigScript()
+	if !ok {
+		return nil, errors.New("redeem script is not a multisig script")
+	}
+
+	tx := ptx.Transaction
+	tx.Inputs = append([]TransactionInput{}, ptx.Transaction.Inputs...)
+	for inId := range tx.Inputs {
+		var signatures [][]byte
+		for _, key := range keys {
+			if signature, ok := ptx.Signatures[inId][hex.EncodeToString(key)]; ok && len(signatures) < required {
+				signatures = append(signatures, signature)
+			}
+		}
+		if len(signatures) < required {
+			return nil, fmt.Errorf("input %d has %d of %d signatures", inId, len(signatures), required)
+		}
+		tx.Inputs[inId].UnlockingScript = MultisigUnlockingScript(signatures, ptx.RedeemScript)
+	}
+	for inId := range tx.Inputs {
+		if err := tx.VerifyInput(inId, ptx.PreviousOutputs[inId]); err != nil {
+			return nil, fmt.Errorf("input %d: %s", inId, err)
+		}
+	}
+	return &tx, nil
+}
+
+func (ptx *PartialTransaction) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(ptx); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializePartialTransaction(data []byte) (*PartialTransaction, error) {
+	var ptx PartialTransaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&ptx); err != nil {
+		return nil, err
+	}
+	return &ptx, nil
+}
+
+// MuSigSession is a spend from a MuSig address passed between cosigners.
+// Every input is signed for the aggregate key in three rounds: each cosigner
+// commits to a nonce, reveals it once every commitment is in and adds a
+// partial signature once every nonce is revealed.
+type MuSigSession struct {
+	Transaction     Transaction
+	PreviousOutputs []TransactionOutput
+	PublicKeys      [][]byte
+	// Per input commitments, nonces and partial signatures keyed by hex
+	// encoded public key
+	Commitments       []map[string][]byte
+	Nonces            []map[string][]byte
+	PartialSignatures []map[string][]byte
+}
+
+func NewMuSigTransaction(musig *wallet.MuSigWallet, to string, amount Amount, UTXOs *UTXOSet) *MuSigSession {
+	var inputs []TransactionInput
+	var outputs []TransactionOutput
+	var previousOutputs []TransactionOutput
+
+	acc, validOutputs := UTXOs.FindSpendableOutputs(wallet.PublicKeyHash(musig.AggregateKey), amount)
+	if acc < amount {
+		panic("Fund error")
+	}
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			panic(err)
+		}
+		previousTx, err := UTXOs.Chain.FindTransaction(txID)
+		if err != nil {
+			panic(err)
+		}
+		for _, out := range outs {
+			inputs = append(inputs, TransactionInput{txID, out, nil, SequenceFinal})
+			previousOutputs = append(previousOutputs, previousTx.Outputs[out])
+		}
+	}
+	outputs = append(outputs, *NewTxOutput(amount, to))
+	// Dust change is left as fee
+	if acc-amount >= DustThreshold {
+		outputs = append(outputs, *NewTxOutput(acc-amount, string(musig.Address())))
+	}
+	tx := Transaction{nil, inputs, outputs, 0, nil, nil, 0}
+	tx.ID = tx.Hash()
+
+	return &MuSigSession{
+		Transaction:       tx,
+		PreviousOutputs:   previousOutputs,
+		PublicKeys:        musig.PublicKeys,
+		Commitments:       make([]map[string][]byte, len(inputs)),
+		Nonces:            make([]map[string][]byte, len(inputs)),
+		PartialSignatures: make([]map[string][]byte, len(inputs)),
+	}
+}
+
+func (s *MuSigSession) checkKey(publicKey []byte) error {
+	for _, key := range s.PublicKeys {
+		if bytes.Equal(key, publicKey) {
+			return nil
+		}
+	}
+	return errors.New("key is not part of the musig address")
+}
+
+// complete reports whether every cosigner has an entry for every input
+func (s *MuSigSession) complete(entries []map[string][]byte) bool {
+	for _, keys := range entries {
+		for _, key := range s.PublicKeys {
+			if _, ok := keys[hex.EncodeToString(key)]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inputNonces returns the nonces of an input in the order of the keys
+func (s *MuSigSession) inputNonces(inId int) [][]byte {
+	var nonces [][]byte
+	for _, key := range s.PublicKeys {
+		nonces = append(nonces, s.Nonces[inId][hex.EncodeToString(key)])
+	}
+	return nonces
+}
+
+// Commit adds the nonce commitments of a cosigner. The returned nonces must
+// be kept private until Reveal and used for this session only.
+func (s *MuSigSession) Commit(publicKey []byte) ([]wallet.MuSigNonce, error) {
+	if err := s.checkKey(publicKey); err != nil {
+		return nil, err
+	}
+	nonces := make([]wallet.MuSigNonce, len(s.Transaction.Inputs))
+	for inId := range nonces {
+		nonces[inId] = wallet.NewMuSigNonce()
+		setSessionEntry(s.Commitments, inId, hex.EncodeToString(publicKey), nonces[inId].Commitment())
+	}
+	return nonces, nil
+}
+
+// Reveal adds the public nonces of a cosigner once every cosigner committed
+func (s *MuSigSession) Reveal(publicKey []byte, nonces []wallet.MuSigNonce) error {
+	if err := s.checkKey(publicKey); err != nil {
+		return err
+	}
+	if !s.complete(s.Commitments) {
+		return errors.New("not every cosigner committed to a nonce")
+	}
+	if len(nonces) != len(s.Transaction.Inputs) {
+		return errors.New("one nonce per input is needed")
+	}
+	key := hex.EncodeToString(publicKey)
+	for inId, nonce := range nonces {
+		if !bytes.Equal(nonce.Commitment(), s.Commitments[inId][key]) {
+			return fmt.Errorf("input %d: nonce does not match its commitment", inId)
+		}
+		setSessionEntry(s.Nonces, inId, key, nonce.Public)
+	}
+	return nil
+}
+
+// Sign adds the partial signatures of a cosigner once every nonce is revealed
+func (s *MuSigSession) Sign(privateKey wallet.PrivateKey, nonces []wallet.MuSigNonce) error {
+	publicKey := privateKey.PublicKey()
+	if err := s.checkKey(publicKey); err != nil {
+		return err
+	}
+	if !s.complete(s.Nonces) {
+		return errors.New("not every cosigner revealed a nonce")
+	}
+	if len(nonces) != len(s.Transaction.Inputs) {
+		return errors.New("one nonce per input is needed")
+	}
+	key := hex.EncodeToString(publicKey)
+	for inId, nonce := range nonces {
+		if !bytes.Equal(nonce.Public, s.Nonces[inId][key]) {
+			return fmt.Errorf("input %d: nonce was not revealed", inId)
+		}
+		hash, err := s.Transaction.SignatureHash(inId, s.PreviousOutputs[inId].LockingScript, SigHashAll)
+		if err != nil {
+			return err
+		}
+		partial, err := wallet.MuSigPartialSign(privateKey, nonce, s.PublicKeys, s.inputNonces(inId), hash)
+		if err != nil {
+			return err
+		}
+		setSessionEntry(s.PartialSignatures, inId, key, partial)
+	}
+	return nil
+}
+
+// Combine merges the rounds completed by another cosigner
+func (s *MuSigSession) Combine(other *MuSigSession) error {
+	if !bytes.Equal(s.Transaction.ID, other.Transaction.ID) {
+		return errors.New("musig sessions spend different transactions")
+	}
+	for inId := range s.Transaction.Inputs {
+		for key, value := range other.Commitments[inId] {
+			setSessionEntry(s.Commitments, inId, key, value)
+		}
+		for key, value := range other.Nonces[inId] {
+			setSessionEntry(s.Nonces, inId, key, value)
+		}
+		for key, value := range other.PartialSignatures[inId] {
+			setSessionEntry(s.PartialSignatures, inId, key, value)
+		}
+	}
+	return nil
+}
+
+func setSessionEntry(entries []map[string][]byte, inId int, key string, value []byte) {
+	// Empty maps do not survive gob encoding
+	if entries[inId] == nil {
+		entries[inId] = make(map[string][]byte)
+	}
+	entries[inId][key] = value
+}
+
+// Finalize adds up the partial signatures of every input
+func (s *MuSigSession) Finalize() (*Transaction, error) {
+	if !s.complete(s.PartialSignatures) {
+		return nil, errors.New("not every cosigner signed")
+	}
+	aggregateKey, err := wallet.AggregatePublicKeys(s.PublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	tx := s.Transaction
+	tx.Inputs = append([]TransactionInput{}, s.Transaction.Inputs...)
+	for inId := range tx.Inputs {
+		var partials [][]byte
+		for _, key := range s.PublicKeys {
+			partials = append(partials, s.PartialSignatures[inId][hex.EncodeToString(key)])
+		}
+		signature, err := wallet.MuSigCombine(s.inputNonces(inId), partials)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs[inId].UnlockingScript = PayToPublicKeyHashUnlockingScript(append(signature, byte(SigHashAll)), aggregateKey)
+	}
+	for inId := range tx.Inputs {
+		if err := tx.VerifyInput(inId, s.PreviousOutputs[inId]); err != nil {
+			return nil, fmt.Errorf("input %d: %s", inId, err)
+		}
+	}
+	return &tx, nil
+}
+
+func (s *MuSigSession) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(s); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeMuSigSession(data []byte) (*MuSigSession, error) {
+	var s MuSigSession
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
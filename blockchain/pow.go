@@ -2,12 +2,9 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
-	"math"
 	"math/big"
-	"runtime"
-	"sync"
 
 	"github.com/JI-0/private-cryptocurrency/randomx"
 )
@@ -16,145 +13,89 @@ const difficulty = 4
 const largePages = false
 const initKey = "bc2bcbb0f927bac40faaf98a468f4de5e81b9395ba6c970634abb4d7b1cb007b"
 
-var once sync.Once
-var flagsCache randomx.Flag
-
-var activeKeyNum = 0
-var activeKey = []byte("bc2bcbb0f927bac40faaf98a468f4de5e81b9395ba6c970634abb4d7b1cb007b")
-
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
-	cache  randomx.Cache
-	ds     randomx.Dataset
-	VM     randomx.VM
+	VM     *randomx.RxVM
+	epoch  *seedEpoch
 }
 
+// NewProof takes a VM for the seed of the block height from FullSeeds, or from
+// LightSeeds without fullMem. Destroy returns it.
 func NewProof(c *Chain, b *Block, fullMem bool) *ProofOfWork {
-	once.Do(func() {
-		flagsCache = randomx.GetFlags()
-	})
-	flags := flagsCache
+	seeds := LightSeeds
 	if fullMem {
-		flags |= randomx.FlagFullMEM
-	}
-	if largePages {
-		flags |= randomx.FlagLargePages
-	}
-
-	reqKeyNum := b.Height / 2048
-	if b.Height%2048 >= 64 {
-		reqKeyNum++
-	}
-	if reqKeyNum != activeKeyNum {
-		activeKeyNum = reqKeyNum
-		if reqKeyNum == 0 {
-			activeKey = []byte(initKey)
-		} else {
-			targetHeight := 2048 * (reqKeyNum - 1)
-			iter := c.Iterator()
-			for {
-				bck := iter.Next()
-				if bck.Height == targetHeight {
-					activeKey = bck.Hash
-					break
-				}
-			}
-		}
+		seeds = FullSeeds
 	}
-
-	cache, err := randomx.AllocCache(flags)
+	epoch, err := seeds.epoch(c, b)
 	if err != nil {
-		println(err)
+		panic(err)
 	}
-	randomx.InitCache(cache, activeKey)
-	ds, err := randomx.AllocDataset(flags)
+	vm, err := epoch.vm()
 	if err != nil {
-		println(err)
+		panic(err)
 	}
 
-	count := randomx.DatasetItemCount()
-	var wg sync.WaitGroup
-	var workerNum = uint32(runtime.NumCPU())
-	for i := uint32(0); i < workerNum; i++ {
-		wg.Add(1)
-		a := (count * i) / workerNum
-		b := (count * (i + 1)) / workerNum
-		go func() {
-			defer wg.Done()
-			randomx.InitDataset(ds, cache, a, b-a)
-		}()
-	}
-	wg.Wait()
+	pow := &ProofOfWork{b, proofTarget(), vm, epoch}
+	return pow
+}
 
-	vm, err := randomx.CreateVM(cache, ds, flags)
-	if err != nil {
-		println(err)
-	}
+// proofTarget is the value block hashes must be below
+func proofTarget() *big.Int {
+	return DifficultyTarget(difficulty)
+}
 
+// DifficultyTarget is the target of hashes starting with bits zero bits
+func DifficultyTarget(bits int) *big.Int {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-difficulty))
-	pow := &ProofOfWork{b, target, cache, ds, vm}
-	return pow
+	return target.Lsh(target, uint(256-bits))
 }
 
+// InitData is the header of the block with a nonce
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(difficulty)),
-		}, []byte{})
-	return data
+	header := pow.Block.Header()
+	binary.BigEndian.PutUint32(header[HeaderNonceOffset:], uint32(nonce))
+	return header
 }
 
+// Run mines on MinerThreads VMs until a nonce is found
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash []byte
-	nonce := 0
-
-	// Init mining
-	data := pow.InitData(nonce)
-	randomx.CalculateHashFirst(pow.VM, data)
-	nonce++
-
-	// Mine
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = randomx.CalculateHashNext(pow.VM, data)
-		fmt.Printf("\r%x", hash)
-
-		intHash.SetBytes(hash[:])
-
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
+	nonce, hash, err := pow.Mine(context.Background(), MinerThreads)
+	if err != nil {
+		panic(err)
 	}
-	nonce--
-
-	fmt.Println()
+	return nonce, hash
+}
 
-	return nonce, hash[:]
+// Hash is the proof of work hash of the block with its nonce
+func (pow *ProofOfWork) Hash() []byte {
+	hash := make([]byte, randomx.RxHashSize)
+	pow.VM.Hash(pow.InitData(pow.Block.Nonce), hash)
+	return hash
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
-	data := pow.InitData(pow.Block.Nonce)
-	hash := randomx.CalculateHash(pow.VM, data)
+	hash := pow.Hash()
 
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1
 }
 
+// VerifyProof validates the proof of work of a block on a light VM, which
+// needs only the 256 MB cache of the seed. The hash of the block, which it is
+// stored and linked by, must be its proof of work hash.
+func VerifyProof(c *Chain, b *Block) bool {
+	pow := NewProof(c, b, false)
+	defer pow.Destroy()
+	hash := pow.Hash()
+	return bytes.Equal(hash, b.Hash) && new(big.Int).SetBytes(hash).Cmp(pow.Target) == -1
+}
+
 func (pow *ProofOfWork) Destroy() {
-	randomx.DestroyVM(pow.VM)
-	randomx.ReleaseDataset(pow.ds)
-	randomx.ReleaseCache(pow.cache)
+	pow.epoch.release(pow.VM)
 }
 
 func ToHex(num int64) []byte {
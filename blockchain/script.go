@@ -0,0 +1,855 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// Script is a small stack based, non Turing complete language used to lock
+// transaction outputs and to unlock them from transaction inputs.
+// There are no loops or jumps, every opcode is executed at most once.
+type Script []byte
+
+type Opcode byte
+
+const (
+	Op0         Opcode = 0x00
+	OpPushData1 Opcode = 0x4c
+	OpPushData2 Opcode = 0x4d
+	Op1         Opcode = 0x51
+	Op16        Opcode = 0x60
+
+	OpIf     Opcode = 0x63
+	OpNotIf  Opcode = 0x64
+	OpElse   Opcode = 0x67
+	OpEndIf  Opcode = 0x68
+	OpVerify Opcode = 0x69
+	OpReturn Opcode = 0x6a
+
+	OpDrop Opcode = 0x75
+	OpDup  Opcode = 0x76
+	OpSwap Opcode = 0x7c
+	OpSize Opcode = 0x82
+
+	OpEqual       Opcode = 0x87
+	OpEqualVerify Opcode = 0x88
+
+	OpSHA256              Opcode = 0xa8
+	OpHash160             Opcode = 0xa9
+	OpSHA512              Opcode = 0xaa
+	OpCheckSig            Opcode = 0xac
+	OpCheckSigVerify      Opcode = 0xad
+	OpCheckMultisig       Opcode = 0xae
+	OpCheckMultisigVerify Opcode = 0xaf
+
+	OpCheckLockTimeVerify Opcode = 0xb1
+	OpCheckSequenceVerify Opcode = 0xb2
+)
+
+const (
+	MaxScriptSize    = 10000
+	MaxScriptOps     = 201
+	MaxStackSize     = 1000
+	MaxScriptElement = 4096
+	MaxMultisigKeys  = 16
+
+	// Largest payload of a data carrier output
+	MaxDataCarrierSize = 80
+)
+
+var opcodeNames = map[Opcode]string{
+	Op0:                   "OP_0",
+	OpPushData1:           "OP_PUSHDATA1",
+	OpPushData2:           "OP_PUSHDATA2",
+	OpIf:                  "OP_IF",
+	OpNotIf:               "OP_NOTIF",
+	OpElse:                "OP_ELSE",
+	OpEndIf:               "OP_ENDIF",
+	OpVerify:              "OP_VERIFY",
+	OpReturn:              "OP_RETURN",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpSwap:                "OP_SWAP",
+	OpSize:                "OP_SIZE",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpSHA256:              "OP_SHA256",
+	OpHash160:             "OP_HASH160",
+	OpSHA512:              "OP_SHA512",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	OpCheckMultisig:       "OP_CHECKMULTISIG",
+	OpCheckMultisigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+	OpCheckSequenceVerify: "OP_CHECKSEQUENCEVERIFY",
+}
+
+var (
+	ErrScriptInvalid     = errors.New("script is malformed")
+	ErrScriptFailed      = errors.New("script evaluated to false")
+	ErrScriptVerify      = errors.New("script verify operation failed")
+	ErrScriptStack       = errors.New("script stack underflow or overflow")
+	ErrScriptUnbalanced  = errors.New("script has unbalanced conditional")
+	ErrScriptReturn      = errors.New("script is provably unspendable")
+	ErrScriptOpcode      = errors.New("script uses unknown opcode")
+	ErrScriptNotPushOnly = errors.New("unlocking script must only push data")
+	ErrScriptNullFail    = errors.New("script signature check failed with a non-empty signature")
+)
+
+func (op Opcode) String() string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	if op >= Op1 && op <= Op16 {
+		return fmt.Sprintf("OP_%d", op-Op1+1)
+	}
+	return fmt.Sprintf("OP_UNKNOWN_%02x", byte(op))
+}
+
+type parsedOp struct {
+	Op   Opcode
+	Data []byte
+}
+
+// Script building
+func (s Script) AddOp(op Opcode) Script {
+	return append(s, byte(op))
+}
+
+func (s Script) AddInt(n int) Script {
+	if n == 0 {
+		return s.AddOp(Op0)
+	}
+	if n > 0 && n <= 16 {
+		return s.AddOp(Op1 + Opcode(n-1))
+	}
+	return s.AddData(EncodeScriptNum(int64(n)))
+}
+
+func (s Script) AddData(data []byte) Script {
+	switch {
+	case len(data) < int(OpPushData1):
+		s = append(s, byte(len(data)))
+	case len(data) <= 0xff:
+		s = append(s, byte(OpPushData1), byte(len(data)))
+	default:
+		var size [2]byte
+		binary.LittleEndian.PutUint16(size[:], uint16(len(data)))
+		s = append(s, byte(OpPushData2))
+		s = append(s, size[:]...)
+	}
+	return append(s, data...)
+}
+
+func (s Script) parse() ([]parsedOp, error) {
+	var ops []parsedOp
+	for i := 0; i < len(s); {
+		op := Opcode(s[i])
+		i++
+		size := 0
+		switch {
+		case op > Op0 && op < OpPushData1:
+			size = int(op)
+		case op == OpPushData1:
+			if i+1 > len(s) {
+				return nil, ErrScriptInvalid
+			}
+			size = int(s[i])
+			i++
+		case op == OpPushData2:
+			if i+2 > len(s) {
+				return nil, ErrScriptInvalid
+			}
+			size = int(binary.LittleEndian.Uint16(s[i : i+2]))
+			i += 2
+		default:
+			ops = append(ops, parsedOp{op, nil})
+			continue
+		}
+		if i+size > len(s) {
+			return nil, ErrScriptInvalid
+		}
+		ops = append(ops, parsedOp{op, s[i : i+size]})
+		i += size
+	}
+	return ops, nil
+}
+
+// PushedData returns the data pushed by a push only script or nil otherwise
+func (s Script) PushedData() [][]byte {
+	ops, err := s.parse()
+	if err != nil {
+		return nil
+	}
+	var data [][]byte
+	for _, op := range ops {
+		if !op.isPush() {
+			return nil
+		}
+		data = append(data, op.push())
+	}
+	return data
+}
+
+func (s Script) IsPushOnly() bool {
+	ops, err := s.parse()
+	if err != nil {
+		return false
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Script) String() string {
+	ops, err := s.parse()
+	if err != nil {
+		return fmt.Sprintf("[invalid %x]", []byte(s))
+	}
+	var parts []string
+	for _, op := range ops {
+		if op.Data != nil {
+			parts = append(parts, fmt.Sprintf("%x", op.Data))
+		} else {
+			parts = append(parts, op.Op.String())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (op parsedOp) isPush() bool {
+	return op.Data != nil || op.Op == Op0 || (op.Op >= Op1 && op.Op <= Op16)
+}
+
+func (op parsedOp) push() []byte {
+	switch {
+	case op.Data != nil:
+		return op.Data
+	case op.Op == Op0:
+		return []byte{}
+	default:
+		return EncodeScriptNum(int64(op.Op - Op1 + 1))
+	}
+}
+
+// Standard templates
+func PayToPublicKeyHashScript(publicKeyHash []byte) Script {
+	return Script{}.
+		AddOp(OpDup).
+		AddOp(OpHash160).
+		AddData(publicKeyHash).
+		AddOp(OpEqualVerify).
+		AddOp(OpCheckSig)
+}
+
+func PayToPublicKeyHashUnlockingScript(signature, publicKey []byte) Script {
+	return Script{}.AddData(signature).AddData(publicKey)
+}
+
+// PublicKeyHash returns the hash a pay-to-public-key-hash script is locked to
+func (s Script) PublicKeyHash() []byte {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 5 {
+		return nil
+	}
+	if ops[0].Op != OpDup || ops[1].Op != OpHash160 || ops[2].Data == nil ||
+		ops[3].Op != OpEqualVerify || ops[4].Op != OpCheckSig {
+		return nil
+	}
+	return ops[2].Data
+}
+
+// Data carrier outputs start with OP_RETURN so they can never be spent
+func NullDataScript(data []byte) Script {
+	return Script{}.AddOp(OpReturn).AddData(data)
+}
+
+func (s Script) IsUnspendable() bool {
+	return len(s) > 0 && Opcode(s[0]) == OpReturn
+}
+
+// NullData returns the payload of a data carrier script
+func (s Script) NullData() ([]byte, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 2 || ops[0].Op != OpReturn || !ops[1].isPush() {
+		return nil, false
+	}
+	return ops[1].push(), true
+}
+
+// Redeem scripts are revealed by the spender and must hash to the value in
+// the locking script before they are executed
+func PayToScriptHashScript(scriptHash []byte) Script {
+	return Script{}.
+		AddOp(OpHash160).
+		AddData(scriptHash).
+		AddOp(OpEqual)
+}
+
+func (s Script) ScriptHash() []byte {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 3 {
+		return nil
+	}
+	if ops[0].Op != OpHash160 || ops[1].Data == nil || ops[2].Op != OpEqual {
+		return nil
+	}
+	return ops[1].Data
+}
+
+func (s Script) IsPayToScriptHash() bool {
+	return s.ScriptHash() != nil
+}
+
+// AddressHash returns the hash encoded in the address an output pays to
+func (s Script) AddressHash() []byte {
+	if _, _, inner, ok := s.splitTimeLock(); ok {
+		return inner.AddressHash()
+	}
+	if hash := s.PublicKeyHash(); hash != nil {
+		return hash
+	}
+	return s.ScriptHash()
+}
+
+// TimeLockedScript prefixes a locking script with an absolute lock time
+// (OP_CHECKLOCKTIMEVERIFY) or a relative sequence lock (OP_CHECKSEQUENCEVERIFY)
+func TimeLockedScript(op Opcode, lock uint32, script Script) Script {
+	locked := Script{}.AddData(EncodeScriptNum(int64(lock))).AddOp(op).AddOp(OpDrop)
+	return append(locked, script...)
+}
+
+// LockTime returns the absolute lock time of a time locked script
+func (s Script) LockTime() (uint32, bool) {
+	op, lock, _, ok := s.splitTimeLock()
+	if !ok || op != OpCheckLockTimeVerify {
+		return 0, false
+	}
+	return lock, true
+}
+
+// RelativeLockTime returns the sequence lock of a time locked script
+func (s Script) RelativeLockTime() (uint32, bool) {
+	op, lock, _, ok := s.splitTimeLock()
+	if !ok || op != OpCheckSequenceVerify {
+		return 0, false
+	}
+	return lock, true
+}
+
+func (s Script) splitTimeLock() (Opcode, uint32, Script, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) < 4 || !ops[0].isPush() || ops[2].Op != OpDrop {
+		return 0, 0, nil, false
+	}
+	if ops[1].Op != OpCheckLockTimeVerify && ops[1].Op != OpCheckSequenceVerify {
+		return 0, 0, nil, false
+	}
+	lock, err := DecodeScriptNum(ops[0].push(), 5)
+	if err != nil || lock < 0 || lock > 0xffffffff {
+		return 0, 0, nil, false
+	}
+	return ops[1].Op, uint32(lock), buildScript(ops[3:]), true
+}
+
+func buildScript(ops []parsedOp) Script {
+	script := Script{}
+	for _, op := range ops {
+		if op.Data != nil {
+			script = script.AddData(op.Data)
+		} else {
+			script = script.AddOp(op.Op)
+		}
+	}
+	return script
+}
+
+func MultisigScript(required int, publicKeys [][]byte) Script {
+	if required < 1 || required > len(publicKeys) || len(publicKeys) > MaxMultisigKeys {
+		panic("invalid multisig parameters")
+	}
+	script := Script{}.AddInt(required)
+	for _, key := range publicKeys {
+		script = script.AddData(key)
+	}
+	return script.AddInt(len(publicKeys)).AddOp(OpCheckMultisig)
+}
+
+// ParseMultisigScript returns the required signature count and the keys of
+// a standard m-of-n multisig script
+func (s Script) ParseMultisigScript() (int, [][]byte, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Op != OpCheckMultisig {
+		return 0, nil, false
+	}
+	required, ok := ops[0].smallInt()
+	if !ok {
+		return 0, nil, false
+	}
+	total, ok := ops[len(ops)-2].smallInt()
+	if !ok || total != len(ops)-3 || required < 1 || required > total {
+		return 0, nil, false
+	}
+	var keys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.Data == nil {
+			return 0, nil, false
+		}
+		keys = append(keys, op.Data)
+	}
+	return required, keys, true
+}
+
+func MultisigUnlockingScript(signatures [][]byte, redeemScript Script) Script {
+	script := Script{}
+	for _, signature := range signatures {
+		script = script.AddData(signature)
+	}
+	return script.AddData(redeemScript)
+}
+
+func (op parsedOp) smallInt() (int, bool) {
+	if op.Op >= Op1 && op.Op <= Op16 {
+		return int(op.Op-Op1) + 1, true
+	}
+	return 0, false
+}
+
+// Script numbers are little endian with the sign in the top bit
+func EncodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+func DecodeScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, ErrScriptInvalid
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+	return result, nil
+}
+
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// Negative zero is false
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// TransactionChecker validates signatures and locks found in a script
+// against the transaction being spent
+type TransactionChecker interface {
+	CheckSignature(signature, publicKey []byte) bool
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+// SignatureBatcher is implemented by checkers that can defer the signature
+// of OP_CHECKSIG to a batch verified later. This cannot change the result of
+// a script because a failing signature must be empty.
+type SignatureBatcher interface {
+	DeferSignature(signature, publicKey []byte) bool
+}
+
+type ScriptEngine struct {
+	checker TransactionChecker
+	stack   [][]byte
+	opCount int
+}
+
+func NewScriptEngine(checker TransactionChecker) *ScriptEngine {
+	return &ScriptEngine{checker: checker}
+}
+
+// VerifyScripts runs the unlocking script and then the locking script on the
+// resulting stack. The spend is valid if the top of the stack is true.
+// For pay-to-script-hash outputs the revealed redeem script is run last on
+// the remaining unlocking stack.
+func VerifyScripts(unlocking, locking Script, checker TransactionChecker) error {
+	if !unlocking.IsPushOnly() {
+		return ErrScriptNotPushOnly
+	}
+	engine := NewScriptEngine(checker)
+	if err := engine.Execute(unlocking); err != nil {
+		return err
+	}
+	unlockingStack := append([][]byte{}, engine.stack...)
+	if err := engine.Execute(locking); err != nil {
+		return err
+	}
+	if !engine.succeeded() {
+		return ErrScriptFailed
+	}
+
+	if locking.IsPayToScriptHash() {
+		if len(unlockingStack) == 0 {
+			return ErrScriptStack
+		}
+		redeemScript := Script(unlockingStack[len(unlockingStack)-1])
+		engine.stack = unlockingStack[:len(unlockingStack)-1]
+		if err := engine.Execute(redeemScript); err != nil {
+			return err
+		}
+		if !engine.succeeded() {
+			return ErrScriptFailed
+		}
+	}
+	return nil
+}
+
+func (e *ScriptEngine) succeeded() bool {
+	return len(e.stack) > 0 && asBool(e.stack[len(e.stack)-1])
+}
+
+func (e *ScriptEngine) push(data []byte) error {
+	if len(data) > MaxScriptElement {
+		return ErrScriptInvalid
+	}
+	if len(e.stack) >= MaxStackSize {
+		return ErrScriptStack
+	}
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *ScriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, ErrScriptStack
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *ScriptEngine) peek(depth int) ([]byte, error) {
+	if depth >= len(e.stack) {
+		return nil, ErrScriptStack
+	}
+	return e.stack[len(e.stack)-1-depth], nil
+}
+
+func (e *ScriptEngine) Execute(script Script) error {
+	if len(script) > MaxScriptSize {
+		return ErrScriptInvalid
+	}
+	ops, err := script.parse()
+	if err != nil {
+		return err
+	}
+
+	// Conditional execution state, one entry per open OP_IF
+	var conditions []bool
+	executing := func() bool {
+		for _, c := range conditions {
+			if !c {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			e.opCount++
+			if e.opCount > MaxScriptOps {
+				return ErrScriptInvalid
+			}
+		}
+
+		switch op.Op {
+		case OpIf, OpNotIf:
+			value := false
+			if executing() {
+				top, err := e.pop()
+				if err != nil {
+					return err
+				}
+				value = asBool(top)
+				if op.Op == OpNotIf {
+					value = !value
+				}
+			}
+			conditions = append(conditions, value)
+			continue
+		case OpElse:
+			if len(conditions) == 0 {
+				return ErrScriptUnbalanced
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OpEndIf:
+			if len(conditions) == 0 {
+				return ErrScriptUnbalanced
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if !executing() {
+			continue
+		}
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+
+	if len(conditions) != 0 {
+		return ErrScriptUnbalanced
+	}
+	return nil
+}
+
+func (e *ScriptEngine) step(op parsedOp) error {
+	if op.isPush() {
+		return e.push(op.push())
+	}
+
+	switch op.Op {
+	case OpVerify:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return ErrScriptVerify
+		}
+	case OpReturn:
+		return ErrScriptReturn
+	case OpDrop:
+		if _, err := e.pop(); err != nil {
+			return err
+		}
+	case OpDup:
+		top, err := e.peek(0)
+		if err != nil {
+			return err
+		}
+		return e.push(top)
+	case OpSwap:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.stack = append(e.stack, a, b)
+	case OpSize:
+		top, err := e.peek(0)
+		if err != nil {
+			return err
+		}
+		return e.push(EncodeScriptNum(int64(len(top))))
+	case OpEqual, OpEqualVerify:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.Op == OpEqualVerify {
+			if !equal {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(fromBool(equal))
+	case OpHash160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(wallet.PublicKeyHash(top))
+	case OpSHA256:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		return e.push(hash[:])
+	case OpSHA512:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha512.Sum512(top)
+		return e.push(hash[:])
+	case OpCheckSig, OpCheckSigVerify:
+		publicKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		valid := false
+		if e.checker != nil && len(signature) > 0 {
+			if batcher, ok := e.checker.(SignatureBatcher); ok && batcher.DeferSignature(signature, publicKey) {
+				valid = true
+			} else {
+				valid = e.checker.CheckSignature(signature, publicKey)
+			}
+			if !valid {
+				return ErrScriptNullFail
+			}
+		}
+		if op.Op == OpCheckSigVerify {
+			if !valid {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(fromBool(valid))
+	case OpCheckLockTimeVerify, OpCheckSequenceVerify:
+		top, err := e.peek(0)
+		if err != nil {
+			return err
+		}
+		lock, err := DecodeScriptNum(top, 5)
+		if err != nil {
+			return err
+		}
+		if lock < 0 || e.checker == nil {
+			return ErrScriptVerify
+		}
+		if op.Op == OpCheckLockTimeVerify && !e.checker.CheckLockTime(lock) {
+			return ErrScriptVerify
+		}
+		if op.Op == OpCheckSequenceVerify && !e.checker.CheckSequence(lock) {
+			return ErrScriptVerify
+		}
+	case OpCheckMultisig, OpCheckMultisigVerify:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op.Op == OpCheckMultisigVerify {
+			if !valid {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(fromBool(valid))
+	default:
+		return ErrScriptOpcode
+	}
+	return nil
+}
+
+// Stack layout is sig_1 .. sig_m m key_1 .. key_n n with signatures in the
+// same order as the keys they belong to
+func (e *ScriptEngine) checkMultisig() (bool, error) {
+	popCount := func(max int) (int, error) {
+		data, err := e.pop()
+		if err != nil {
+			return 0, err
+		}
+		n, err := DecodeScriptNum(data, 4)
+		if err != nil {
+			return 0, err
+		}
+		if n < 0 || n > int64(max) {
+			return 0, ErrScriptInvalid
+		}
+		return int(n), nil
+	}
+
+	keyCount, err := popCount(MaxMultisigKeys)
+	if err != nil {
+		return false, err
+	}
+	e.opCount += keyCount
+	if e.opCount > MaxScriptOps {
+		return false, ErrScriptInvalid
+	}
+	keys := make([][]byte, keyCount)
+	for i := keyCount - 1; i >= 0; i-- {
+		if keys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+	sigCount, err := popCount(keyCount)
+	if err != nil {
+		return false, err
+	}
+	signatures := make([][]byte, sigCount)
+	for i := sigCount - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	if e.checker == nil {
+		return sigCount == 0, nil
+	}
+	keyIdx := 0
+	for _, signature := range signatures {
+		for {
+			if keyCount-keyIdx < 1 {
+				return false, nil
+			}
+			key := keys[keyIdx]
+			keyIdx++
+			if len(signature) > 0 && e.checker.CheckSignature(signature, key) {
+				break
+			}
+		}
+	}
+	return true, nil
+}
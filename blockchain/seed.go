@@ -0,0 +1,318 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/JI-0/private-cryptocurrency/randomx"
+)
+
+// The seed changes every SeedEpochBlocks blocks. A new seed is used
+// SeedEpochLag blocks after its seed block, which leaves time to prepare the
+// next dataset in the background.
+const (
+	SeedEpochBlocks = 2048
+	SeedEpochLag    = 64
+)
+
+var (
+	// Seeds used by miners, VMs run on a full dataset
+	FullSeeds = NewSeedManager(true)
+	// Seeds used by verifiers, VMs run on the cache only
+	LightSeeds = NewSeedManager(false)
+)
+
+// SeedEpoch returns the epoch of the seed used at a height
+func SeedEpoch(height int) int {
+	epoch := height / SeedEpochBlocks
+	if height%SeedEpochBlocks >= SeedEpochLag {
+		epoch++
+	}
+	return epoch
+}
+
+// Seed lookups kept per chain before the cache is cleared
+const maxSeedLookups = 1 << 14
+
+// seedKey returns the seed of an epoch for a block on top of prevHash, the
+// hash of the seed block in its ancestry
+func seedKey(c *Chain, prevHash []byte, epoch int) ([]byte, error) {
+	if epoch == 0 {
+		return []byte(initKey), nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("the seed of epoch %d is in a chain", epoch)
+	}
+	return c.seedHash(prevHash, SeedEpochBlocks*(epoch-1))
+}
+
+type seedLookup struct {
+	hash   string
+	height int
+}
+
+// seedHash returns the hash of the block at a seed height in the ancestry of
+// a block, itself included. Blocks below a snapshot base are taken from the
+// seeds stored with the snapshot. The answer is cached for every block
+// walked, so the walk for a block on the tip stops at its parent.
+func (c *Chain) seedHash(hash []byte, height int) ([]byte, error) {
+	c.seedMutex.Lock()
+	defer c.seedMutex.Unlock()
+	if c.seedHashes == nil || len(c.seedHashes) >= maxSeedLookups {
+		c.seedHashes = make(map[seedLookup][]byte)
+	}
+	var walked []seedLookup
+	var seed []byte
+	for {
+		lookup := seedLookup{string(hash), height}
+		if cached, ok := c.seedHashes[lookup]; ok {
+			seed = cached
+			break
+		}
+		walked = append(walked, lookup)
+		block, err := c.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		if block.Height == height {
+			seed = block.Hash
+			break
+		}
+		if block.Height < height {
+			return nil, errors.New("seed block above the block")
+		}
+		if c.IsFirstBlock(&block) {
+			if seed, err = c.snapshotSeed(height); err != nil {
+				return nil, err
+			}
+			break
+		}
+		hash = block.PrevHash
+	}
+	for _, lookup := range walked {
+		c.seedHashes[lookup] = seed
+	}
+	return seed, nil
+}
+
+// seedEpoch holds the cache and dataset of a seed and a pool of VMs on them
+type seedEpoch struct {
+	number int
+	key    []byte
+	flags  randomx.Flag
+	cache  *randomx.RxCache
+	ds     *randomx.RxDataset
+	ready  chan struct{}
+	err    error
+
+	mutex   sync.Mutex
+	vms     []*randomx.RxVM
+	users   int
+	retired bool
+}
+
+// init allocates and initializes the cache and, in full memory mode, the
+// dataset
+func (e *seedEpoch) init(fullMem bool) {
+	defer close(e.ready)
+	if e.cache, e.err = randomx.NewCache(e.key, e.flags); e.err != nil || !fullMem {
+		return
+	}
+	e.ds, e.err = randomx.NewDataset(e.cache, e.flags)
+}
+
+// acquire takes another VM for a caller already holding one of the epoch
+func (e *seedEpoch) acquire() (*randomx.RxVM, error) {
+	e.mutex.Lock()
+	e.users++
+	e.mutex.Unlock()
+	return e.vm()
+}
+
+// vm waits for the epoch to be ready and takes a VM from the pool for a user
+// counted already, creating one if the pool is empty. The user is dropped if
+// it fails.
+func (e *seedEpoch) vm() (*randomx.RxVM, error) {
+	<-e.ready
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err != nil {
+		e.leave()
+		return nil, e.err
+	}
+	if n := len(e.vms); n > 0 {
+		vm := e.vms[n-1]
+		e.vms = e.vms[:n-1]
+		return vm, nil
+	}
+	vm, err := randomx.NewVM(e.cache, e.ds, e.flags)
+	if err != nil {
+		e.leave()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// release returns a VM to the pool
+func (e *seedEpoch) release(vm *randomx.RxVM) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.vms = append(e.vms, vm)
+	e.leave()
+}
+
+// leave drops a user, the last user of a retired epoch frees it. The mutex
+// of the epoch must be held.
+func (e *seedEpoch) leave() {
+	e.users--
+	if e.retired && e.users == 0 {
+		e.free()
+	}
+}
+
+// retire frees the epoch once no VM on it is in use
+func (e *seedEpoch) retire() {
+	go func() {
+		<-e.ready
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		e.retired = true
+		if e.users == 0 {
+			e.free()
+		}
+	}()
+}
+
+func (e *seedEpoch) free() {
+	for _, vm := range e.vms {
+		vm.Close()
+	}
+	e.vms = nil
+	if e.ds != nil {
+		e.ds.Close()
+		e.ds = nil
+	}
+	if e.cache != nil {
+		e.cache.Close()
+		e.cache = nil
+	}
+}
+
+// SeedManager keeps the caches and datasets of the current and the next seed
+// so they are initialized once and shared by every proof of work. It is safe
+// for concurrent use.
+type SeedManager struct {
+	fullMem bool
+
+	once   sync.Once
+	flags  randomx.Flag
+	mutex  sync.Mutex
+	epochs []*seedEpoch
+}
+
+func NewSeedManager(fullMem bool) *SeedManager {
+	return &SeedManager{fullMem: fullMem}
+}
+
+func (m *SeedManager) getFlags() randomx.Flag {
+	m.once.Do(func() {
+		m.flags = randomx.GetFlags()
+		if m.fullMem {
+			m.flags |= randomx.FlagFullMEM
+		}
+		if largePages {
+			m.flags |= randomx.FlagLargePages
+		}
+	})
+	return m.flags
+}
+
+// epoch returns the epoch of the seed used by a block with a user counted,
+// and once the block of the next seed is in its ancestry, starts preparing
+// the next epoch
+func (m *SeedManager) epoch(c *Chain, b *Block) (*seedEpoch, error) {
+	number := SeedEpoch(b.Height)
+	key, err := seedKey(c, b.PrevHash, number)
+	if err != nil {
+		return nil, err
+	}
+	e := m.load(number, key, true)
+	if c != nil && b.Height-1 >= SeedEpochBlocks*number {
+		if next, err := seedKey(c, b.PrevHash, number+1); err == nil {
+			m.load(number+1, next, false)
+		}
+	}
+	return e, nil
+}
+
+// load returns an epoch, starting its initialization if it is not kept.
+// Epochs are kept per seed, another chain or a fork of the seed block gets
+// its own. Only two epochs are kept, one with the same number and another
+// seed is retired first, otherwise the one furthest from the new one. The
+// user is counted before the manager is unlocked, so the epoch cannot be
+// retired and freed before it is used.
+func (m *SeedManager) load(number int, key []byte, use bool) *seedEpoch {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e := m.find(number, key)
+	if e == nil {
+		e = &seedEpoch{
+			number: number,
+			key:    key,
+			flags:  m.getFlags(),
+			ready:  make(chan struct{}),
+		}
+		go e.init(m.fullMem)
+		m.keep(e)
+	}
+	if use {
+		e.mutex.Lock()
+		e.users++
+		e.mutex.Unlock()
+	}
+	return e
+}
+
+func (m *SeedManager) find(number int, key []byte) *seedEpoch {
+	for _, e := range m.epochs {
+		if e.number == number && bytes.Equal(e.key, key) {
+			return e
+		}
+	}
+	return nil
+}
+
+// keep adds an epoch, retiring another one if two are kept
+func (m *SeedManager) keep(e *seedEpoch) {
+	if len(m.epochs) < 2 {
+		m.epochs = append(m.epochs, e)
+		return
+	}
+	replaced := 0
+	if m.epochs[1].number == e.number || (m.epochs[0].number != e.number &&
+		distance(m.epochs[1].number, e.number) > distance(m.epochs[0].number, e.number)) {
+		replaced = 1
+	}
+	m.epochs[replaced].retire()
+	m.epochs[replaced] = e
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Close retires every epoch, their memory is freed when the VMs in use are
+// returned
+func (m *SeedManager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.epochs {
+		e.retire()
+	}
+	m.epochs = nil
+}
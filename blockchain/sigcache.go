@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const DefaultSignatureCacheSize = 100000
+
+// Signatures verified when a transaction enters the memory pool are
+// remembered, so they are not verified again once it is mined in a block
+var signatureCache atomic.Pointer[SignatureCache]
+
+func init() {
+	signatureCache.Store(NewSignatureCache(DefaultSignatureCacheSize))
+}
+
+// SignatureCache is a bounded set of valid (sighash, public key, signature)
+// triples. When it is full a random entry is evicted.
+type SignatureCache struct {
+	mutex      sync.RWMutex
+	entries    map[[sha512.Size]byte]struct{}
+	maxEntries int
+}
+
+func NewSignatureCache(maxEntries int) *SignatureCache {
+	return &SignatureCache{entries: make(map[[sha512.Size]byte]struct{}), maxEntries: maxEntries}
+}
+
+// signatureCacheKey length-prefixes each field, so no two triples share
+// their encoding
+func signatureCacheKey(hash, publicKey, signature []byte) [sha512.Size]byte {
+	var data []byte
+	for _, field := range [][]byte{hash, publicKey, signature} {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	return sha512.Sum512(data)
+}
+
+func (c *SignatureCache) Contains(hash, publicKey, signature []byte) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.entries[signatureCacheKey(hash, publicKey, signature)]
+	return ok
+}
+
+func (c *SignatureCache) Add(hash, publicKey, signature []byte) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	key := signatureCacheKey(hash, publicKey, signature)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		// Map iteration order is random
+		for evict := range c.entries {
+			delete(c.entries, evict)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
+
+func (c *SignatureCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries)
+}
+
+// SetSignatureCacheSize replaces the signature cache, 0 disables it
+func SetSignatureCacheSize(maxEntries int) {
+	signatureCache.Store(NewSignatureCache(maxEntries))
+}
+
+// runChecks spreads independent checks over one worker per CPU and returns
+// the first error
+func runChecks(checks []func() error) error {
+	workers := runtime.NumCPU()
+	if workers > len(checks) {
+		workers = len(checks)
+	}
+	jobs := make(chan func() error)
+	errs := make(chan error, len(checks))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				errs <- check()
+			}
+		}()
+	}
+	for _, check := range checks {
+		jobs <- check
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
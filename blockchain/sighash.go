@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// SigHashType selects the parts of a transaction a signature commits to.
+// It is appended to every input signature.
+type SigHashType byte
+
+const (
+	// Every input and output
+	SigHashAll SigHashType = 0x01
+	// Every input but no outputs, anyone can redirect the funds
+	SigHashNone SigHashType = 0x02
+	// Every input and only the output with the same index as the input
+	SigHashSingle SigHashType = 0x03
+	// Combined with one of the above, only the signed input is covered so
+	// others can add their own inputs
+	SigHashAnyoneCanPay SigHashType = 0x80
+	// Alone in place of an input signature, refers to the aggregate
+	// signature of the transaction
+	SigHashAggregate SigHashType = 0x40
+
+	sigHashMask = 0x1f
+)
+
+var (
+	ErrSigHashType   = errors.New("invalid signature hash type")
+	ErrSigHashSingle = errors.New("signature hash single without matching output")
+)
+
+func (t SigHashType) base() SigHashType {
+	return t & sigHashMask
+}
+
+func (t SigHashType) Valid() bool {
+	if t&^(SigHashAnyoneCanPay|sigHashMask) != 0 {
+		return false
+	}
+	return t.base() >= SigHashAll && t.base() <= SigHashSingle
+}
+
+// SignatureHash is the digest signed for an input. The input being signed
+// carries the locking script of the output it spends, all others are empty.
+// The hash type decides which other inputs and outputs are included.
+func (tx *Transaction) SignatureHash(inId int, lockingScript Script, hashType SigHashType) ([]byte, error) {
+	if !hashType.Valid() {
+		return nil, ErrSigHashType
+	}
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[inId].UnlockingScript = lockingScript
+
+	switch hashType.base() {
+	case SigHashNone:
+		txCopy.Outputs = nil
+		txCopy.clearOtherSequences(inId)
+	case SigHashSingle:
+		if inId >= len(txCopy.Outputs) {
+			return nil, ErrSigHashSingle
+		}
+		txCopy.Outputs = txCopy.Outputs[:inId+1]
+		for i := 0; i < inId; i++ {
+			txCopy.Outputs[i] = TransactionOutput{-1, nil, nil}
+		}
+		txCopy.clearOtherSequences(inId)
+	}
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Inputs = txCopy.Inputs[inId : inId+1]
+	}
+
+	hash := sha512.Sum512(append(txCopy.digest(), byte(hashType)))
+	return hash[:], nil
+}
+
+// Other signers may update their inputs when the outputs are not fixed
+func (tx *Transaction) clearOtherSequences(inId int) {
+	for i := range tx.Inputs {
+		if i != inId {
+			tx.Inputs[i].Sequence = 0
+		}
+	}
+}
+
+// SignInput returns the signature for an input with the hash type appended
+func (tx *Transaction) SignInput(inId int, privateKey wallet.PrivateKey, lockingScript Script, hashType SigHashType) ([]byte, error) {
+	hash, err := tx.SignatureHash(inId, lockingScript, hashType)
+	if err != nil {
+		return nil, err
+	}
+	return append(SignHash(privateKey, hash), byte(hashType)), nil
+}
+
+func (c inputChecker) CheckSignature(signature, publicKey []byte) bool {
+	signature, hash, publicKey, ok := c.signatureHash(signature, publicKey)
+	if !ok {
+		return false
+	}
+	return verifySignature(publicKey, signature, hash, c.admit)
+}
+
+// DeferSignature adds Schnorr signatures to the batch instead of checking
+// them right away. The aggregate signature is added by its first input only.
+func (c inputChecker) DeferSignature(signature, publicKey []byte) bool {
+	if c.batch == nil {
+		return false
+	}
+	if keyType, ok := wallet.PublicKeyType(publicKey); !ok || keyType != wallet.KeyTypeSchnorr {
+		return false
+	}
+	aggregate := len(signature) == 1 && SigHashType(signature[0]) == SigHashAggregate
+	signature, hash, publicKey, ok := c.signatureHash(signature, publicKey)
+	if !ok {
+		return false
+	}
+	if aggregate && c.inId != c.aggregate.first {
+		return true
+	}
+	if signatureCache.Load().Contains(hash, publicKey, signature) {
+		return true
+	}
+	return c.batch.Add(publicKey, signature, hash)
+}
+
+// signatureHash splits the hash type off a signature and returns the digest
+// it signs and the key it is checked against. The aggregate signature is
+// checked against the aggregate of the keys of all inputs using it.
+func (c inputChecker) signatureHash(signature, publicKey []byte) ([]byte, []byte, []byte, bool) {
+	if len(signature) == 0 {
+		return nil, nil, nil, false
+	}
+	hashType := SigHashType(signature[len(signature)-1])
+	if len(signature) == 1 && hashType == SigHashAggregate {
+		aggregateKey, ok := c.aggregate.keyFor(c.tx, publicKey)
+		if !ok || len(c.tx.AggregateSignature) == 0 {
+			return nil, nil, nil, false
+		}
+		return c.tx.AggregateSignature, c.tx.AggregateSignatureHash(), aggregateKey, true
+	}
+	hash, err := c.tx.SignatureHash(c.inId, c.lockingScript, hashType)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	return signature[:len(signature)-1], hash, publicKey, true
+}
+
+// aggregateSigner holds the MuSig key of the inputs signed by the aggregate
+// signature, it is computed once for all inputs of a transaction
+type aggregateSigner struct {
+	once  sync.Once
+	keys  map[string]bool
+	key   []byte
+	first int
+}
+
+// aggregatedKeys returns the distinct keys of the inputs unlocked with the
+// aggregate signature and the first of those inputs
+func (tx *Transaction) aggregatedKeys() ([][]byte, int) {
+	var keys [][]byte
+	first := -1
+	seen := make(map[string]bool)
+	for inId, in := range tx.Inputs {
+		pushes := in.UnlockingScript.PushedData()
+		if len(pushes) != 2 || !bytes.Equal(pushes[0], []byte{byte(SigHashAggregate)}) {
+			continue
+		}
+		if first < 0 {
+			first = inId
+		}
+		if !seen[string(pushes[1])] {
+			seen[string(pushes[1])] = true
+			keys = append(keys, pushes[1])
+		}
+	}
+	return keys, first
+}
+
+// keyFor returns the aggregate key if publicKey is one of the aggregated keys
+func (a *aggregateSigner) keyFor(tx *Transaction, publicKey []byte) ([]byte, bool) {
+	a.once.Do(func() {
+		keys, first := tx.aggregatedKeys()
+		a.keys = make(map[string]bool)
+		for _, key := range keys {
+			a.keys[string(key)] = true
+		}
+		a.first = first
+		a.key, _ = wallet.AggregatePublicKeys(keys)
+	})
+	return a.key, a.key != nil && a.keys[string(publicKey)]
+}
+
+// AggregateSignatureHash commits to every input and output of the transaction
+func (tx *Transaction) AggregateSignatureHash() []byte {
+	hash := sha512.Sum512(append(tx.Hash(), byte(SigHashAggregate)))
+	return hash[:]
+}
+
+// SignAggregated signs all inputs with a single MuSig signature for the
+// aggregate of the keys they are locked to. Every input must spend an output
+// locked to one of the Schnorr keys.
+func (tx *Transaction) SignAggregated(privateKeys []wallet.PrivateKey, previousTxs map[string]Transaction) {
+	var signers []wallet.PrivateKey
+	publicKeys := make([][]byte, len(tx.Inputs))
+	for inId, in := range tx.Inputs {
+		previousTx := previousTxs[hex.EncodeToString(in.ID)]
+		if previousTx.ID == nil {
+			panic("previous transaction input does not exist")
+		}
+		for _, privateKey := range privateKeys {
+			publicKey := privateKey.PublicKey()
+			if previousTx.Outputs[in.Output].IsLockedWithKey(wallet.PublicKeyHash(publicKey)) {
+				publicKeys[inId] = publicKey
+				break
+			}
+		}
+		if publicKeys[inId] == nil {
+			panic("input is not locked with a signing key")
+		}
+	}
+	// Signers in the order of the aggregated keys
+	for _, publicKey := range publicKeys {
+		for _, privateKey := range privateKeys {
+			if bytes.Equal(privateKey.PublicKey(), publicKey) && !containsKey(signers, publicKey) {
+				signers = append(signers, privateKey)
+			}
+		}
+	}
+
+	tx.AggregateSignature = nil
+	for inId := range tx.Inputs {
+		tx.Inputs[inId].UnlockingScript = PayToPublicKeyHashUnlockingScript([]byte{byte(SigHashAggregate)}, publicKeys[inId])
+	}
+	signature, err := wallet.MuSigSign(signers, tx.AggregateSignatureHash())
+	if err != nil {
+		panic(err)
+	}
+	tx.AggregateSignature = signature
+}
+
+func containsKey(privateKeys []wallet.PrivateKey, publicKey []byte) bool {
+	for _, privateKey := range privateKeys {
+		if bytes.Equal(privateKey.PublicKey(), publicKey) {
+			return true
+		}
+	}
+	return false
+}
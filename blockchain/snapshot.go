@@ -0,0 +1,339 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger"
+)
+
+const snapshotVersion = 1
+
+var (
+	// Base block of a loaded snapshot and the commitment it was loaded with,
+	// both are removed once the blocks below it are validated
+	snapshotBaseKey       = []byte("snapshot-base")
+	snapshotCommitmentKey = []byte("snapshot-commitment")
+	// RandomX seeds of the epochs below the base, one key per height
+	snapshotSeedPrefix = []byte("snapshot-seed-")
+
+	ErrSnapshotHistory = errors.New("blocks below the UTXO snapshot are not validated")
+)
+
+// SnapshotHeader is written before the outputs of a snapshot
+type SnapshotHeader struct {
+	Version    int
+	Block      []byte
+	Seeds      map[int][]byte
+	Outputs    int
+	Commitment []byte
+}
+
+func snapshotSeedKey(height int) []byte {
+	return append(append([]byte{}, snapshotSeedPrefix...), ToHex(int64(height))...)
+}
+
+func loadSnapshotBase(db *badger.DB) []byte {
+	var base []byte
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotBaseKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		base, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	return base
+}
+
+// snapshotSeed returns the seed stored with the snapshot for a height below
+// its base
+func (c *Chain) snapshotSeed(height int) ([]byte, error) {
+	var hash []byte
+	err := c.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotSeedKey(height))
+		if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+		return err
+	})
+	return hash, err
+}
+
+// ExportSnapshot writes the UTXO set after a block. The stored set is
+// streamed when the block is its tip, older sets are rebuilt from the chain.
+func (u UTXOSet) ExportSnapshot(blockHash []byte, w io.Writer) (SnapshotHeader, error) {
+	if u.Chain.SnapshotBase() != nil {
+		return SnapshotHeader{}, ErrSnapshotHistory
+	}
+	block, err := u.Chain.GetBlock(blockHash)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header := SnapshotHeader{Version: snapshotVersion, Block: block.Serialize(), Seeds: make(map[int][]byte)}
+	iter := &ChainIterator{blockHash, u.Chain.Database}
+	for {
+		b := iter.Next()
+		if b.Height%2048 == 0 && b.Height < block.Height {
+			header.Seeds[b.Height] = b.Hash
+		}
+		if len(b.PrevHash) == 0 {
+			break
+		}
+	}
+
+	info := u.Info()
+	var UTXOs []UTXO
+	if bytes.Equal(info.BestBlock, blockHash) {
+		header.Outputs = info.Outputs
+		header.Commitment = info.Commitment
+	} else {
+		UTXOs = u.Chain.FindUTXOsAt(blockHash)
+		commitment := NewMuHash()
+		for _, utxo := range UTXOs {
+			commitment.Insert(utxo.commitmentData())
+		}
+		header.Outputs = len(UTXOs)
+		header.Commitment = commitment.Finalize()
+	}
+
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return header, err
+	}
+	if UTXOs == nil {
+		u.forEach(func(utxo UTXO) {
+			if err == nil {
+				err = encoder.Encode(utxo)
+			}
+		})
+		return header, err
+	}
+	for _, utxo := range UTXOs {
+		if err := encoder.Encode(utxo); err != nil {
+			return header, err
+		}
+	}
+	return header, nil
+}
+
+// LoadSnapshot creates a chain starting at the base block of a snapshot. The
+// commitment in the file is not trusted, the outputs must match the MuHash
+// given by the user.
+func LoadSnapshot(r io.Reader, nodeId string, commitment []byte) (*Chain, error) {
+	path := fmt.Sprintf(dbPath, nodeId)
+	if DBExists(path) {
+		return nil, errors.New("chain already exists")
+	}
+	decoder := gob.NewDecoder(r)
+	var header SnapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != snapshotVersion {
+		return nil, errors.New("unknown snapshot version")
+	}
+	if !bytes.Equal(header.Commitment, commitment) {
+		return nil, errors.New("snapshot commitment is not the expected MuHash")
+	}
+	var base *Block
+	base = base.Deserialize(header.Block)
+
+	db, err := DBOpen(path, badger.DefaultOptions(path))
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*Chain, error) {
+		db.Close()
+		os.RemoveAll(path)
+		return nil, err
+	}
+
+	loaded := NewMuHash()
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+	for i := 0; i < header.Outputs; i++ {
+		var utxo UTXO
+		if err := decoder.Decode(&utxo); err != nil {
+			return fail(err)
+		}
+		if err := batch.Set(coinKey(utxo.Outpoint), utxo.Serialize()); err != nil {
+			return fail(err)
+		}
+		loaded.Insert(utxo.commitmentData())
+	}
+	if err := batch.Flush(); err != nil {
+		return fail(err)
+	}
+	if !bytes.Equal(loaded.Finalize(), commitment) {
+		return fail(errors.New("snapshot outputs do not match its commitment"))
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(base.Hash, header.Block); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("lh"), base.Hash); err != nil {
+			return err
+		}
+		for height, hash := range header.Seeds {
+			if err := txn.Set(snapshotSeedKey(height), hash); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set(snapshotCommitmentKey, header.Commitment); err != nil {
+			return err
+		}
+		if err := txn.Set(snapshotBaseKey, base.Hash); err != nil {
+			return err
+		}
+		return storeCoinState(txn, loaded, base.Hash)
+	}); err != nil {
+		return fail(err)
+	}
+	return &Chain{LastHash: base.Hash, Database: db, snapshotBase: base.Hash}, nil
+}
+
+// ValidateSnapshot checks the blocks below a loaded snapshot once they are
+// stored. They are validated from the genesis block up like blocks on the
+// tip, and the outputs they leave unspent at the base must match the
+// snapshot commitment.
+func (c *Chain) ValidateSnapshot() error {
+	base := c.SnapshotBase()
+	if base == nil {
+		return nil
+	}
+	block, err := c.GetBlock(base)
+	if err != nil {
+		return err
+	}
+	history := []Block{block}
+	for len(block.PrevHash) > 0 {
+		previous, err := c.GetBlock(block.PrevHash)
+		if err != nil {
+			return ErrSnapshotHistory
+		}
+		if previous.Height != block.Height-1 {
+			return fmt.Errorf("block %x has height %d below height %d", previous.Hash, previous.Height, block.Height)
+		}
+		history = append(history, previous)
+		block = previous
+	}
+
+	var expected []byte
+	if err := c.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotCommitmentKey)
+		if err != nil {
+			return err
+		}
+		expected, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		return err
+	}
+	replay := newHistoryOutputs()
+	for i := len(history) - 1; i >= 0; i-- {
+		block := &history[i]
+		if err := c.validateHistoryBlock(block, replay); err != nil {
+			return fmt.Errorf("block %x below the snapshot: %s", block.Hash, err)
+		}
+		replay.apply(block)
+	}
+	commitment := NewMuHash()
+	for _, utxo := range replay.utxos {
+		commitment.Insert(utxo.commitmentData())
+	}
+	if !bytes.Equal(commitment.Finalize(), expected) {
+		return errors.New("blocks below the snapshot do not match its commitment")
+	}
+
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+	if err := c.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(snapshotBaseKey); err != nil {
+			return err
+		}
+		return txn.Delete(snapshotCommitmentKey)
+	}); err != nil {
+		return err
+	}
+	c.snapshotBase = nil
+	return nil
+}
+
+// validateHistoryBlock checks a block below the snapshot base. The seeds
+// stored with the snapshot must be the hashes of the synced seed blocks.
+func (c *Chain) validateHistoryBlock(block *Block, replay historyOutputs) error {
+	if block.Height%SeedEpochBlocks == 0 {
+		var seed []byte
+		if err := c.Database.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(snapshotSeedKey(block.Height))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			seed, err = item.ValueCopy(nil)
+			return err
+		}); err != nil {
+			return err
+		}
+		if seed != nil && !bytes.Equal(seed, block.Hash) {
+			return errors.New("seed block does not match the snapshot")
+		}
+	}
+	if len(block.PrevHash) == 0 {
+		if !VerifyProof(c, block) {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+	return c.validateBlock(block, replay.spendable)
+}
+
+// historyOutputs is the UTXO set rebuilt while the blocks below a snapshot
+// are replayed, with the time of each block for relative locks
+type historyOutputs struct {
+	utxos map[string]UTXO
+	times map[int]int64
+}
+
+func newHistoryOutputs() historyOutputs {
+	return historyOutputs{make(map[string]UTXO), make(map[int]int64)}
+}
+
+func (h historyOutputs) spendable(in TransactionInput, previousTxs map[string]Transaction) (Transaction, *Block, error) {
+	utxo, ok := h.utxos[string(coinKey(Outpoint{in.ID, in.Output}))]
+	if !ok {
+		return Transaction{}, nil, errors.New("transaction input is spent or does not exist")
+	}
+	return spentTransaction(in, utxo.Output, previousTxs), &Block{Timestamp: h.times[utxo.Height], Height: utxo.Height}, nil
+}
+
+func (h historyOutputs) apply(block *Block) {
+	h.times[block.Height] = block.Timestamp
+	for _, tx := range block.Transactions {
+		coinbase := tx.IsCoinbaseTransaction()
+		if !coinbase {
+			for _, in := range tx.Inputs {
+				delete(h.utxos, string(coinKey(Outpoint{in.ID, in.Output})))
+			}
+		}
+		for outId, out := range tx.Outputs {
+			if out.LockingScript.IsUnspendable() {
+				continue
+			}
+			utxo := UTXO{Outpoint{tx.ID, outId}, out, block.Height, coinbase}
+			h.utxos[string(coinKey(utxo.Outpoint))] = utxo
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// BlockTemplate is a block on the tip waiting for a nonce from an external
+// miner. Miners sharing a template search their own nonces by setting the
+// extranonce of the coinbase with Block.WithExtranonce.
+type BlockTemplate struct {
+	Block    *Block
+	Target   *big.Int
+	SeedHash []byte
+}
+
+// NewBlockTemplate builds a block on the tip paying the reward to an address.
+// Transactions that are not valid at its height are left out.
+func (c *Chain) NewBlockTemplate(txs []*Transaction, address string) *BlockTemplate {
+	lastHash, lastHeight := c.tip()
+	height := lastHeight + 1
+	now := blockTime(c, lastHash)
+
+	selected := c.SelectTransactions(txs, height, now)
+	selected = append(selected, CoinbaseTransaction(address, ""))
+
+	seed, err := seedKey(c, lastHash, SeedEpoch(height))
+	if err != nil {
+		panic(err)
+	}
+	return &BlockTemplate{
+		Block:    &Block{now, []byte{}, selected, lastHash, height, 0},
+		Target:   proofTarget(),
+		SeedHash: seed,
+	}
+}
+
+// SelectTransactions picks the transactions valid at a height. A transaction
+// spending an output already spent by a picked one is left out, so the picked
+// transactions fit in one block.
+func (c *Chain) SelectTransactions(txs []*Transaction, height int, timestamp int64) []*Transaction {
+	var selected []*Transaction
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		if tx.IsCoinbaseTransaction() || c.ValidateTransaction(tx, height, timestamp) != nil {
+			continue
+		}
+		var outpoints []string
+		conflicts := false
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Output)
+			conflicts = conflicts || spent[outpoint]
+			outpoints = append(outpoints, outpoint)
+		}
+		if conflicts {
+			continue
+		}
+		for _, outpoint := range outpoints {
+			spent[outpoint] = true
+		}
+		selected = append(selected, tx)
+	}
+	return selected
+}
+
+// SubmitBlock checks a block solved by an external miner and stores it as the
+// new tip. Its hash is computed from the nonce.
+func (c *Chain) SubmitBlock(block *Block) error {
+	lastHash, lastHeight := c.tip()
+	if !bytes.Equal(block.PrevHash, lastHash) {
+		return ErrStaleTip
+	}
+	if block.Height != lastHeight+1 {
+		return errors.New("block height does not follow the tip")
+	}
+	if err := block.checkHeader(); err != nil {
+		return err
+	}
+	if err := c.checkTimestamp(block); err != nil {
+		return err
+	}
+
+	pow := NewProof(c, block, false)
+	hash := pow.Hash()
+	pow.Destroy()
+	if new(big.Int).SetBytes(hash).Cmp(proofTarget()) != -1 {
+		return ErrInvalidProof
+	}
+	if err := c.validateTransactions(block); err != nil {
+		return err
+	}
+
+	block.Hash = hash
+	return c.storeOnTip(block, lastHash)
+}
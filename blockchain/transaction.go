@@ -2,14 +2,12 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha512"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/big"
 	"os"
 	"strings"
 
@@ -18,14 +16,22 @@ import (
 )
 
 type Transaction struct {
-	ID      []byte
-	Inputs  []TransactionInput
-	Outputs []TransactionOutput
+	ID       []byte
+	Inputs   []TransactionInput
+	Outputs  []TransactionOutput
+	LockTime uint32
+	Issuance *AssetIssuance
+	// Signs every input at once when they all belong to one key
+	AggregateSignature []byte
+	// Set by miners in the coinbase to change the merkle root, zero elsewhere
+	Extranonce uint64
 }
 
 type TransactionOutput struct {
-	Value         int
-	PublicKeyHash []byte
+	Value         Amount
+	LockingScript Script
+	// Empty for the native coin
+	Asset []byte
 }
 
 type TransactionOutputs struct {
@@ -33,10 +39,10 @@ type TransactionOutputs struct {
 }
 
 type TransactionInput struct {
-	ID        []byte
-	Output    int
-	Signature []byte
-	PublicKey []byte
+	ID              []byte
+	Output          int
+	UnlockingScript Script
+	Sequence        uint32
 }
 
 func CoinbaseTransaction(to, data string) *Transaction {
@@ -54,10 +60,10 @@ func CoinbaseTransaction(to, data string) *Transaction {
 		panic(err)
 	}
 	signiture := ed448.Sign(priv, hash[:], "")
-	txin := TransactionInput{hash[:], -1, signiture, nil}
-	txout := NewTxOutput(100, to)
+	txin := TransactionInput{hash[:], -1, Script{}.AddData(signiture), SequenceFinal}
+	txout := NewTxOutput(CoinbaseReward, to)
 
-	transaction := Transaction{nil, []TransactionInput{txin}, []TransactionOutput{*txout}}
+	transaction := Transaction{nil, []TransactionInput{txin}, []TransactionOutput{*txout}, 0, nil, nil, 0}
 	transaction.ID = transaction.Hash()
 
 	return &transaction
@@ -69,47 +75,119 @@ func (tx *Transaction) IsCoinbaseTransaction() bool {
 		if err != nil {
 			panic(err)
 		}
-		return ed448.Verify(pub, tx.Inputs[0].ID, tx.Inputs[0].Signature, "")
+		data := tx.Inputs[0].UnlockingScript.PushedData()
+		if len(data) != 1 {
+			return false
+		}
+		return ed448.Verify(pub, tx.Inputs[0].ID, data[0], "")
 	}
 	return false
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXOs *UTXOSet) *Transaction {
+func NewTransaction(w *wallet.Wallet, to string, amount Amount, UTXOs *UTXOSet) *Transaction {
+	return NewTransactionWithOutputs(w, []TransactionOutput{*NewTxOutput(amount, to)}, UTXOs)
+}
+
+// NewTransactionWithOutputs funds and signs a transaction paying to any
+// outputs, the change of every asset goes back to the wallet
+func NewTransactionWithOutputs(w *wallet.Wallet, payments []TransactionOutput, UTXOs *UTXOSet) *Transaction {
 	var inputs []TransactionInput
 	var outputs []TransactionOutput
+	var dataOutputs []TransactionOutput
+	var lockTime uint32
+	var assets [][]byte
+	amounts := make(map[string]Amount)
+	for _, payment := range payments {
+		asset := hex.EncodeToString(payment.Asset)
+		if _, ok := amounts[asset]; !ok {
+			assets = append(assets, payment.Asset)
+		}
+		amounts[asset] += payment.Value
+		if payment.LockingScript.IsUnspendable() {
+			dataOutputs = append(dataOutputs, payment)
+		} else {
+			outputs = append(outputs, payment)
+		}
+	}
 
 	publicKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOutputs := UTXOs.FindSpendableOutputs(publicKeyHash, amount)
-	if acc < amount {
-		panic("Fund error")
+	for _, asset := range assets {
+		amount := amounts[hex.EncodeToString(asset)]
+		acc, validOutputs := UTXOs.FindSpendableAssetOutputs(publicKeyHash, asset, amount)
+		if acc < amount {
+			panic("Fund error")
+		}
+		assetInputs, assetLockTime := spendOutputs(validOutputs, UTXOs)
+		inputs = append(inputs, assetInputs...)
+		if assetLockTime > lockTime {
+			lockTime = assetLockTime
+		}
+		// Native change below the dust threshold would not be relayed, it
+		// is left as fee
+		if acc-amount >= DustThreshold || (len(asset) > 0 && acc > amount) {
+			outputs = append(outputs, *NewAssetTxOutput(acc-amount, string(w.Address()), asset))
+		}
 	}
+	// Data outputs are not stored in the UTXO set, keeping them last leaves
+	// the positions of the spendable outputs intact
+	outputs = append(outputs, dataOutputs...)
+	tx := Transaction{nil, inputs, outputs, lockTime, nil, nil, 0}
+	tx.ID = tx.Hash()
+	UTXOs.Chain.SignTransaction(&tx, w.PrivateKey, w.PublicKey)
+
+	return &tx
+}
+
+// spendOutputs builds the inputs for outputs found in the UTXO set and the
+// lock time they need
+func spendOutputs(validOutputs map[string][]int, UTXOs *UTXOSet) ([]TransactionInput, uint32) {
+	var inputs []TransactionInput
+	var lockTime uint32
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
 			panic(err)
 		}
 		for _, out := range outs {
-			input := TransactionInput{txID, out, nil, w.PublicKey}
+			utxo, ok := UTXOs.GetUTXO(Outpoint{txID, out})
+			if !ok {
+				panic("output is not in the UTXO set")
+			}
+			input := TransactionInput{txID, out, nil, SequenceFinal}
+			// Spending a time locked output needs a matching lock on the input
+			lockingScript := utxo.Output.LockingScript
+			if outLockTime, ok := lockingScript.LockTime(); ok {
+				input.Sequence = SequenceFinal - 1
+				if outLockTime > lockTime {
+					lockTime = outLockTime
+				}
+			}
+			if sequence, ok := lockingScript.RelativeLockTime(); ok {
+				input.Sequence = sequence
+			}
 			inputs = append(inputs, input)
 		}
 	}
-	outputs = append(outputs, *NewTxOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTxOutput(acc-amount, string(w.Address())))
-	}
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	UTXOs.Chain.SignTransaction(&tx, w.PrivateKey)
-
-	return &tx
+	return inputs, lockTime
 }
 
+// Hash is the transaction ID. It leaves out unlocking scripts and the
+// issuance signature so re-encoded signatures cannot change it.
 func (tx *Transaction) Hash() []byte {
+	txCopy := tx.TrimmedCopy()
+	return txCopy.digest()
+}
+
+// WitnessHash covers the whole transaction including signatures
+func (tx *Transaction) WitnessHash() []byte {
+	return tx.digest()
+}
+
+func (tx Transaction) digest() []byte {
 	var hash [64]byte
-	txCopy := *tx
-	txCopy.ID = []byte{}
-	hash = sha512.Sum512(txCopy.Serialize())
+	tx.ID = []byte{}
+	hash = sha512.Sum512(tx.Serialize())
 	return hash[:]
 }
 
@@ -117,16 +195,24 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TransactionInput
 	var outputs []TransactionOutput
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TransactionInput{in.ID, in.Output, nil, nil})
+		inputs = append(inputs, TransactionInput{in.ID, in.Output, nil, in.Sequence})
 	}
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TransactionOutput{out.Value, out.PublicKeyHash})
+		outputs = append(outputs, TransactionOutput{out.Value, out.LockingScript, out.Asset})
+	}
+	var issuance *AssetIssuance
+	if tx.Issuance != nil {
+		issuance = &AssetIssuance{tx.Issuance.Name, tx.Issuance.Issuer, nil}
 	}
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime, issuance, nil, tx.Extranonce}
 	return txCopy
 }
 
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, previousTxs map[string]Transaction) {
+func (tx *Transaction) Sign(privateKey wallet.PrivateKey, publicKey []byte, previousTxs map[string]Transaction) {
+	tx.SignWithHashType(privateKey, publicKey, previousTxs, SigHashAll)
+}
+
+func (tx *Transaction) SignWithHashType(privateKey wallet.PrivateKey, publicKey []byte, previousTxs map[string]Transaction, hashType SigHashType) {
 	if tx.IsCoinbaseTransaction() {
 		return
 	}
@@ -136,25 +222,29 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, previousTxs map[string]
 			panic("previous transaction input does not exist")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range tx.Inputs {
 		previousTx := previousTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PublicKey = previousTx.Outputs[in.Output].PublicKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PublicKey = nil
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID)
+		signature, err := tx.SignInput(inId, privateKey, previousTx.Outputs[in.Output].LockingScript, hashType)
 		if err != nil {
 			panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-
-		tx.Inputs[inId].Signature = signature
+		tx.Inputs[inId].UnlockingScript = PayToPublicKeyHashUnlockingScript(signature, publicKey)
 	}
 }
 
 func (tx *Transaction) Verify(previousTxs map[string]Transaction) bool {
+	return tx.VerifyWithBatch(previousTxs, nil)
+}
+
+// VerifyWithBatch defers the Schnorr signatures of the transaction to a
+// batch, the transaction is only valid once the batch verifies
+func (tx *Transaction) VerifyWithBatch(previousTxs map[string]Transaction, batch *wallet.SchnorrBatch) bool {
+	return tx.verify(previousTxs, batch, false)
+}
+
+// verify runs the scripts of the transaction, with admit the signatures it
+// verifies are added to the signature cache
+func (tx *Transaction) verify(previousTxs map[string]Transaction, batch *wallet.SchnorrBatch, admit bool) bool {
 	if tx.IsCoinbaseTransaction() {
 		return true
 	}
@@ -164,30 +254,90 @@ func (tx *Transaction) Verify(previousTxs map[string]Transaction) bool {
 			panic("previous transaction input does not exist")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P521()
+	for _, check := range tx.scriptChecks(previousTxs, batch, admit) {
+		if err := check(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptChecks returns the signature checks of a transaction. They do not
+// depend on each other and can run in any order.
+func (tx *Transaction) scriptChecks(previousTxs map[string]Transaction, batch *wallet.SchnorrBatch, admit bool) []func() error {
+	var checks []func() error
+	if tx.Issuance != nil {
+		checks = append(checks, func() error {
+			if !verifySignature(tx.Issuance.Issuer, tx.Issuance.Signature, tx.IssuanceHash(), admit) {
+				return errors.New("issuance signature invalid")
+			}
+			return nil
+		})
+	}
+	aggregate := &aggregateSigner{}
 	for inId, in := range tx.Inputs {
+		inId := inId
 		previousTx := previousTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PublicKey = previousTx.Outputs[in.Output].PublicKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PublicKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PublicKey)
-		x.SetBytes(in.PublicKey[:(keyLen / 2)])
-		y.SetBytes(in.PublicKey[(keyLen / 2):])
-
-		rawPublicKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPublicKey, txCopy.ID, &r, &s) == false {
-			return false
+		if in.Output < 0 || in.Output >= len(previousTx.Outputs) {
+			return []func() error{func() error {
+				return errors.New("transaction input references missing output")
+			}}
 		}
+		previousOut := previousTx.Outputs[in.Output]
+		checks = append(checks, func() error {
+			if err := tx.verifyInput(inId, previousOut, batch, aggregate, admit); err != nil {
+				return fmt.Errorf("input %d: %s", inId, err)
+			}
+			return nil
+		})
+	}
+	return checks
+}
+
+// VerifyInput runs the unlocking script of an input against the locking
+// script of the output it spends
+func (tx *Transaction) VerifyInput(inId int, previousOut TransactionOutput) error {
+	return tx.verifyInput(inId, previousOut, nil, &aggregateSigner{}, false)
+}
+
+func (tx *Transaction) verifyInput(inId int, previousOut TransactionOutput, batch *wallet.SchnorrBatch, aggregate *aggregateSigner, admit bool) error {
+	checker := inputChecker{tx, inId, previousOut.LockingScript, batch, aggregate, admit}
+	return VerifyScripts(tx.Inputs[inId].UnlockingScript, previousOut.LockingScript, checker)
+}
+
+type inputChecker struct {
+	tx            *Transaction
+	inId          int
+	lockingScript Script
+	batch         *wallet.SchnorrBatch
+	aggregate     *aggregateSigner
+	admit         bool
+}
+
+func SignHash(privateKey wallet.PrivateKey, hash []byte) []byte {
+	return privateKey.Sign(hash)
+}
+
+// VerifySignature skips signatures found in the signature cache
+func VerifySignature(publicKey, signature, hash []byte) bool {
+	return verifySignature(publicKey, signature, hash, false)
+}
+
+// verifySignature adds the signatures it verifies to the signature cache
+// when a transaction is admitted to the memory pool
+func verifySignature(publicKey, signature, hash []byte, admit bool) bool {
+	if !wallet.ValidPublicKey(publicKey) {
+		return false
+	}
+	cache := signatureCache.Load()
+	if cache.Contains(hash, publicKey, signature) {
+		return true
+	}
+	if !wallet.VerifySignature(publicKey, signature, hash) {
+		return false
+	}
+	if admit {
+		cache.Add(hash, publicKey, signature)
 	}
 	return true
 }
@@ -195,17 +345,26 @@ func (tx *Transaction) Verify(previousTxs map[string]Transaction) bool {
 func (tx Transaction) String() string {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("--Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("		LockTime: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("		Input %d:", i))
 		lines = append(lines, fmt.Sprintf("			TXID: %x", input.ID))
 		lines = append(lines, fmt.Sprintf("			Out: %d", input.Output))
-		lines = append(lines, fmt.Sprintf("			Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("			PublicKey: %x", input.PublicKey))
+		lines = append(lines, fmt.Sprintf("			Script: %s", input.UnlockingScript))
+		lines = append(lines, fmt.Sprintf("			Sequence: %x", input.Sequence))
 	}
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("		Output %d:", i))
-		lines = append(lines, fmt.Sprintf("			Value: %d", output.Value))
-		lines = append(lines, fmt.Sprintf("			PublicKeyHash: %x", output.PublicKeyHash))
+		lines = append(lines, fmt.Sprintf("			Value: %s", output.Value))
+		if len(output.Asset) > 0 {
+			lines = append(lines, fmt.Sprintf("			Asset: %x", output.Asset))
+		}
+		lines = append(lines, fmt.Sprintf("			Script: %s", output.LockingScript))
+	}
+	if tx.Issuance != nil {
+		lines = append(lines, fmt.Sprintf("		Issuance of %s (%x)", tx.Issuance.Name, tx.Issuance.AssetID()))
 	}
 	return strings.Join(lines, "\n")
 }
@@ -231,25 +390,58 @@ func DeserializeTransaction(data []byte) Transaction {
 
 // Transaction input
 func (in *TransactionInput) UsesKey(publicKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PublicKey)
+	data := in.UnlockingScript.PushedData()
+	if len(data) != 2 {
+		return false
+	}
+	lockingHash := wallet.PublicKeyHash(data[1])
 	return bytes.Compare(lockingHash, publicKeyHash) == 0
 }
 
 // Transaction output
-func NewTxOutput(value int, address string) *TransactionOutput {
-	txo := &TransactionOutput{value, nil}
+func NewTxOutput(value Amount, address string) *TransactionOutput {
+	txo := &TransactionOutput{value, nil, nil}
 	txo.Lock([]byte(address))
 	return txo
 }
 
+// NewTimeLockedTxOutput can only be spent once the chain reaches the given
+// height, or time if lockTime is at least LockTimeThreshold
+func NewTimeLockedTxOutput(value Amount, address string, lockTime uint32) *TransactionOutput {
+	txo := NewTxOutput(value, address)
+	txo.LockingScript = TimeLockedScript(OpCheckLockTimeVerify, lockTime, txo.LockingScript)
+	return txo
+}
+
+// NewRelativeLockedTxOutput can only be spent a number of blocks after it
+// was mined
+func NewRelativeLockedTxOutput(value Amount, address string, blocks uint16) *TransactionOutput {
+	txo := NewTxOutput(value, address)
+	txo.LockingScript = TimeLockedScript(OpCheckSequenceVerify, uint32(blocks), txo.LockingScript)
+	return txo
+}
+
+// NewDataTxOutput anchors a payload on chain. It carries no value and is
+// never added to the UTXO set.
+func NewDataTxOutput(data []byte) *TransactionOutput {
+	if len(data) > MaxDataCarrierSize {
+		panic("data carrier payload too large")
+	}
+	return &TransactionOutput{0, NullDataScript(data), nil}
+}
+
 func (out *TransactionOutput) Lock(address []byte) {
-	publicKeyHash := wallet.Base58Decode(address)
-	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-wallet.ChecksumLen]
-	out.PublicKeyHash = publicKeyHash
+	version, hash := wallet.DecodeAddress(string(address))
+	if version == wallet.ScriptHashVersion {
+		out.LockingScript = PayToScriptHashScript(hash)
+	} else {
+		out.LockingScript = PayToPublicKeyHashScript(hash)
+	}
 }
 
 func (out *TransactionOutput) IsLockedWithKey(publicKeyHash []byte) bool {
-	return bytes.Compare(out.PublicKeyHash, publicKeyHash) == 0
+	lockingHash := out.LockingScript.AddressHash()
+	return lockingHash != nil && bytes.Compare(lockingHash, publicKeyHash) == 0
 }
 
 func (outs *TransactionOutputs) Serialize() []byte {
@@ -2,174 +2,547 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"sort"
+	"time"
 
 	"github.com/dgraph-io/badger"
 )
 
 var (
+	// Every unspent output is stored under coin-<txid><vout>
+	coinPrefix = []byte("coin-")
+	coinKeyLen = len(coinPrefix) + 64 + 4
+
+	// Rolling MuHash over every stored unspent output
+	coinHashKey = []byte("coinstate-muhash")
+
+	// Records of the old layout, one utxo-<txid> per transaction
 	utxoPrefix = []byte("utxo-")
 	prefixLen  = len(utxoPrefix)
 )
 
+// Outpoint identifies an output by its transaction and position
+type Outpoint struct {
+	ID    []byte
+	Index int
+}
+
+// UTXO is an unspent output with the height of the block that created it
+type UTXO struct {
+	Outpoint
+	Output   TransactionOutput
+	Height   int
+	Coinbase bool
+}
+
+// UTXOSet reads and writes the stored set directly unless a cache is set
 type UTXOSet struct {
 	Chain *Chain
+	Cache *UTXOCache
+	// Picks the outputs spent by new transactions, DefaultCoinSelector if nil
+	Selector CoinSelector
+}
+
+func coinKey(outpoint Outpoint) []byte {
+	key := make([]byte, 0, coinKeyLen)
+	key = append(key, coinPrefix...)
+	key = append(key, outpoint.ID...)
+	return binary.BigEndian.AppendUint32(key, uint32(outpoint.Index))
+}
+
+func coinOutpoint(key []byte) Outpoint {
+	key = bytes.TrimPrefix(key, coinPrefix)
+	id := append([]byte{}, key[:len(key)-4]...)
+	return Outpoint{id, int(binary.BigEndian.Uint32(key[len(key)-4:]))}
+}
+
+// commitmentData is the encoding of an output added to the set hash
+func (utxo UTXO) commitmentData() []byte {
+	data := coinKey(utxo.Outpoint)
+	height := uint32(utxo.Height) << 1
+	if utxo.Coinbase {
+		height |= 1
+	}
+	data = binary.BigEndian.AppendUint32(data, height)
+	data = binary.BigEndian.AppendUint64(data, uint64(utxo.Output.Value))
+	data = append(data, byte(len(utxo.Output.Asset)))
+	data = append(data, utxo.Output.Asset...)
+	return append(data, utxo.Output.LockingScript...)
+}
+
+func (utxo UTXO) Serialize() []byte {
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
+	if err := encoder.Encode(utxo); err != nil {
+		panic(err)
+	}
+	return encoded.Bytes()
+}
+
+func DeserializeUTXO(data []byte) UTXO {
+	var utxo UTXO
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&utxo); err != nil {
+		panic(err)
+	}
+	return utxo
 }
 
 func (u UTXOSet) Reindex() {
+	if u.Chain.SnapshotBase() != nil {
+		panic(ErrSnapshotHistory)
+	}
 	db := u.Chain.Database
+	if u.Cache != nil {
+		u.Cache.Reset()
+	}
 	u.DeleteByPrefix(utxoPrefix)
+	u.DeleteByPrefix(coinPrefix)
 	UTXOs := u.Chain.FindUTXOs()
+	commitment := NewMuHash()
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, utxo := range UTXOs {
+		if err := batch.Set(coinKey(utxo.Outpoint), utxo.Serialize()); err != nil {
+			panic(err)
+		}
+		commitment.Insert(utxo.commitmentData())
+	}
+	if err := batch.Flush(); err != nil {
+		panic(err)
+	}
 	if err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXOs {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				panic(err)
-			}
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			if err != nil {
-				panic(err)
-			}
+		if err := txn.Set(coinHashKey, commitment.Serialize()); err != nil {
+			return err
 		}
-		return nil
+		if err := txn.Set(coinBestKey, u.Chain.TipHash()); err != nil {
+			return err
+		}
+		return txn.Delete(coinFlushKey)
 	}); err != nil {
 		panic(err)
 	}
 }
 
-func (u UTXOSet) CountTransactions() int {
-	db := u.Chain.Database
-	counter := 0
-	if err := db.View(func(txn *badger.Txn) error {
+// Migrate rebuilds the UTXO set from the blocks if it still uses the layout
+// with one record per transaction. Output positions in that layout cannot be
+// trusted, so the records are not converted.
+func (u UTXOSet) Migrate() bool {
+	found := false
+	if err := u.Chain.Database.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
-		}
+		it.Seek(utxoPrefix)
+		found = it.ValidForPrefix(utxoPrefix)
 		return nil
 	}); err != nil {
 		panic(err)
 	}
-	return counter
+	if found {
+		u.Reindex()
+	}
+	return found
 }
 
-func (u UTXOSet) FindUTXO(publicKeyHash []byte) []TransactionOutput {
-	var UTXOs []TransactionOutput
-	db := u.Chain.Database
-
-	if err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// forEach calls fn for every unspent output in key order
+func (u UTXOSet) forEach(fn func(utxo UTXO)) {
+	u.view(fn)
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var outs TransactionOutputs
-			item.Value(func(val []byte) error {
-				outs = DeserializeOutputs(val)
-				return nil
-			})
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(publicKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+// view reads the set with the changes held in the cache, without flushing
+// it. fn, if not nil, is called for every unspent output in key order. The
+// hash of the set and the block it is at are returned.
+func (u UTXOSet) view(fn func(utxo UTXO)) (*MuHash, []byte) {
+	// Clean entries match the stored set, only dirty ones are merged
+	dirty := make(map[string]utxoCacheEntry)
+	var best []byte
+	if u.Cache != nil {
+		u.Cache.mutex.Lock()
+		for key, entry := range u.Cache.entries {
+			if entry.dirty {
+				dirty[key] = *entry
 			}
 		}
-		return nil
+		best = u.Cache.best
+	}
+	// The transaction reads the stored set as it is before a later flush
+	txn := u.Chain.Database.NewTransaction(false)
+	if u.Cache != nil {
+		u.Cache.mutex.Unlock()
+	}
+	defer txn.Discard()
+
+	commitment, err := loadCommitment(txn)
+	if err != nil {
+		panic(err)
+	}
+	var added []string
+	for key, entry := range dirty {
+		if entry.spent {
+			commitment.Remove(entry.utxo.commitmentData())
+		} else {
+			commitment.Insert(entry.utxo.commitmentData())
+			added = append(added, key)
+		}
+	}
+	if best == nil {
+		item, err := txn.Get(coinBestKey)
+		if err == nil {
+			best, err = item.ValueCopy(nil)
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			panic(err)
+		}
+	}
+	if fn == nil {
+		return commitment, best
+	}
+
+	sort.Strings(added)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(coinPrefix); it.ValidForPrefix(coinPrefix); it.Next() {
+		item := it.Item()
+		key := string(item.Key())
+		for len(added) > 0 && added[0] < key {
+			fn(dirty[added[0]].utxo)
+			added = added[1:]
+		}
+		if _, ok := dirty[key]; ok {
+			continue
+		}
+		var utxo UTXO
+		if err := item.Value(func(val []byte) error {
+			utxo = DeserializeUTXO(val)
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+		fn(utxo)
+	}
+	for _, key := range added {
+		fn(dirty[key].utxo)
+	}
+	return commitment, best
+}
+
+// GetUTXO looks up an unspent output by its outpoint
+func (u UTXOSet) GetUTXO(outpoint Outpoint) (UTXO, bool) {
+	if u.Cache != nil {
+		return u.Cache.Get(outpoint)
+	}
+	return u.getStored(outpoint)
+}
+
+func (u UTXOSet) getStored(outpoint Outpoint) (UTXO, bool) {
+	var utxo UTXO
+	found := false
+	if err := u.Chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(coinKey(outpoint))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return item.Value(func(val []byte) error {
+			utxo = DeserializeUTXO(val)
+			return nil
+		})
 	}); err != nil {
 		panic(err)
 	}
+	return utxo, found
+}
 
+func (u UTXOSet) CountTransactions() int {
+	counter := 0
+	var lastID []byte
+	u.forEach(func(utxo UTXO) {
+		if !bytes.Equal(utxo.ID, lastID) {
+			counter++
+			lastID = utxo.ID
+		}
+	})
+	return counter
+}
+
+func (u UTXOSet) CountOutputs() int {
+	counter := 0
+	u.forEach(func(utxo UTXO) {
+		counter++
+	})
+	return counter
+}
+
+func (u UTXOSet) FindUTXO(publicKeyHash []byte) []TransactionOutput {
+	var UTXOs []TransactionOutput
+	u.forEach(func(utxo UTXO) {
+		if utxo.Output.IsLockedWithKey(publicKeyHash) {
+			UTXOs = append(UTXOs, utxo.Output)
+		}
+	})
 	return UTXOs
 }
 
-func (u UTXOSet) FindSpendableOutputs(publicKeyHash []byte, amount int) (int, map[string][]int) {
+// FindUTXOsFor returns the unspent outputs locked with the key and their
+// outpoints
+func (u UTXOSet) FindUTXOsFor(publicKeyHash []byte) []UTXO {
+	var UTXOs []UTXO
+	u.forEach(func(utxo UTXO) {
+		if utxo.Output.IsLockedWithKey(publicKeyHash) {
+			UTXOs = append(UTXOs, utxo)
+		}
+	})
+	return UTXOs
+}
+
+func (u UTXOSet) FindSpendableOutputs(publicKeyHash []byte, amount Amount) (Amount, map[string][]int) {
+	return u.FindSpendableAssetOutputs(publicKeyHash, nil, amount)
+}
+
+// FindSpendableAssetOutputs only picks outputs of one asset, nil selects the
+// native coin. The outputs are chosen by the selector of the set.
+func (u UTXOSet) FindSpendableAssetOutputs(publicKeyHash, asset []byte, amount Amount) (Amount, map[string][]int) {
+	candidates := u.FindSpendableCandidates(publicKeyHash, asset)
+	selector := u.Selector
+	if selector == nil {
+		selector = DefaultCoinSelector
+	}
 	unspentOuts := make(map[string][]int)
-	accumulated := 0
-	db := u.Chain.Database
+	var accumulated Amount
+	selected, err := selector.Select(candidates, amount)
+	if err != nil {
+		// Callers see the failure as an accumulated amount of zero
+		return accumulated, unspentOuts
+	}
+	for _, utxo := range selected {
+		txID := hex.EncodeToString(utxo.ID)
+		accumulated += utxo.Output.Value
+		unspentOuts[txID] = append(unspentOuts[txID], utxo.Index)
+	}
+	return accumulated, unspentOuts
+}
 
-	if err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// FindSpendableCandidates returns every mature output of an asset locked
+// with the key
+func (u UTXOSet) FindSpendableCandidates(publicKeyHash, asset []byte) []UTXO {
+	var candidates []UTXO
+	height := u.Chain.GetTopHeight() + 1
+	timestamp := time.Now().Unix()
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var outs TransactionOutputs
-			item.Value(func(val []byte) error {
-				outs = DeserializeOutputs(val)
-				return nil
-			})
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(publicKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
+	u.forEach(func(utxo UTXO) {
+		out := utxo.Output
+		if out.IsLockedWithKey(publicKeyHash) && bytes.Equal(out.Asset, asset) && u.isMature(utxo, height, timestamp) {
+			candidates = append(candidates, utxo)
+		}
+	})
+	return candidates
+}
+
+// Time locked outputs are only spendable once their lock has passed
+func (u UTXOSet) isMature(utxo UTXO, height int, timestamp int64) bool {
+	out := utxo.Output
+	if lockTime, ok := out.LockingScript.LockTime(); ok {
+		if lockTime < LockTimeThreshold {
+			return int64(lockTime) < int64(height)
+		}
+		return int64(lockTime) < timestamp
+	}
+	if sequence, ok := out.LockingScript.RelativeLockTime(); ok {
+		block := &Block{Height: utxo.Height}
+		if sequence&SequenceLockTimeTypeFlag != 0 {
+			var err error
+			if _, block, err = u.Chain.FindTransactionBlock(utxo.ID); err != nil {
+				return false
 			}
 		}
-		return nil
-	}); err != nil {
-		panic(err)
+		return RelativeLockSatisfied(TransactionInput{Sequence: sequence}, block, height, timestamp)
 	}
-
-	return accumulated, unspentOuts
+	return true
 }
 
+// Update spends the outputs used by a block and adds the ones it creates
 func (u *UTXOSet) Update(b *Block) {
+	if u.Cache != nil {
+		u.Cache.Update(b)
+		return
+	}
 	db := u.Chain.Database
 	if err := db.Update(func(txn *badger.Txn) error {
+		commitment, err := loadCommitment(txn)
+		if err != nil {
+			return err
+		}
 		for _, tx := range b.Transactions {
-			if !tx.IsCoinbaseTransaction() {
+			coinbase := tx.IsCoinbaseTransaction()
+			if !coinbase {
 				for _, in := range tx.Inputs {
-					updatedOuts := TransactionOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					if err != nil {
-						panic(err)
+					key := coinKey(Outpoint{in.ID, in.Output})
+					item, err := txn.Get(key)
+					if err == badger.ErrKeyNotFound {
+						continue
+					} else if err != nil {
+						return err
 					}
-					var outs TransactionOutputs
-					item.Value(func(val []byte) error {
-						outs = DeserializeOutputs(val)
+					if err := item.Value(func(val []byte) error {
+						commitment.Remove(DeserializeUTXO(val).commitmentData())
 						return nil
-					})
-					for outId, out := range outs.Outputs {
-						if outId != in.Output {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
+					}); err != nil {
+						return err
 					}
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							panic(err)
-						}
+					if err := txn.Delete(key); err != nil {
+						return err
 					}
 				}
 			}
-			newOutputs := TransactionOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			for outId, out := range tx.Outputs {
+				if out.LockingScript.IsUnspendable() {
+					continue
+				}
+				utxo := UTXO{Outpoint{tx.ID, outId}, out, b.Height, coinbase}
+				if err := txn.Set(coinKey(utxo.Outpoint), utxo.Serialize()); err != nil {
+					return err
+				}
+				commitment.Insert(utxo.commitmentData())
+			}
+		}
+		return storeCoinState(txn, commitment, b.Hash)
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// Disconnect reverts a block at the tip of the stored set, its outputs are
+// removed and the outputs it spent are restored from the chain
+func (u *UTXOSet) Disconnect(b *Block) {
+	if u.Cache != nil {
+		u.Cache.Flush()
+	}
+	created := make(map[string]bool)
+	for _, tx := range b.Transactions {
+		created[hex.EncodeToString(tx.ID)] = true
+	}
+	// Outputs created and spent in the block are in neither set
+	spent := make(map[string]bool)
+	var restored []UTXO
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbaseTransaction() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if created[hex.EncodeToString(in.ID)] {
+				spent[string(coinKey(Outpoint{in.ID, in.Output}))] = true
+				continue
 			}
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
+			previousTx, block, err := u.Chain.FindTransactionBlock(in.ID)
+			if err != nil {
 				panic(err)
 			}
+			utxo := UTXO{Outpoint{in.ID, in.Output}, previousTx.Outputs[in.Output], block.Height, previousTx.IsCoinbaseTransaction()}
+			restored = append(restored, utxo)
 		}
-		return nil
+	}
+	if err := u.Chain.Database.Update(func(txn *badger.Txn) error {
+		commitment, err := loadCommitment(txn)
+		if err != nil {
+			return err
+		}
+		for _, tx := range b.Transactions {
+			for outId, out := range tx.Outputs {
+				if out.LockingScript.IsUnspendable() {
+					continue
+				}
+				utxo := UTXO{Outpoint{tx.ID, outId}, out, b.Height, tx.IsCoinbaseTransaction()}
+				if spent[string(coinKey(utxo.Outpoint))] {
+					continue
+				}
+				if err := txn.Delete(coinKey(utxo.Outpoint)); err != nil {
+					return err
+				}
+				commitment.Remove(utxo.commitmentData())
+			}
+		}
+		for _, utxo := range restored {
+			if err := txn.Set(coinKey(utxo.Outpoint), utxo.Serialize()); err != nil {
+				return err
+			}
+			commitment.Insert(utxo.commitmentData())
+		}
+		return storeCoinState(txn, commitment, b.PrevHash)
 	}); err != nil {
 		panic(err)
 	}
 }
 
+func loadCommitment(txn *badger.Txn) (*MuHash, error) {
+	item, err := txn.Get(coinHashKey)
+	if err == badger.ErrKeyNotFound {
+		return NewMuHash(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	var commitment *MuHash
+	err = item.Value(func(val []byte) error {
+		commitment, err = DeserializeMuHash(val)
+		return err
+	})
+	return commitment, err
+}
+
+// storeCoinState records the set hash and the block the stored set is at
+func storeCoinState(txn *badger.Txn, commitment *MuHash, best []byte) error {
+	if err := txn.Set(coinHashKey, commitment.Serialize()); err != nil {
+		return err
+	}
+	return txn.Set(coinBestKey, best)
+}
+
+// UTXOSetInfo summarizes the set at a block
+type UTXOSetInfo struct {
+	Height       int
+	BestBlock    []byte
+	Transactions int
+	Outputs      int
+	TotalAmount  Amount
+	Assets       map[string]Amount
+	Commitment   []byte
+}
+
+func (u UTXOSet) Info() UTXOSetInfo {
+	info := UTXOSetInfo{Assets: make(map[string]Amount)}
+	var lastID []byte
+	commitment, best := u.view(func(utxo UTXO) {
+		if !bytes.Equal(utxo.ID, lastID) {
+			info.Transactions++
+			lastID = utxo.ID
+		}
+		info.Outputs++
+		if len(utxo.Output.Asset) == 0 {
+			info.TotalAmount += utxo.Output.Value
+		} else {
+			info.Assets[hex.EncodeToString(utxo.Output.Asset)] += utxo.Output.Value
+		}
+	})
+	info.Commitment = commitment.Finalize()
+	info.BestBlock = best
+	if block, err := u.Chain.GetBlock(info.BestBlock); err == nil {
+		info.Height = block.Height
+	}
+	return info
+}
+
+// Commitment is the MuHash of the set with the changes held in the cache
+func (u UTXOSet) Commitment() []byte {
+	commitment, _ := u.view(nil)
+	return commitment.Finalize()
+}
+
 func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 	deleteKeys := func(keysForDelection [][]byte) error {
 		if err := u.Chain.Database.Update(func(txn *badger.Txn) error {
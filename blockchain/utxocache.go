@@ -0,0 +1,389 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	DefaultUTXOCacheMemory        = 64 << 20
+	DefaultUTXOCacheFlushInterval = 100
+
+	// Rough size of an entry besides its scripts, used for the memory budget
+	utxoCacheEntryOverhead = 200
+)
+
+var (
+	// Hash of the last block applied to the stored UTXO set
+	coinBestKey = []byte("coinstate-best")
+	// Present while a flush is written, the stored set is inconsistent if
+	// it is found on startup
+	coinFlushKey = []byte("coinstate-flush")
+	// Changes of the flush being written, Recover finishes an interrupted
+	// flush from them
+	coinJournalPrefix = []byte("coinjournal-")
+)
+
+// coinChange is an output added to or removed from the stored set
+type coinChange struct {
+	UTXO  UTXO
+	Spent bool
+}
+
+func (change coinChange) Serialize() []byte {
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(change); err != nil {
+		panic(err)
+	}
+	return encoded.Bytes()
+}
+
+func deserializeCoinChange(data []byte) coinChange {
+	var change coinChange
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&change); err != nil {
+		panic(err)
+	}
+	return change
+}
+
+type utxoCacheEntry struct {
+	utxo  UTXO
+	spent bool
+	dirty bool
+	// Created since the last flush, a spend removes it without a write
+	fresh bool
+}
+
+func (e *utxoCacheEntry) size() int {
+	return utxoCacheEntryOverhead + len(e.utxo.ID) + len(e.utxo.Output.LockingScript) + len(e.utxo.Output.Asset)
+}
+
+// UTXOCache keeps unspent outputs in memory and writes changes back to the
+// database in batches. It is flushed every FlushInterval blocks and whenever
+// it grows past MaxMemory bytes.
+type UTXOCache struct {
+	MaxMemory     int
+	FlushInterval int
+
+	set     UTXOSet
+	mutex   sync.Mutex
+	entries map[string]*utxoCacheEntry
+	memory  int
+	best    []byte
+	blocks  int
+}
+
+func NewUTXOCache(chain *Chain, maxMemory, flushInterval int) *UTXOCache {
+	return &UTXOCache{
+		MaxMemory:     maxMemory,
+		FlushInterval: flushInterval,
+		set:           UTXOSet{Chain: chain},
+		entries:       make(map[string]*utxoCacheEntry),
+	}
+}
+
+func (c *UTXOCache) Get(outpoint Outpoint) (UTXO, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := string(coinKey(outpoint))
+	if entry, ok := c.entries[key]; ok {
+		return entry.utxo, !entry.spent
+	}
+	utxo, ok := c.set.getStored(outpoint)
+	if ok {
+		c.add(key, &utxoCacheEntry{utxo: utxo})
+	}
+	return utxo, ok
+}
+
+func (c *UTXOCache) add(key string, entry *utxoCacheEntry) {
+	if old, ok := c.entries[key]; ok {
+		c.memory -= old.size()
+	}
+	c.entries[key] = entry
+	c.memory += entry.size()
+}
+
+func (c *UTXOCache) remove(key string) {
+	if old, ok := c.entries[key]; ok {
+		c.memory -= old.size()
+		delete(c.entries, key)
+	}
+}
+
+// Update applies a block to the cached set
+func (c *UTXOCache) Update(b *Block) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, tx := range b.Transactions {
+		coinbase := tx.IsCoinbaseTransaction()
+		if !coinbase {
+			for _, in := range tx.Inputs {
+				outpoint := Outpoint{in.ID, in.Output}
+				key := string(coinKey(outpoint))
+				entry, ok := c.entries[key]
+				if ok && entry.fresh {
+					c.remove(key)
+					continue
+				}
+				// The spent output is kept to remove it from the set hash
+				utxo := UTXO{Outpoint: outpoint}
+				if ok {
+					utxo = entry.utxo
+				} else if stored, found := c.set.getStored(outpoint); found {
+					utxo = stored
+				} else {
+					continue
+				}
+				c.add(key, &utxoCacheEntry{utxo: utxo, spent: true, dirty: true})
+			}
+		}
+		for outId, out := range tx.Outputs {
+			if out.LockingScript.IsUnspendable() {
+				continue
+			}
+			utxo := UTXO{Outpoint{tx.ID, outId}, out, b.Height, coinbase}
+			c.add(string(coinKey(utxo.Outpoint)), &utxoCacheEntry{utxo: utxo, dirty: true, fresh: true})
+		}
+	}
+	c.best = b.Hash
+	c.blocks++
+	if c.blocks >= c.FlushInterval || c.memory > c.MaxMemory {
+		c.flush()
+	}
+}
+
+func (c *UTXOCache) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flush()
+}
+
+// flush writes every dirty entry in one batch
+func (c *UTXOCache) flush() {
+	c.blocks = 0
+	if c.best == nil {
+		return
+	}
+	var changes []coinChange
+	for _, entry := range c.entries {
+		if entry.dirty {
+			changes = append(changes, coinChange{entry.utxo, entry.spent})
+		}
+	}
+	c.set.writeCoins(changes, c.best)
+	c.best = nil
+
+	if c.memory > c.MaxMemory {
+		c.entries = make(map[string]*utxoCacheEntry)
+		c.memory = 0
+		return
+	}
+	for key, entry := range c.entries {
+		if entry.spent {
+			c.remove(key)
+		} else {
+			entry.dirty = false
+			entry.fresh = false
+		}
+	}
+}
+
+// writeCoins applies changes to the stored set. They are journaled first
+// and a marker is stored for the duration of the write, so a crash in
+// between is detected and finished by Recover.
+func (u UTXOSet) writeCoins(changes []coinChange, best []byte) {
+	db := u.Chain.Database
+	journal := db.NewWriteBatch()
+	defer journal.Cancel()
+	for _, change := range changes {
+		key := append(append([]byte{}, coinJournalPrefix...), coinKey(change.UTXO.Outpoint)...)
+		if err := journal.Set(key, change.Serialize()); err != nil {
+			panic(err)
+		}
+	}
+	if err := journal.Flush(); err != nil {
+		panic(err)
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(coinFlushKey, best)
+	}); err != nil {
+		panic(err)
+	}
+	u.applyCoins(changes, best)
+}
+
+// applyCoins writes journaled changes and the set hash at best, then drops
+// the journal. Writing the same changes again gives the same set.
+func (u UTXOSet) applyCoins(changes []coinChange, best []byte) {
+	db := u.Chain.Database
+	var commitment *MuHash
+	if err := db.View(func(txn *badger.Txn) error {
+		var err error
+		commitment, err = loadCommitment(txn)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, change := range changes {
+		var err error
+		if change.Spent {
+			err = batch.Delete(coinKey(change.UTXO.Outpoint))
+			commitment.Remove(change.UTXO.commitmentData())
+		} else {
+			err = batch.Set(coinKey(change.UTXO.Outpoint), change.UTXO.Serialize())
+			commitment.Insert(change.UTXO.commitmentData())
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		panic(err)
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := storeCoinState(txn, commitment, best); err != nil {
+			return err
+		}
+		return txn.Delete(coinFlushKey)
+	}); err != nil {
+		panic(err)
+	}
+	u.DeleteByPrefix(coinJournalPrefix)
+}
+
+// journal reads the changes of an interrupted flush
+func (u UTXOSet) journal() []coinChange {
+	var changes []coinChange
+	if err := u.Chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(coinJournalPrefix); it.ValidForPrefix(coinJournalPrefix); it.Next() {
+			if err := it.Item().Value(func(val []byte) error {
+				changes = append(changes, deserializeCoinChange(val))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return changes
+}
+
+// Reset drops the cache without writing it
+func (c *UTXOCache) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*utxoCacheEntry)
+	c.memory = 0
+	c.best = nil
+	c.blocks = 0
+}
+
+func (c *UTXOCache) Memory() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.memory
+}
+
+// Best returns the hash of the last block applied to the set
+func (u UTXOSet) Best() []byte {
+	if u.Cache != nil {
+		u.Cache.mutex.Lock()
+		best := u.Cache.best
+		u.Cache.mutex.Unlock()
+		if best != nil {
+			return best
+		}
+	}
+	var best []byte
+	if err := u.Chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(coinBestKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		best, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	return best
+}
+
+// Recover brings the stored UTXO set to the tip of the chain. An interrupted
+// flush is finished from its journal, blocks added since the last flush are
+// applied again.
+func (u UTXOSet) Recover() {
+	if u.Cache != nil {
+		u.Cache.Flush()
+	}
+	var best, flushing []byte
+	rebuild := false
+	if err := u.Chain.Database.View(func(txn *badger.Txn) error {
+		if item, err := txn.Get(coinFlushKey); err == nil {
+			if flushing, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		// Sets stored before the set hash was kept are rebuilt
+		if _, err := txn.Get(coinHashKey); err == badger.ErrKeyNotFound {
+			rebuild = true
+		} else if err != nil {
+			return err
+		}
+		item, err := txn.Get(coinBestKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		best, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	if rebuild || best == nil {
+		u.Reindex()
+		return
+	}
+	if flushing != nil {
+		u.applyCoins(u.journal(), flushing)
+		best = flushing
+	} else {
+		// Left by a flush interrupted before its marker was stored
+		u.DeleteByPrefix(coinJournalPrefix)
+	}
+	if bytes.Equal(best, u.Chain.TipHash()) {
+		return
+	}
+
+	var missing []*Block
+	iter := u.Chain.Iterator()
+	for {
+		block := iter.Next()
+		if bytes.Equal(block.Hash, best) {
+			break
+		}
+		missing = append(missing, block)
+		if u.Chain.IsFirstBlock(block) {
+			// The stored set is not on this chain
+			u.Reindex()
+			return
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		u.Update(missing[i])
+	}
+}
@@ -1,14 +1,21 @@
 package cli
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/JI-0/private-cryptocurrency/blockchain"
 	"github.com/JI-0/private-cryptocurrency/network"
+	"github.com/JI-0/private-cryptocurrency/randomx"
 	"github.com/JI-0/private-cryptocurrency/wallet"
 )
 
@@ -19,11 +26,40 @@ func (cli *CommandLine) printUsage() {
 	fmt.Println("	createChain -address ADDRESS <-- creates a blockchain")
 	fmt.Println("	printChain <-- print the chain")
 	fmt.Println("	reindexUTXOSet <-- reindexes the UTXO set of unspent transactions")
-	fmt.Println("	createWallet <-- create a new wallet")
+	fmt.Println("	createWallet -type p521|ed25519|ed448|schnorr <-- create a new wallet")
 	fmt.Println("	listWallets <-- list addresses of all wallets")
 	fmt.Println("	getBalance -address ADDRESS <-- get the balance for address")
+	fmt.Println("	listUnspent -address ADDRESS <-- list the outputs spendable by address")
+	fmt.Println("	getTxOutSetInfo <-- print the size, total amount and hash of the UTXO set")
+	fmt.Println("	dumpUTXOSet -file FILE -block HASH <-- write the UTXO set after a block, the tip by default, to a snapshot")
+	fmt.Println("	loadUTXOSet -file FILE -muhash HASH <-- create the chain from a snapshot with a trusted MuHash, the blocks below it are validated by the node once synced")
 	fmt.Println("	send -from FROM -to TO -amount AMOUNT -mine <-- send amount from address to address")
+	fmt.Println("		-lockUntil HEIGHT|TIME <-- the output can only be spent after a block height or unix time")
+	fmt.Println("		-lockBlocks BLOCKS <-- the output can only be spent a number of blocks after it is mined")
+	fmt.Println("		-data HEX <-- anchor up to 80 bytes of data in the transaction")
+	fmt.Println("		-asset ASSET <-- send an issued asset instead of the native coin")
+	fmt.Println("	issueAsset -address ADDRESS -name NAME -amount AMOUNT -to TO -mine <-- issue a new asset signed by the address key")
 	fmt.Println("	startNode -miner ADDRESS <-- start a miner with address")
+	fmt.Println("		-utxoCache MB <-- memory used to cache unspent outputs before writing them to disk")
+	fmt.Println("		-threads N <-- number of mining threads")
+	fmt.Println("		-rpc ADDRESS <-- serve getBlockTemplate and submitBlock to external miners")
+	fmt.Println("		-stratum ADDRESS -shareDifficulty BITS <-- run a mining pool paying to the miner address")
+	fmt.Println("	createMultisig -required M -keys KEY,KEY,... <-- create an M-of-N address from addresses or hex public keys")
+	fmt.Println("	createMultisigTx -from FROM -to TO -amount AMOUNT -file FILE <-- write an unsigned spend from a multisig address")
+	fmt.Println("	signMultisigTx -file FILE -address ADDRESS <-- add the signatures of a cosigner to the spend")
+	fmt.Println("	combineMultisigTx -files FILE,FILE,... -mine <-- combine signatures and send the spend")
+	fmt.Println("	createMuSig -keys KEY,KEY,... <-- create an N-of-N address for the MuSig aggregate of schnorr addresses or hex public keys")
+	fmt.Println("	createMuSigTx -from FROM -to TO -amount AMOUNT -file FILE <-- write an unsigned spend from a MuSig address")
+	fmt.Println("	commitMuSigTx -file FILE -address ADDRESS <-- commit to the nonces of a cosigner, they are kept in FILE.ADDRESS.nonce")
+	fmt.Println("	revealMuSigTx -file FILE -address ADDRESS <-- reveal the nonces of a cosigner once every cosigner committed")
+	fmt.Println("	signMuSigTx -file FILE -address ADDRESS <-- add the partial signatures of a cosigner once every nonce is revealed")
+	fmt.Println("	combineMuSigTx -files FILE,FILE,... -mine <-- merge the rounds into the first file and send the spend once signed")
+	fmt.Println("	initiateSwap -from FROM -to TO -amount AMOUNT -lockUntil HEIGHT|TIME -secretHash HASH -mine <-- lock amount in a swap contract, a secret is generated without -secretHash")
+	fmt.Println("	redeemSwap -contract TXID -secret SECRET -address ADDRESS -mine <-- claim a swap contract with the secret")
+	fmt.Println("	refundSwap -contract TXID -address ADDRESS -mine <-- take back a swap contract after its lock time")
+	fmt.Println("	auditSwap -contract TXID <-- print the terms of a swap contract")
+	fmt.Println("	extractSecret -contract TXID <-- print the secret revealed by redeeming a swap contract")
+	fmt.Println("	benchmark -seconds N -threads N -light <-- check RandomX against test vectors and measure its speed, -light skips the 2 GB dataset")
 }
 
 func (cli *CommandLine) validateArgs() {
@@ -53,14 +89,12 @@ func (cli *CommandLine) printChain(nodeID string) {
 		block := iterator.Next()
 		fmt.Printf("Prev hash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := blockchain.NewProof(chain, block, true)
-		fmt.Printf("POW: %s\n", strconv.FormatBool(pow.Validate()))
-		pow.Destroy()
+		fmt.Printf("POW: %s\n", strconv.FormatBool(blockchain.VerifyProof(chain, block)))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 
-		if len(block.PrevHash) == 0 {
+		if chain.IsFirstBlock(block) {
 			break
 		}
 	}
@@ -76,9 +110,127 @@ func (cli *CommandLine) reindexUTXOSet(nodeID string) {
 	fmt.Printf("There are %d transactions in the UTXO set.", count)
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
+func (cli *CommandLine) listUnspent(address, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		panic("address invalid")
+	}
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+
+	publicKeyHash := wallet.Base58Decode([]byte(address))
+	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-wallet.ChecksumLen]
+	for _, utxo := range UTXOSet.FindUTXOsFor(publicKeyHash) {
+		fmt.Printf("%x:%d value %s height %d", utxo.ID, utxo.Index, utxo.Output.Value, utxo.Height)
+		if len(utxo.Output.Asset) > 0 {
+			fmt.Printf(" asset %x", utxo.Output.Asset)
+		}
+		fmt.Println()
+	}
+}
+
+func (cli *CommandLine) getTxOutSetInfo(nodeID string) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	info := UTXOSet.Info()
+
+	fmt.Printf("Height: %d\n", info.Height)
+	fmt.Printf("Best block: %x\n", info.BestBlock)
+	fmt.Printf("Transactions: %d\n", info.Transactions)
+	fmt.Printf("Outputs: %d\n", info.Outputs)
+	fmt.Printf("Total amount: %s\n", info.TotalAmount)
+	for asset, amount := range info.Assets {
+		fmt.Printf("Asset %s: %s\n", asset, amount)
+	}
+	fmt.Printf("MuHash: %x\n", info.Commitment)
+}
+
+func (cli *CommandLine) benchmark(seconds, threads int, light bool) {
+	flags := randomx.GetFlags()
+	fmt.Printf("JIT: %t\n", flags&randomx.FlagJIT != 0)
+	fmt.Printf("Hardware AES: %t\n", flags&randomx.FlagHardAES != 0)
+	fmt.Printf("Large pages: %t\n", randomx.LargePagesAvailable())
+
+	upstream, vectorsErr := randomx.CheckConfiguration(flags)
+	if vectorsErr != nil {
+		fmt.Println("Test vectors: FAILED,", vectorsErr)
+	} else {
+		fmt.Println("Test vectors: OK")
+	}
+	if upstream {
+		fmt.Println("Upstream configuration: yes")
+	} else {
+		fmt.Println("Upstream configuration: no")
+	}
+
+	fmt.Printf("Benchmarking %d threads for %ds per mode\n", threads, seconds)
+	result, err := randomx.Benchmark(flags, threads, time.Duration(seconds)*time.Second, !light)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Cache init: %s\n", result.CacheInit)
+	fmt.Printf("Light mode: %.2f H/s\n", result.LightHashrate)
+	if !light {
+		fmt.Printf("Dataset init: %s\n", result.DatasetInit)
+		fmt.Printf("Full mode: %.2f H/s\n", result.FullHashrate)
+	}
+	if vectorsErr != nil {
+		os.Exit(1)
+	}
+}
+
+func (cli *CommandLine) dumpUTXOSet(file, blockHash, nodeID string) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	hash := chain.LastHash
+	if blockHash != "" {
+		var err error
+		if hash, err = hex.DecodeString(blockHash); err != nil {
+			panic(err)
+		}
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	header, err := UTXOSet.ExportSnapshot(hash, f)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Wrote %d outputs at block %x\n", header.Outputs, hash)
+	fmt.Printf("MuHash: %x\n", header.Commitment)
+}
+
+func (cli *CommandLine) loadUTXOSet(file, muhash, nodeID string) {
+	commitment, err := hex.DecodeString(muhash)
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	chain, err := blockchain.LoadSnapshot(f, nodeID, commitment)
+	if err != nil {
+		panic(err)
+	}
+	defer chain.Database.Close()
+	info := blockchain.UTXOSet{Chain: chain}.Info()
+	fmt.Printf("Loaded %d outputs at height %d\n", info.Outputs, info.Height)
+	fmt.Printf("MuHash: %x\n", info.Commitment)
+}
+
+func (cli *CommandLine) createWallet(keyType, nodeID string) {
+	kt, err := wallet.ParseKeyType(keyType)
+	if err != nil {
+		panic(err)
+	}
 	wallets, _ := wallet.NewWallets()
-	address := wallets.AddWallet()
+	address := wallets.AddWalletWithType(kt)
 	wallets.Save()
 	println("New address: %s", address)
 }
@@ -99,24 +251,47 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	defer chain.Database.Close()
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
 
-	balance := 0
+	var balance blockchain.Amount
+	assets := make(map[string]blockchain.Amount)
 	publicKeyHash := wallet.Base58Decode([]byte(address))
 	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-wallet.ChecksumLen]
 	UTXOs := UTXOSet.FindUTXO(publicKeyHash)
 
 	for _, out := range UTXOs {
-		balance += out.Value
+		if len(out.Asset) > 0 {
+			assets[hex.EncodeToString(out.Asset)] += out.Value
+		} else {
+			balance += out.Value
+		}
+	}
+	fmt.Printf("Balance of %s: %s\n", address, balance)
+	for asset, amount := range assets {
+		fmt.Printf("	Asset %s: %s\n", asset, amount)
 	}
-	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mine bool) {
+func (cli *CommandLine) send(from, to string, amount blockchain.Amount, nodeID string, mine bool, lockUntil uint, lockBlocks uint, data, asset, coinSelection, coins string) {
 	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
 		panic("address invalid")
 	}
 	chain := blockchain.ContinueChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	selector, err := blockchain.ParseCoinSelector(coinSelection)
+	if err != nil {
+		panic(err)
+	}
+	if coins != "" {
+		manual := blockchain.ManualSelector{Fallback: selector}
+		for _, coin := range strings.Split(coins, ",") {
+			outpoint, err := blockchain.ParseOutpoint(coin)
+			if err != nil {
+				panic(err)
+			}
+			manual.Outpoints = append(manual.Outpoints, outpoint)
+		}
+		selector = manual
+	}
+	UTXOSet := blockchain.UTXOSet{Chain: chain, Selector: selector}
 
 	wallets, err := wallet.NewWallets()
 	if err != nil {
@@ -124,19 +299,483 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mine bo
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	output := blockchain.NewTxOutput(amount, to)
+	if lockUntil > 0 {
+		output = blockchain.NewTimeLockedTxOutput(amount, to, uint32(lockUntil))
+	} else if lockBlocks > 0 {
+		output = blockchain.NewRelativeLockedTxOutput(amount, to, uint16(lockBlocks))
+	}
+	if asset != "" {
+		output.Asset, err = hex.DecodeString(asset)
+		if err != nil {
+			panic(err)
+		}
+	}
+	outputs := []blockchain.TransactionOutput{*output}
+	if data != "" {
+		payload, err := hex.DecodeString(data)
+		if err != nil {
+			panic(err)
+		}
+		if len(payload) > blockchain.MaxDataCarrierSize {
+			panic("data too large")
+		}
+		outputs = append(outputs, *blockchain.NewDataTxOutput(payload))
+	}
+	tx := blockchain.NewTransactionWithOutputs(&wallet, outputs, &UTXOSet)
+	cli.sendOrMine(chain, tx, from, mine)
+
+	fmt.Println("Sent amount")
+}
+
+func (cli *CommandLine) issueAsset(address, name string, amount blockchain.Amount, to, nodeID string, mine bool) {
+	if !wallet.ValidateAddress(address) || !wallet.ValidateAddress(to) {
+		panic("address invalid")
+	}
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	wallet := wallets.GetWallet(address)
+
+	tx := blockchain.NewIssuanceTransaction(&wallet, name, amount, to, &UTXOSet)
+	cli.sendOrMine(chain, tx, address, mine)
+
+	fmt.Printf("Issued asset %x\n", tx.Issuance.AssetID())
+}
+
+func (cli *CommandLine) createMultisig(required int, keys, nodeID string) {
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	var publicKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		if w, ok := wallets.Wallets[key]; ok {
+			publicKeys = append(publicKeys, w.PublicKey)
+			continue
+		}
+		publicKey, err := hex.DecodeString(key)
+		if err != nil {
+			panic("key is neither a local address nor a hex public key")
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	if required < 1 || required > len(publicKeys) || len(publicKeys) > blockchain.MaxMultisigKeys {
+		panic("invalid number of required signatures or keys")
+	}
+	redeemScript := blockchain.MultisigScript(required, publicKeys)
+	address := wallets.AddMultisig(&wallet.MultisigWallet{Required: required, PublicKeys: publicKeys, RedeemScript: redeemScript})
+	wallets.Save()
+	fmt.Printf("New multisig address: %s\n", address)
+}
+
+func (cli *CommandLine) createMultisigTx(from, to string, amount blockchain.Amount, file, nodeID string) {
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		panic("address invalid")
+	}
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	multisig := wallets.GetMultisig(from)
+	if multisig == nil {
+		panic("multisig address unknown")
+	}
+
+	ptx := blockchain.NewMultisigTransaction(multisig, to, amount, &UTXOSet)
+	if err := os.WriteFile(file, ptx.Serialize(), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Unsigned transaction %x written to %s\n", ptx.Transaction.ID, file)
+}
+
+func (cli *CommandLine) signMultisigTx(file, address string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	ptx, err := blockchain.DeserializePartialTransaction(data)
+	if err != nil {
+		panic(err)
+	}
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+	if err := ptx.Sign(w.PrivateKey, w.PublicKey); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(file, ptx.Serialize(), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Signed transaction %x\n", ptx.Transaction.ID)
+}
+
+func (cli *CommandLine) combineMultisigTx(files, nodeID string, mine bool) {
+	var ptx *blockchain.PartialTransaction
+	for _, file := range strings.Split(files, ",") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+		other, err := blockchain.DeserializePartialTransaction(data)
+		if err != nil {
+			panic(err)
+		}
+		if ptx == nil {
+			ptx = other
+		} else if err := ptx.Combine(other); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := ptx.Finalize()
+	if err != nil {
+		panic(err)
+	}
+
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	from := wallet.EncodeAddress(wallet.ScriptHashVersion, wallet.PublicKeyHash(ptx.RedeemScript))
+	cli.sendOrMine(chain, tx, string(from), mine)
+
+	fmt.Println("Sent amount")
+}
+
+func (cli *CommandLine) createMuSig(keys string) {
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	var publicKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		if w, ok := wallets.Wallets[key]; ok {
+			publicKeys = append(publicKeys, w.PublicKey)
+			continue
+		}
+		publicKey, err := hex.DecodeString(key)
+		if err != nil {
+			panic("key is neither a local address nor a hex public key")
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	musig, err := wallet.NewMuSigWallet(publicKeys)
+	if err != nil {
+		panic(err)
+	}
+	address := wallets.AddMuSig(musig)
+	wallets.Save()
+	fmt.Printf("New MuSig address: %s\n", address)
+}
+
+func (cli *CommandLine) createMuSigTx(from, to string, amount blockchain.Amount, file, nodeID string) {
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		panic("address invalid")
+	}
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	musig := wallets.GetMuSig(from)
+	if musig == nil {
+		panic("MuSig address unknown")
+	}
+
+	session := blockchain.NewMuSigTransaction(musig, to, amount, &UTXOSet)
+	if err := os.WriteFile(file, session.Serialize(), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Unsigned transaction %x written to %s\n", session.Transaction.ID, file)
+}
+
+func readMuSigSession(file string) *blockchain.MuSigSession {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	session, err := blockchain.DeserializeMuSigSession(data)
+	if err != nil {
+		panic(err)
+	}
+	return session
+}
+
+func writeMuSigSession(file string, session *blockchain.MuSigSession) {
+	if err := os.WriteFile(file, session.Serialize(), 0644); err != nil {
+		panic(err)
+	}
+}
+
+// The secret nonces of a cosigner stay on its machine next to the session
+// file until it signs
+func muSigNonceFile(file, address string) string {
+	return file + "." + address + ".nonce"
+}
+
+func readMuSigNonces(file, address string) []wallet.MuSigNonce {
+	data, err := os.ReadFile(muSigNonceFile(file, address))
+	if err != nil {
+		panic(err)
+	}
+	var encoded [][]byte
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&encoded); err != nil {
+		panic(err)
+	}
+	nonces := make([]wallet.MuSigNonce, len(encoded))
+	for i, nonce := range encoded {
+		if nonces[i], err = wallet.DeserializeMuSigNonce(nonce); err != nil {
+			panic(err)
+		}
+	}
+	return nonces
+}
+
+func (cli *CommandLine) commitMuSigTx(file, address string) {
+	session := readMuSigSession(file)
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+	nonces, err := session.Commit(w.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	var encoded [][]byte
+	for _, nonce := range nonces {
+		encoded = append(encoded, nonce.Serialize())
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(encoded); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(muSigNonceFile(file, address), buffer.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+	writeMuSigSession(file, session)
+	fmt.Printf("Committed to nonces for %x\n", session.Transaction.ID)
+}
+
+func (cli *CommandLine) revealMuSigTx(file, address string) {
+	session := readMuSigSession(file)
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+	if err := session.Reveal(w.PublicKey, readMuSigNonces(file, address)); err != nil {
+		panic(err)
+	}
+	writeMuSigSession(file, session)
+	fmt.Printf("Revealed nonces for %x\n", session.Transaction.ID)
+}
+
+func (cli *CommandLine) signMuSigTx(file, address string) {
+	session := readMuSigSession(file)
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+	if err := session.Sign(w.PrivateKey, readMuSigNonces(file, address)); err != nil {
+		panic(err)
+	}
+	writeMuSigSession(file, session)
+	// A nonce must never sign twice
+	if err := os.Remove(muSigNonceFile(file, address)); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Signed transaction %x\n", session.Transaction.ID)
+}
+
+func (cli *CommandLine) combineMuSigTx(files, nodeID string, mine bool) {
+	paths := strings.Split(files, ",")
+	session := readMuSigSession(paths[0])
+	for _, file := range paths[1:] {
+		if err := session.Combine(readMuSigSession(file)); err != nil {
+			panic(err)
+		}
+	}
+	writeMuSigSession(paths[0], session)
+	tx, err := session.Finalize()
+	if err != nil {
+		fmt.Println("Merged into", paths[0]+":", err)
+		return
+	}
+
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	aggregateKey, err := wallet.AggregatePublicKeys(session.PublicKeys)
+	if err != nil {
+		panic(err)
+	}
+	from := wallet.EncodeAddress(wallet.SchnorrKeyHashVersion, wallet.PublicKeyHash(aggregateKey))
+	cli.sendOrMine(chain, tx, string(from), mine)
+
+	fmt.Println("Sent amount")
+}
+
+func (cli *CommandLine) sendOrMine(chain *blockchain.Chain, tx *blockchain.Transaction, miner string, mine bool) {
 	if mine {
-		cbTx := blockchain.CoinbaseTransaction(from, "")
+		UTXOSet := blockchain.UTXOSet{Chain: chain}
+		cbTx := blockchain.CoinbaseTransaction(miner, "")
 		block := chain.MineBlock([]*blockchain.Transaction{tx, cbTx})
 		UTXOSet.Update(block)
 	} else {
 		network.SendTransaction(network.KnownNodes[0], tx)
 	}
+}
 
-	fmt.Println("Sent amount")
+func (cli *CommandLine) initiateSwap(from, to string, amount blockchain.Amount, lockUntil uint32, secretHash, nodeID string, mine bool) {
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		panic("address invalid")
+	}
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(from)
+
+	var hash []byte
+	if secretHash == "" {
+		secret := make([]byte, blockchain.HTLCSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		hash = blockchain.HTLCSecretHash(secret)
+		fmt.Printf("Secret: %x\n", secret)
+	} else if hash, err = hex.DecodeString(secretHash); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Secret hash: %x\n", hash)
+
+	contract := blockchain.NewHTLC(hash, to, from, lockUntil)
+	output := blockchain.TransactionOutput{Value: amount, LockingScript: contract.Script()}
+	tx := blockchain.NewTransactionWithOutputs(&w, []blockchain.TransactionOutput{output}, &UTXOSet)
+	cli.sendOrMine(chain, tx, from, mine)
+
+	fmt.Printf("Contract transaction: %x\n", tx.ID)
+}
+
+func (cli *CommandLine) redeemSwap(contractID, secret, address, nodeID string, mine bool) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+
+	contractTx := cli.findContract(chain, contractID)
+	secretBytes, err := hex.DecodeString(secret)
+	if err != nil {
+		panic(err)
+	}
+	tx, err := blockchain.NewHTLCRedeemTransaction(&w, &contractTx, secretBytes)
+	if err != nil {
+		panic(err)
+	}
+	cli.sendOrMine(chain, tx, address, mine)
+
+	fmt.Printf("Redeem transaction: %x\n", tx.ID)
 }
 
-func (cli *CommandLine) StartNode(nodeId, minerAddress string) {
+func (cli *CommandLine) refundSwap(contractID, address, nodeID string, mine bool) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	wallets, err := wallet.NewWallets()
+	if err != nil {
+		panic(err)
+	}
+	w := wallets.GetWallet(address)
+
+	contractTx := cli.findContract(chain, contractID)
+	tx, err := blockchain.NewHTLCRefundTransaction(&w, &contractTx)
+	if err != nil {
+		panic(err)
+	}
+	cli.sendOrMine(chain, tx, address, mine)
+
+	fmt.Printf("Refund transaction: %x\n", tx.ID)
+}
+
+func (cli *CommandLine) auditSwap(contractID, nodeID string) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	contractTx := cli.findContract(chain, contractID)
+	outId, contract, _ := contractTx.FindHTLC()
+	fmt.Printf("Contract output: %d\n", outId)
+	fmt.Printf("Value: %s\n", contractTx.Outputs[outId].Value)
+	fmt.Printf("Secret hash: %x\n", contract.SecretHash)
+	fmt.Printf("Recipient: %s\n", wallet.EncodeAddress(wallet.PublicKeyHashVersion, contract.RecipientHash))
+	fmt.Printf("Refund: %s\n", wallet.EncodeAddress(wallet.PublicKeyHashVersion, contract.RefundHash))
+	if contract.LockTime < blockchain.LockTimeThreshold {
+		fmt.Printf("Lock time: block %d (top block %d)\n", contract.LockTime, chain.GetTopHeight())
+	} else {
+		fmt.Printf("Lock time: %s\n", time.Unix(int64(contract.LockTime), 0))
+	}
+	if spend, err := chain.FindSpendingTransaction(contractTx.ID, outId); err == nil {
+		fmt.Printf("Spent by: %x\n", spend.ID)
+	} else {
+		fmt.Println("Unspent")
+	}
+}
+
+func (cli *CommandLine) extractSecret(contractID, nodeID string) {
+	chain := blockchain.ContinueChain(nodeID)
+	defer chain.Database.Close()
+
+	contractTx := cli.findContract(chain, contractID)
+	outId, _, _ := contractTx.FindHTLC()
+	spend, err := chain.FindSpendingTransaction(contractTx.ID, outId)
+	if err != nil {
+		panic(err)
+	}
+	secret, err := blockchain.ExtractHTLCSecret(&spend, contractTx.ID)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Secret: %x\n", secret)
+}
+
+func (cli *CommandLine) findContract(chain *blockchain.Chain, contractID string) blockchain.Transaction {
+	txID, err := hex.DecodeString(contractID)
+	if err != nil {
+		panic(err)
+	}
+	contractTx, err := chain.FindTransaction(txID)
+	if err != nil {
+		panic(err)
+	}
+	if _, _, ok := contractTx.FindHTLC(); !ok {
+		panic("transaction has no contract output")
+	}
+	return contractTx
+}
+
+func (cli *CommandLine) StartNode(nodeId, minerAddress string, utxoCacheMB int) {
 	fmt.Printf("Starting node %s\n", nodeId)
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
@@ -145,7 +784,19 @@ func (cli *CommandLine) StartNode(nodeId, minerAddress string) {
 			fmt.Println("Miner address error.")
 		}
 	}
-	network.StartServer(nodeId, minerAddress)
+	network.StartServer(nodeId, minerAddress, utxoCacheMB<<20)
+}
+
+// parseAmount reads a positive decimal amount or prints the usage of the
+// command
+func parseAmount(cmd *flag.FlagSet, value string) blockchain.Amount {
+	amount, err := blockchain.ParseAmount(value)
+	if err != nil || amount == 0 {
+		fmt.Println("Invalid amount:", value)
+		cmd.Usage()
+		runtime.Goexit()
+	}
+	return amount
 }
 
 func (cli *CommandLine) Run() {
@@ -163,16 +814,100 @@ func (cli *CommandLine) Run() {
 	createWalletCmd := flag.NewFlagSet("createWallet", flag.ExitOnError)
 	listWalletsCmd := flag.NewFlagSet("listWallets", flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet("getBalance", flag.ExitOnError)
+	listUnspentCmd := flag.NewFlagSet("listUnspent", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("getTxOutSetInfo", flag.ExitOnError)
+	benchmarkCmd := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	dumpUTXOSetCmd := flag.NewFlagSet("dumpUTXOSet", flag.ExitOnError)
+	loadUTXOSetCmd := flag.NewFlagSet("loadUTXOSet", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startNode", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createMultisig", flag.ExitOnError)
+	createMultisigTxCmd := flag.NewFlagSet("createMultisigTx", flag.ExitOnError)
+	signMultisigTxCmd := flag.NewFlagSet("signMultisigTx", flag.ExitOnError)
+	combineMultisigTxCmd := flag.NewFlagSet("combineMultisigTx", flag.ExitOnError)
+	createMuSigCmd := flag.NewFlagSet("createMuSig", flag.ExitOnError)
+	createMuSigTxCmd := flag.NewFlagSet("createMuSigTx", flag.ExitOnError)
+	commitMuSigTxCmd := flag.NewFlagSet("commitMuSigTx", flag.ExitOnError)
+	revealMuSigTxCmd := flag.NewFlagSet("revealMuSigTx", flag.ExitOnError)
+	signMuSigTxCmd := flag.NewFlagSet("signMuSigTx", flag.ExitOnError)
+	combineMuSigTxCmd := flag.NewFlagSet("combineMuSigTx", flag.ExitOnError)
+	initiateSwapCmd := flag.NewFlagSet("initiateSwap", flag.ExitOnError)
+	redeemSwapCmd := flag.NewFlagSet("redeemSwap", flag.ExitOnError)
+	refundSwapCmd := flag.NewFlagSet("refundSwap", flag.ExitOnError)
+	auditSwapCmd := flag.NewFlagSet("auditSwap", flag.ExitOnError)
+	extractSecretCmd := flag.NewFlagSet("extractSecret", flag.ExitOnError)
+	issueAssetCmd := flag.NewFlagSet("issueAsset", flag.ExitOnError)
 
 	createChainAddress := createChainCmd.String("address", "", "The address")
+	createWalletType := createWalletCmd.String("type", "p521", "Key type of the wallet")
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address")
+	listUnspentAddress := listUnspentCmd.String("address", "", "The address")
+	dumpUTXOSetFile := dumpUTXOSetCmd.String("file", "", "Snapshot file")
+	dumpUTXOSetBlock := dumpUTXOSetCmd.String("block", "", "Hex block hash, defaults to the tip")
+	loadUTXOSetFile := loadUTXOSetCmd.String("file", "", "Snapshot file")
+	loadUTXOSetMuHash := loadUTXOSetCmd.String("muhash", "", "Hex MuHash of the snapshot from a trusted source")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
-	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendAmount := sendCmd.String("amount", "", "Amount of coins to send, up to 8 decimals")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately")
+	sendLockUntil := sendCmd.Uint("lockUntil", 0, "Block height or unix time before which the output cannot be spent")
+	sendLockBlocks := sendCmd.Uint("lockBlocks", 0, "Number of blocks after mining before the output can be spent")
+	sendData := sendCmd.String("data", "", "Hex data to anchor in the transaction")
+	sendAsset := sendCmd.String("asset", "", "Hex asset ID to send instead of the native coin")
+	sendCoinSelection := sendCmd.String("coinSelection", "default", "Coin selection policy: default, bnb, largest or oldest")
+	sendCoins := sendCmd.String("coins", "", "Comma separated TXID:INDEX outputs to spend")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable miner")
+	startNodeUTXOCache := startNodeCmd.Int("utxoCache", blockchain.DefaultUTXOCacheMemory>>20, "UTXO cache size in MB")
+	startNodeThreads := startNodeCmd.Int("threads", blockchain.MinerThreads, "Number of mining threads")
+	startNodeRPC := startNodeCmd.String("rpc", "", "JSON-RPC address for external miners")
+	startNodeStratum := startNodeCmd.String("stratum", "", "Stratum pool address")
+	startNodeShareDifficulty := startNodeCmd.Int("shareDifficulty", network.StratumShareDifficulty, "Leading zero bits of pool shares")
+	benchmarkSeconds := benchmarkCmd.Int("seconds", 10, "Seconds hashed per mode")
+	benchmarkThreads := benchmarkCmd.Int("threads", runtime.NumCPU(), "Number of hashing threads")
+	benchmarkLight := benchmarkCmd.Bool("light", false, "Only benchmark light mode")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "Number of required signatures")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated addresses or hex public keys")
+	createMultisigTxFrom := createMultisigTxCmd.String("from", "", "Source multisig address")
+	createMultisigTxTo := createMultisigTxCmd.String("to", "", "Destination wallet address")
+	createMultisigTxAmount := createMultisigTxCmd.String("amount", "", "Amount of coins to send, up to 8 decimals")
+	createMultisigTxFile := createMultisigTxCmd.String("file", "", "Partial transaction file")
+	signMultisigTxFile := signMultisigTxCmd.String("file", "", "Partial transaction file")
+	signMultisigTxAddress := signMultisigTxCmd.String("address", "", "Cosigner wallet address")
+	combineMultisigTxFiles := combineMultisigTxCmd.String("files", "", "Comma separated partial transaction files")
+	combineMultisigTxMine := combineMultisigTxCmd.Bool("mine", false, "Mine immediately")
+	createMuSigKeys := createMuSigCmd.String("keys", "", "Comma separated schnorr addresses or hex public keys")
+	createMuSigTxFrom := createMuSigTxCmd.String("from", "", "Source MuSig address")
+	createMuSigTxTo := createMuSigTxCmd.String("to", "", "Destination wallet address")
+	createMuSigTxAmount := createMuSigTxCmd.String("amount", "", "Amount of coins to send, up to 8 decimals")
+	createMuSigTxFile := createMuSigTxCmd.String("file", "", "MuSig session file")
+	commitMuSigTxFile := commitMuSigTxCmd.String("file", "", "MuSig session file")
+	commitMuSigTxAddress := commitMuSigTxCmd.String("address", "", "Cosigner wallet address")
+	revealMuSigTxFile := revealMuSigTxCmd.String("file", "", "MuSig session file")
+	revealMuSigTxAddress := revealMuSigTxCmd.String("address", "", "Cosigner wallet address")
+	signMuSigTxFile := signMuSigTxCmd.String("file", "", "MuSig session file")
+	signMuSigTxAddress := signMuSigTxCmd.String("address", "", "Cosigner wallet address")
+	combineMuSigTxFiles := combineMuSigTxCmd.String("files", "", "Comma separated MuSig session files")
+	combineMuSigTxMine := combineMuSigTxCmd.Bool("mine", false, "Mine immediately")
+	initiateSwapFrom := initiateSwapCmd.String("from", "", "Source wallet address, refunds go back here")
+	initiateSwapTo := initiateSwapCmd.String("to", "", "Recipient wallet address")
+	initiateSwapAmount := initiateSwapCmd.String("amount", "", "Amount of coins to lock, up to 8 decimals")
+	initiateSwapLockUntil := initiateSwapCmd.Uint("lockUntil", 0, "Block height or unix time after which the contract can be refunded")
+	initiateSwapSecretHash := initiateSwapCmd.String("secretHash", "", "Hex secret hash of the counterparty contract")
+	initiateSwapMine := initiateSwapCmd.Bool("mine", false, "Mine immediately")
+	redeemSwapContract := redeemSwapCmd.String("contract", "", "Contract transaction ID")
+	redeemSwapSecret := redeemSwapCmd.String("secret", "", "Hex secret")
+	redeemSwapAddress := redeemSwapCmd.String("address", "", "Recipient wallet address")
+	redeemSwapMine := redeemSwapCmd.Bool("mine", false, "Mine immediately")
+	refundSwapContract := refundSwapCmd.String("contract", "", "Contract transaction ID")
+	refundSwapAddress := refundSwapCmd.String("address", "", "Sender wallet address")
+	refundSwapMine := refundSwapCmd.Bool("mine", false, "Mine immediately")
+	auditSwapContract := auditSwapCmd.String("contract", "", "Contract transaction ID")
+	extractSecretContract := extractSecretCmd.String("contract", "", "Contract transaction ID")
+	issueAssetAddress := issueAssetCmd.String("address", "", "Issuer wallet address")
+	issueAssetName := issueAssetCmd.String("name", "", "Asset name")
+	issueAssetAmount := issueAssetCmd.String("amount", "", "Amount to issue, up to 8 decimals")
+	issueAssetTo := issueAssetCmd.String("to", "", "Recipient wallet address, defaults to the issuer")
+	issueAssetMine := issueAssetCmd.Bool("mine", false, "Mine immediately")
 
 	switch os.Args[1] {
 	case "createChain":
@@ -199,6 +934,26 @@ func (cli *CommandLine) Run() {
 		if err := getBalanceCmd.Parse(os.Args[2:]); err != nil {
 			panic(err)
 		}
+	case "listUnspent":
+		if err := listUnspentCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "getTxOutSetInfo":
+		if err := getTxOutSetInfoCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "benchmark":
+		if err := benchmarkCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "dumpUTXOSet":
+		if err := dumpUTXOSetCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "loadUTXOSet":
+		if err := loadUTXOSetCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
 	case "send":
 		if err := sendCmd.Parse(os.Args[2:]); err != nil {
 			panic(err)
@@ -207,6 +962,70 @@ func (cli *CommandLine) Run() {
 		if err := startNodeCmd.Parse(os.Args[2:]); err != nil {
 			panic(err)
 		}
+	case "createMultisig":
+		if err := createMultisigCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "createMultisigTx":
+		if err := createMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "signMultisigTx":
+		if err := signMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "combineMultisigTx":
+		if err := combineMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "createMuSig":
+		if err := createMuSigCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "createMuSigTx":
+		if err := createMuSigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "commitMuSigTx":
+		if err := commitMuSigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "revealMuSigTx":
+		if err := revealMuSigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "signMuSigTx":
+		if err := signMuSigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "combineMuSigTx":
+		if err := combineMuSigTxCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "initiateSwap":
+		if err := initiateSwapCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "redeemSwap":
+		if err := redeemSwapCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "refundSwap":
+		if err := refundSwapCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "auditSwap":
+		if err := auditSwapCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "extractSecret":
+		if err := extractSecretCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
+	case "issueAsset":
+		if err := issueAssetCmd.Parse(os.Args[2:]); err != nil {
+			panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -229,7 +1048,7 @@ func (cli *CommandLine) Run() {
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(*createWalletType, nodeID)
 	}
 
 	if listWalletsCmd.Parsed() {
@@ -244,12 +1063,52 @@ func (cli *CommandLine) Run() {
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
+	if listUnspentCmd.Parsed() {
+		if *listUnspentAddress == "" {
+			listUnspentCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.listUnspent(*listUnspentAddress, nodeID)
+	}
+
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.getTxOutSetInfo(nodeID)
+	}
+
+	if benchmarkCmd.Parsed() {
+		if *benchmarkSeconds < 1 || *benchmarkThreads < 1 {
+			benchmarkCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.benchmark(*benchmarkSeconds, *benchmarkThreads, *benchmarkLight)
+	}
+
+	if dumpUTXOSetCmd.Parsed() {
+		if *dumpUTXOSetFile == "" {
+			dumpUTXOSetCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXOSet(*dumpUTXOSetFile, *dumpUTXOSetBlock, nodeID)
+	}
+
+	if loadUTXOSetCmd.Parsed() {
+		if *loadUTXOSetFile == "" || *loadUTXOSetMuHash == "" {
+			loadUTXOSetCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.loadUTXOSet(*loadUTXOSetFile, *loadUTXOSetMuHash, nodeID)
+	}
+
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount == 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount == "" {
+			sendCmd.Usage()
+			runtime.Goexit()
+		}
+		if *sendLockUntil > 0xffffffff || *sendLockBlocks > blockchain.SequenceLockTimeMask {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, parseAmount(sendCmd, *sendAmount), nodeID, *sendMine, *sendLockUntil, *sendLockBlocks, *sendData, *sendAsset, *sendCoinSelection, *sendCoins)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -258,6 +1117,146 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		blockchain.MinerThreads = *startNodeThreads
+		network.RPCAddress = *startNodeRPC
+		network.StratumAddress = *startNodeStratum
+		network.StratumShareDifficulty = *startNodeShareDifficulty
+		if *startNodeStratum != "" && !wallet.ValidateAddress(*startNodeMiner) {
+			fmt.Println("The stratum pool pays to the -miner address")
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeUTXOCache)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired == 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisig(*createMultisigRequired, *createMultisigKeys, nodeID)
+	}
+
+	if createMultisigTxCmd.Parsed() {
+		if *createMultisigTxFrom == "" || *createMultisigTxTo == "" || *createMultisigTxAmount == "" || *createMultisigTxFile == "" {
+			createMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisigTx(*createMultisigTxFrom, *createMultisigTxTo, parseAmount(createMultisigTxCmd, *createMultisigTxAmount), *createMultisigTxFile, nodeID)
+	}
+
+	if signMultisigTxCmd.Parsed() {
+		if *signMultisigTxFile == "" || *signMultisigTxAddress == "" {
+			signMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.signMultisigTx(*signMultisigTxFile, *signMultisigTxAddress)
+	}
+
+	if combineMultisigTxCmd.Parsed() {
+		if *combineMultisigTxFiles == "" {
+			combineMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.combineMultisigTx(*combineMultisigTxFiles, nodeID, *combineMultisigTxMine)
+	}
+
+	if createMuSigCmd.Parsed() {
+		if *createMuSigKeys == "" {
+			createMuSigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMuSig(*createMuSigKeys)
+	}
+
+	if createMuSigTxCmd.Parsed() {
+		if *createMuSigTxFrom == "" || *createMuSigTxTo == "" || *createMuSigTxAmount == "" || *createMuSigTxFile == "" {
+			createMuSigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMuSigTx(*createMuSigTxFrom, *createMuSigTxTo, parseAmount(createMuSigTxCmd, *createMuSigTxAmount), *createMuSigTxFile, nodeID)
+	}
+
+	if commitMuSigTxCmd.Parsed() {
+		if *commitMuSigTxFile == "" || *commitMuSigTxAddress == "" {
+			commitMuSigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.commitMuSigTx(*commitMuSigTxFile, *commitMuSigTxAddress)
+	}
+
+	if revealMuSigTxCmd.Parsed() {
+		if *revealMuSigTxFile == "" || *revealMuSigTxAddress == "" {
+			revealMuSigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.revealMuSigTx(*revealMuSigTxFile, *revealMuSigTxAddress)
+	}
+
+	if signMuSigTxCmd.Parsed() {
+		if *signMuSigTxFile == "" || *signMuSigTxAddress == "" {
+			signMuSigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.signMuSigTx(*signMuSigTxFile, *signMuSigTxAddress)
+	}
+
+	if combineMuSigTxCmd.Parsed() {
+		if *combineMuSigTxFiles == "" {
+			combineMuSigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.combineMuSigTx(*combineMuSigTxFiles, nodeID, *combineMuSigTxMine)
+	}
+
+	if initiateSwapCmd.Parsed() {
+		if *initiateSwapFrom == "" || *initiateSwapTo == "" || *initiateSwapAmount == "" || *initiateSwapLockUntil == 0 || *initiateSwapLockUntil > 0xffffffff {
+			initiateSwapCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.initiateSwap(*initiateSwapFrom, *initiateSwapTo, parseAmount(initiateSwapCmd, *initiateSwapAmount), uint32(*initiateSwapLockUntil), *initiateSwapSecretHash, nodeID, *initiateSwapMine)
+	}
+
+	if redeemSwapCmd.Parsed() {
+		if *redeemSwapContract == "" || *redeemSwapSecret == "" || *redeemSwapAddress == "" {
+			redeemSwapCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.redeemSwap(*redeemSwapContract, *redeemSwapSecret, *redeemSwapAddress, nodeID, *redeemSwapMine)
+	}
+
+	if refundSwapCmd.Parsed() {
+		if *refundSwapContract == "" || *refundSwapAddress == "" {
+			refundSwapCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.refundSwap(*refundSwapContract, *refundSwapAddress, nodeID, *refundSwapMine)
+	}
+
+	if auditSwapCmd.Parsed() {
+		if *auditSwapContract == "" {
+			auditSwapCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.auditSwap(*auditSwapContract, nodeID)
+	}
+
+	if extractSecretCmd.Parsed() {
+		if *extractSecretContract == "" {
+			extractSecretCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.extractSecret(*extractSecretContract, nodeID)
+	}
+
+	if issueAssetCmd.Parsed() {
+		if *issueAssetAddress == "" || *issueAssetName == "" || *issueAssetAmount == "" {
+			issueAssetCmd.Usage()
+			runtime.Goexit()
+		}
+		if *issueAssetTo == "" {
+			*issueAssetTo = *issueAssetAddress
+		}
+		cli.issueAsset(*issueAssetAddress, *issueAssetName, parseAmount(issueAssetCmd, *issueAssetAmount), *issueAssetTo, nodeID, *issueAssetMine)
 	}
 }
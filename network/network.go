@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/JI-0/private-cryptocurrency/blockchain"
 	"github.com/vrecan/death/v3"
@@ -26,8 +29,14 @@ var (
 	nodeAddress     string
 	minerAddress    string
 	KnownNodes      = []string{"localhost:3000"}
+	knownNodesMutex sync.Mutex
 	blocksInTransit = [][]byte{}
 	memoryPool      = make(map[string]blockchain.Transaction)
+	memoryPoolMutex sync.Mutex
+	utxoCache       *blockchain.UTXOCache
+
+	miningMutex  sync.Mutex
+	cancelMining context.CancelFunc
 )
 
 type Address struct {
@@ -67,7 +76,7 @@ type Version struct {
 }
 
 func SendAddress(address string) {
-	nodes := Address{KnownNodes}
+	nodes := Address{knownNodes()}
 	nodes.AddressList = append(nodes.AddressList, nodeAddress)
 	payload := GobEncode(nodes)
 	requests := append(CmdToBytes("adr"), payload...)
@@ -119,6 +128,7 @@ func SendData(address string, data []byte) {
 
 	if err != nil {
 		fmt.Printf("%s is not available\n", address)
+		knownNodesMutex.Lock()
 		var updatedNodes []string
 		for _, node := range KnownNodes {
 			if node != address {
@@ -126,6 +136,7 @@ func SendData(address string, data []byte) {
 			}
 		}
 		KnownNodes = updatedNodes
+		knownNodesMutex.Unlock()
 		return
 	}
 	defer conn.Close()
@@ -155,8 +166,11 @@ func HandleAddress(request []byte) {
 	if err := decoder.Decode(&payload); err != nil {
 		fmt.Println(err)
 	}
+	knownNodesMutex.Lock()
 	KnownNodes = append(KnownNodes, payload.AddressList...)
-	fmt.Printf("%d known nodes\n", len(KnownNodes))
+	count := len(KnownNodes)
+	knownNodesMutex.Unlock()
+	fmt.Printf("%d known nodes\n", count)
 	RequestBlocks()
 }
 
@@ -173,15 +187,39 @@ func HandleBlock(request []byte, c *blockchain.Chain) {
 	blockData := payload.Block
 	block = block.Deserialize(blockData)
 	fmt.Println("New block received")
-	c.AddBlock(block)
+	UTXOSet := blockchain.UTXOSet{Chain: c, Cache: utxoCache}
+	// Only blocks extending our tip can be checked against the chain, their
+	// inputs are looked up in the unspent outputs of the tip. Other blocks
+	// are stored without moving the tip, a peer further ahead is asked for
+	// the blocks in between.
+	extendsTip := bytes.Equal(block.PrevHash, c.TipHash())
+	if extendsTip {
+		if !bytes.Equal(UTXOSet.Best(), c.TipHash()) {
+			UTXOSet.Recover()
+		}
+		if err := c.ValidateBlock(block); err != nil {
+			fmt.Println("Block rejected:", err)
+			return
+		}
+		lastHash := c.TipHash()
+		c.AddBlock(block)
+		if !bytes.Equal(lastHash, c.TipHash()) {
+			StopMining()
+			UTXOSet.Update(block)
+		}
+	} else {
+		c.StoreBlock(block)
+		if len(blocksInTransit) == 0 && block.Height > c.GetTopHeight()+1 {
+			SendGetBlocks(payload.AddressFrom)
+		}
+	}
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddressFrom, "block", blockHash)
 		blocksInTransit = blocksInTransit[1:]
 	} else {
-		UTXOSet := blockchain.UTXOSet{Chain: c}
-		UTXOSet.Reindex()
+		UTXOSet.Recover()
 	}
 }
 
@@ -218,7 +256,9 @@ func HandleGetData(request []byte, c *blockchain.Chain) {
 	}
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
+		memoryPoolMutex.Lock()
 		tx := memoryPool[txID]
+		memoryPoolMutex.Unlock()
 		SendTransaction(payload.AddressFrom, &tx)
 	}
 }
@@ -234,23 +274,29 @@ func HandleInventory(request []byte, c *blockchain.Chain) {
 	}
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddressFrom, "block", blockHash)
-
+		// The blocks are listed from the tip, they are requested from the
+		// oldest missing one so that each extends the tip when it arrives.
+		// Blocks stored above the tip are requested again to connect them.
+		topHeight := c.GetTopHeight()
 		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if block, err := c.GetBlock(payload.Items[i]); err != nil || block.Height > topHeight {
+				newInTransit = append(newInTransit, payload.Items[i])
 			}
 		}
-		blocksInTransit = newInTransit
+		if len(newInTransit) == 0 {
+			return
+		}
+		SendGetData(payload.AddressFrom, "block", newInTransit[0])
+		blocksInTransit = newInTransit[1:]
 	}
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		memoryPoolMutex.Lock()
+		known := memoryPool[hex.EncodeToString(txID)].ID != nil
+		memoryPoolMutex.Unlock()
+		if !known {
 			SendGetData(payload.AddressFrom, "tx", txID)
 		}
 	}
@@ -267,33 +313,64 @@ func HandleTransaction(request []byte, c *blockchain.Chain) {
 	}
 	transactionData := payload.Transaction
 	transaction := blockchain.DeserializeTransaction(transactionData)
+	if transaction.HasDust() {
+		fmt.Println("Transaction rejected: output below the dust threshold")
+		return
+	}
+	if err := c.AdmitTransaction(&transaction, c.GetTopHeight()+1, time.Now().Unix()); err != nil {
+		fmt.Println("Transaction rejected:", err)
+		return
+	}
+	memoryPoolMutex.Lock()
 	memoryPool[hex.EncodeToString(transaction.ID)] = transaction
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
-	if nodeAddress == KnownNodes[0] {
+	pending := len(memoryPool)
+	memoryPoolMutex.Unlock()
+	fmt.Printf("%s, %d", nodeAddress, pending)
+	nodes := knownNodes()
+	if len(nodes) > 0 && nodeAddress == nodes[0] {
 		//TODO is central node
-		for _, node := range KnownNodes {
+		for _, node := range nodes {
 			if node != nodeAddress && node != payload.AddressFrom {
 				SendInventory(node, "tx", [][]byte{transaction.ID})
 			}
 		}
 	} else {
 		// TODO mine if something
-		if len(memoryPool) >= 1 && len(minerAddress) > 0 {
+		if pending >= 1 && len(minerAddress) > 0 {
 			MineTx(c)
 		}
 	}
 }
 
-func MineTx(c *blockchain.Chain) {
-	var txs []*blockchain.Transaction
+// startMining cancels the block being mined, a new template replaces it
+func startMining() context.Context {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	if cancelMining != nil {
+		cancelMining()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelMining = cancel
+	return ctx
+}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if c.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+// StopMining cancels the block being mined, its tip is stale
+func StopMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	if cancelMining != nil {
+		cancelMining()
+		cancelMining = nil
+	}
+}
+
+func MineTx(c *blockchain.Chain) {
+	height := c.GetTopHeight() + 1
+	pending := memoryPoolTransactions()
+	for _, tx := range pending {
+		fmt.Printf("tx: %s\n", tx.ID)
 	}
+	txs := c.SelectTransactions(pending, height, time.Now().Unix())
 
 	if len(txs) == 0 {
 		println("All transactions invalid")
@@ -303,26 +380,53 @@ func MineTx(c *blockchain.Chain) {
 	cbTx := blockchain.CoinbaseTransaction(minerAddress, "")
 	txs = append(txs, cbTx)
 
-	newBlock := c.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{Chain: c}
-	UTXOSet.Reindex()
-
+	ctx := startMining()
+	newBlock, err := c.MineBlockContext(ctx, txs)
+	if err != nil {
+		fmt.Println("Mining stopped:", err)
+		return
+	}
 	fmt.Println("New block mined")
+	announceBlock(c, newBlock)
+
+	memoryPoolMutex.Lock()
+	remaining := len(memoryPool)
+	memoryPoolMutex.Unlock()
+	if remaining > 0 {
+		MineTx(c)
+	}
+}
+
+// memoryPoolTransactions lists the transactions waiting to be mined
+func memoryPoolTransactions() []*blockchain.Transaction {
+	memoryPoolMutex.Lock()
+	defer memoryPoolMutex.Unlock()
+	var txs []*blockchain.Transaction
+	for id := range memoryPool {
+		tx := memoryPool[id]
+		txs = append(txs, &tx)
+	}
+	return txs
+}
+
+// announceBlock applies a new tip to the UTXO set, drops its transactions
+// from the memory pool and sends it to the known nodes
+func announceBlock(c *blockchain.Chain, block *blockchain.Block) {
+	UTXOSet := blockchain.UTXOSet{Chain: c, Cache: utxoCache}
+	UTXOSet.Update(block)
 
-	for _, tx := range txs {
+	memoryPoolMutex.Lock()
+	for _, tx := range block.Transactions {
 		txID := hex.EncodeToString(tx.ID)
 		delete(memoryPool, txID)
 	}
+	memoryPoolMutex.Unlock()
 
-	for _, node := range KnownNodes {
+	for _, node := range knownNodes() {
 		if node != nodeAddress {
-			SendInventory(node, "block", [][]byte{newBlock.Hash})
+			SendInventory(node, "block", [][]byte{block.Hash})
 		}
 	}
-
-	if len(memoryPool) > 0 {
-		MineTx(c)
-	}
 }
 
 func HandleVersion(request []byte, c *blockchain.Chain) {
@@ -343,9 +447,11 @@ func HandleVersion(request []byte, c *blockchain.Chain) {
 		SendVersion(payload.AddressFrom, c)
 	}
 
-	if !NodeIsKnown(payload.AddressFrom) {
+	knownNodesMutex.Lock()
+	if !nodeIsKnown(payload.AddressFrom) {
 		KnownNodes = append(KnownNodes, payload.AddressFrom)
 	}
+	knownNodesMutex.Unlock()
 }
 
 func HandleConnection(conn net.Conn, chain *blockchain.Chain) {
@@ -382,12 +488,18 @@ func ExtractCmd(request []byte) []byte {
 }
 
 func RequestBlocks() {
-	for _, node := range KnownNodes {
+	for _, node := range knownNodes() {
 		SendGetBlocks(node)
 	}
 }
 
 func NodeIsKnown(address string) bool {
+	knownNodesMutex.Lock()
+	defer knownNodesMutex.Unlock()
+	return nodeIsKnown(address)
+}
+
+func nodeIsKnown(address string) bool {
 	for _, node := range KnownNodes {
 		if node == address {
 			return true
@@ -396,6 +508,14 @@ func NodeIsKnown(address string) bool {
 	return false
 }
 
+// knownNodes copies the known nodes, connection handlers and pool shares
+// change them concurrently
+func knownNodes() []string {
+	knownNodesMutex.Lock()
+	defer knownNodesMutex.Unlock()
+	return append([]string{}, KnownNodes...)
+}
+
 func CmdToBytes(cmd string) []byte {
 	var bytes [commandLength]byte
 	for i, c := range cmd {
@@ -414,8 +534,9 @@ func BytesToCmd(bytes []byte) string {
 	return fmt.Sprintf("%s", cmd)
 }
 
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddr string, utxoCacheMemory int) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	minerAddress = minerAddr
 
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
@@ -425,7 +546,21 @@ func StartServer(nodeID, minerAddress string) {
 
 	chain := blockchain.ContinueChain(nodeID)
 	defer chain.Database.Close()
+	utxoCache = blockchain.NewUTXOCache(chain, utxoCacheMemory, blockchain.DefaultUTXOCacheFlushInterval)
+	chain.UTXOCache = utxoCache
 	go CloseDB(chain)
+	if chain.SnapshotBase() != nil {
+		go ValidateSnapshot(chain)
+	}
+	if RPCAddress != "" {
+		go StartRPC(RPCAddress, chain)
+	}
+	if StratumAddress != "" {
+		stratumServer = NewStratumServer(chain, minerAddress, StratumShareDifficulty)
+		go func() {
+			fmt.Println("Stratum stopped:", stratumServer.Listen(StratumAddress))
+		}()
+	}
 
 	if nodeAddress != KnownNodes[0] {
 		SendVersion(KnownNodes[0], chain)
@@ -439,12 +574,35 @@ func StartServer(nodeID, minerAddress string) {
 	}
 }
 
+// ValidateSnapshot waits for the blocks below a loaded UTXO snapshot to be
+// synced and checks them against the snapshot
+func ValidateSnapshot(chain *blockchain.Chain) {
+	for {
+		err := chain.ValidateSnapshot()
+		if err == nil {
+			fmt.Println("Blocks below the UTXO snapshot validated")
+			return
+		}
+		if err != blockchain.ErrSnapshotHistory {
+			// The outputs loaded from the snapshot cannot be trusted, the
+			// node stops instead of serving them
+			fmt.Println("UTXO snapshot invalid, the chain must be created again:", err)
+			chain.Database.Close()
+			os.Exit(1)
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
 func CloseDB(chain *blockchain.Chain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
+		if utxoCache != nil {
+			utxoCache.Flush()
+		}
 		chain.Database.Close()
 	})
 }
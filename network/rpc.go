@@ -0,0 +1,162 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/JI-0/private-cryptocurrency/blockchain"
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+// Address of the JSON-RPC server for external miners, empty disables it
+var RPCAddress string
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// BlockTemplate is the getBlockTemplate result. Miners hash the header with
+// the 4 byte big endian nonce at NonceOffset, set the nonce of Block and pass
+// it to submitBlock.
+type BlockTemplate struct {
+	Height       int      `json:"height"`
+	PrevHash     string   `json:"previousblockhash"`
+	Timestamp    int64    `json:"curtime"`
+	Target       string   `json:"target"`
+	SeedHash     string   `json:"seedhash"`
+	Header       string   `json:"header"`
+	NonceOffset  int      `json:"nonceoffset"`
+	Transactions []string `json:"transactions"`
+	Block        string   `json:"block"`
+}
+
+var rpcMethods = map[string]func(*blockchain.Chain, json.RawMessage) (interface{}, error){
+	"getBlockTemplate":  rpcGetBlockTemplate,
+	"submitBlock":       rpcSubmitBlock,
+	"getStratumWorkers": rpcGetStratumWorkers,
+}
+
+func StartRPC(address string, c *blockchain.Chain) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var request rpcRequest
+		var response rpcResponse
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			response.Error = &rpcError{-32700, err.Error()}
+		} else if method, ok := rpcMethods[request.Method]; !ok {
+			response.ID = request.ID
+			response.Error = &rpcError{-32601, fmt.Sprintf("unknown method %q", request.Method)}
+		} else {
+			response.ID = request.ID
+			result, err := method(c, request.Params)
+			if err != nil {
+				response.Error = &rpcError{-1, err.Error()}
+			} else {
+				response.Result = result
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+	fmt.Printf("RPC listening on %s\n", address)
+	if err := http.ListenAndServe(address, http.HandlerFunc(handler)); err != nil {
+		fmt.Println("RPC stopped:", err)
+	}
+}
+
+// stringParams reads positional string parameters, missing ones are empty
+func stringParams(params json.RawMessage, n int) ([]string, error) {
+	values := make([]string, n)
+	if len(params) == 0 || string(params) == "null" {
+		return values, nil
+	}
+	var list []string
+	if err := json.Unmarshal(params, &list); err != nil {
+		return nil, err
+	}
+	if len(list) > n {
+		return nil, errors.New("too many parameters")
+	}
+	copy(values, list)
+	return values, nil
+}
+
+// rpcGetBlockTemplate takes an optional payout address, the miner address of
+// the node by default
+func rpcGetBlockTemplate(c *blockchain.Chain, params json.RawMessage) (interface{}, error) {
+	args, err := stringParams(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	address := args[0]
+	if address == "" {
+		address = minerAddress
+	}
+	if !wallet.ValidateAddress(address) {
+		return nil, errors.New("a valid payout address is required")
+	}
+
+	template := c.NewBlockTemplate(memoryPoolTransactions(), address)
+	result := &BlockTemplate{
+		Height:      template.Block.Height,
+		PrevHash:    hex.EncodeToString(template.Block.PrevHash),
+		Timestamp:   template.Block.Timestamp,
+		Target:      fmt.Sprintf("%064x", template.Target),
+		SeedHash:    hex.EncodeToString(template.SeedHash),
+		Header:      hex.EncodeToString(template.Block.Header()),
+		NonceOffset: blockchain.HeaderNonceOffset,
+		Block:       hex.EncodeToString(template.Block.Serialize()),
+	}
+	for _, tx := range template.Block.Transactions {
+		result.Transactions = append(result.Transactions, hex.EncodeToString(tx.Serialize()))
+	}
+	return result, nil
+}
+
+// rpcSubmitBlock takes a template block with its nonce set
+func rpcSubmitBlock(c *blockchain.Chain, params json.RawMessage) (interface{}, error) {
+	args, err := stringParams(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(args[0])
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("block must be hex encoded")
+	}
+	block, err := deserializeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SubmitBlock(block); err != nil {
+		return nil, err
+	}
+	fmt.Println("New block submitted")
+	StopMining()
+	announceBlock(c, block)
+	return hex.EncodeToString(block.Hash), nil
+}
+
+// deserializeBlock returns an error instead of panicking on malformed data
+func deserializeBlock(data []byte) (block *blockchain.Block, err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("malformed block")
+		}
+	}()
+	return block.Deserialize(data), nil
+}
@@ -0,0 +1,383 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JI-0/private-cryptocurrency/blockchain"
+)
+
+var (
+	// Address of the stratum pool server, empty disables it
+	StratumAddress string
+	// Leading zero bits of a share hash, shares below the block difficulty
+	// measure the work of each worker
+	StratumShareDifficulty = 2
+	// How often a job is rebuilt with the transactions of the memory pool
+	StratumJobInterval = 30 * time.Second
+	// Jobs on the tip shares are accepted for, older ones are stale
+	StratumJobsKept = 4
+
+	stratumServer *StratumServer
+)
+
+// StratumWorker is the share accounting of a worker login
+type StratumWorker struct {
+	Name     string `json:"name"`
+	Accepted int    `json:"accepted"`
+	Rejected int    `json:"rejected"`
+	Blocks   int    `json:"blocks"`
+}
+
+// StratumJob is sent to miners. Blob is the block header, nonces are 4 byte
+// big endian numbers at NonceOffset. Every connection has its own extranonce
+// in the coinbase, so connections search different headers.
+type StratumJob struct {
+	ID          string `json:"job_id"`
+	Blob        string `json:"blob"`
+	NonceOffset int    `json:"nonce_offset"`
+	Extranonce  string `json:"extranonce"`
+	Target      string `json:"target"`
+	SeedHash    string `json:"seed_hash"`
+	Height      int    `json:"height"`
+}
+
+type stratumJob struct {
+	id       string
+	template *blockchain.BlockTemplate
+	created  time.Time
+	shares   map[uint64]bool
+}
+
+type stratumNotification struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type stratumConn struct {
+	conn       net.Conn
+	encoder    *json.Encoder
+	mutex      sync.Mutex
+	extranonce uint64
+	worker     *StratumWorker
+}
+
+func (sc *stratumConn) send(message interface{}) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if err := sc.encoder.Encode(message); err != nil {
+		sc.conn.Close()
+	}
+}
+
+// StratumServer hands out jobs paying to one address. Each connection
+// searches its own extranonce, shares are checked against the share
+// target and those meeting the block target are submitted as blocks.
+type StratumServer struct {
+	chain       *blockchain.Chain
+	payout      string
+	shareTarget *big.Int
+
+	listener net.Listener
+	done     chan struct{}
+	watching sync.WaitGroup
+
+	mutex      sync.Mutex
+	job        *stratumJob
+	jobs       map[string]*stratumJob
+	nextJob    int
+	extranonce uint64
+	conns      map[*stratumConn]bool
+	workers    map[string]*StratumWorker
+}
+
+func NewStratumServer(c *blockchain.Chain, payout string, shareDifficulty int) *StratumServer {
+	return &StratumServer{
+		chain:       c,
+		payout:      payout,
+		shareTarget: blockchain.DifficultyTarget(shareDifficulty),
+		jobs:        make(map[string]*stratumJob),
+		conns:       make(map[*stratumConn]bool),
+		workers:     make(map[string]*StratumWorker),
+		done:        make(chan struct{}),
+	}
+}
+
+// Listen accepts miners and rebuilds the job when the tip changes
+func (s *StratumServer) Listen(address string) error {
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.listener = ln
+	s.mutex.Unlock()
+	s.refresh()
+	s.watching.Add(1)
+	go s.watchTip()
+	fmt.Printf("Stratum listening on %s\n", address)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting miners and building jobs
+func (s *StratumServer) Close() {
+	s.mutex.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mutex.Unlock()
+	close(s.done)
+	s.watching.Wait()
+}
+
+func (s *StratumServer) watchTip() {
+	defer s.watching.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		stale := !bytes.Equal(s.job.template.Block.PrevHash, s.chain.TipHash()) ||
+			time.Since(s.job.created) >= StratumJobInterval
+		s.mutex.Unlock()
+		if stale {
+			s.refresh()
+		}
+	}
+}
+
+// refresh builds a new job and sends it to every miner. Jobs on an older tip
+// and all but the last StratumJobsKept jobs are dropped, their shares are
+// stale.
+func (s *StratumServer) refresh() {
+	template := s.chain.NewBlockTemplate(memoryPoolTransactions(), s.payout)
+
+	s.mutex.Lock()
+	if s.job != nil && !bytes.Equal(s.job.template.Block.PrevHash, template.Block.PrevHash) {
+		s.jobs = make(map[string]*stratumJob)
+	}
+	s.nextJob++
+	job := &stratumJob{strconv.Itoa(s.nextJob), template, time.Now(), make(map[uint64]bool)}
+	s.job = job
+	s.jobs[job.id] = job
+	delete(s.jobs, strconv.Itoa(s.nextJob-StratumJobsKept))
+	var conns []*stratumConn
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mutex.Unlock()
+
+	for _, sc := range conns {
+		sc.send(stratumNotification{"job", s.jobFor(job, sc)})
+	}
+}
+
+func (s *StratumServer) jobFor(job *stratumJob, sc *stratumConn) StratumJob {
+	target := s.shareTarget
+	if target.Cmp(job.template.Target) < 0 {
+		target = job.template.Target
+	}
+	extranonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(extranonce, sc.extranonce)
+	return StratumJob{
+		ID:          job.id,
+		Blob:        hex.EncodeToString(job.template.Block.WithExtranonce(sc.extranonce).Header()),
+		NonceOffset: blockchain.HeaderNonceOffset,
+		Extranonce:  hex.EncodeToString(extranonce),
+		Target:      fmt.Sprintf("%064x", target),
+		SeedHash:    hex.EncodeToString(job.template.SeedHash),
+		Height:      job.template.Block.Height,
+	}
+}
+
+func (s *StratumServer) handle(conn net.Conn) {
+	defer conn.Close()
+	s.mutex.Lock()
+	s.extranonce++
+	sc := &stratumConn{conn: conn, encoder: json.NewEncoder(conn), extranonce: s.extranonce}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, sc)
+		s.mutex.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request rpcRequest
+		response := rpcResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = &rpcError{-32700, err.Error()}
+			sc.send(response)
+			continue
+		}
+		response.ID = request.ID
+		var result interface{}
+		var err error
+		switch request.Method {
+		case "login":
+			result, err = s.login(sc, request.Params)
+		case "getjob":
+			result, err = s.getJob(sc)
+		case "submit":
+			result, err = s.submit(sc, request.Params)
+		default:
+			err = fmt.Errorf("unknown method %q", request.Method)
+		}
+		if err != nil {
+			response.Error = &rpcError{-1, err.Error()}
+		} else {
+			response.Result = result
+		}
+		sc.send(response)
+	}
+}
+
+func (s *StratumServer) login(sc *stratumConn, params json.RawMessage) (interface{}, error) {
+	var login struct {
+		Login string `json:"login"`
+	}
+	if err := json.Unmarshal(params, &login); err != nil || login.Login == "" {
+		return nil, errors.New("login required")
+	}
+	s.mutex.Lock()
+	worker, ok := s.workers[login.Login]
+	if !ok {
+		worker = &StratumWorker{Name: login.Login}
+		s.workers[login.Login] = worker
+	}
+	sc.worker = worker
+	s.conns[sc] = true
+	job := s.job
+	s.mutex.Unlock()
+	return map[string]interface{}{"id": login.Login, "job": s.jobFor(job, sc), "status": "OK"}, nil
+}
+
+func (s *StratumServer) getJob(sc *stratumConn) (interface{}, error) {
+	if sc.worker == nil {
+		return nil, errors.New("not logged in")
+	}
+	s.mutex.Lock()
+	job := s.job
+	s.mutex.Unlock()
+	return s.jobFor(job, sc), nil
+}
+
+// submit checks a share. Rejected shares are counted against the worker.
+func (s *StratumServer) submit(sc *stratumConn, params json.RawMessage) (interface{}, error) {
+	if sc.worker == nil {
+		return nil, errors.New("not logged in")
+	}
+	err := s.checkShare(sc, params)
+	s.mutex.Lock()
+	if err != nil {
+		sc.worker.Rejected++
+	} else {
+		sc.worker.Accepted++
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "OK"}, nil
+}
+
+func (s *StratumServer) checkShare(sc *stratumConn, params json.RawMessage) error {
+	var share struct {
+		JobID string `json:"job_id"`
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(params, &share); err != nil {
+		return err
+	}
+	nonceBytes, err := hex.DecodeString(share.Nonce)
+	if err != nil || len(nonceBytes) != 4 {
+		return errors.New("nonce must be 4 hex encoded bytes")
+	}
+	nonce := binary.BigEndian.Uint32(nonceBytes)
+	key := sc.extranonce<<32 | uint64(nonce)
+
+	s.mutex.Lock()
+	job, ok := s.jobs[share.JobID]
+	duplicate := ok && job.shares[key]
+	if ok {
+		job.shares[key] = true
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return errors.New("stale job")
+	}
+	if duplicate {
+		return errors.New("duplicate share")
+	}
+
+	block := job.template.Block.WithExtranonce(sc.extranonce)
+	block.Nonce = int(nonce)
+	pow := blockchain.NewProof(s.chain, block, false)
+	hash := new(big.Int).SetBytes(pow.Hash())
+	pow.Destroy()
+	if hash.Cmp(s.shareTarget) != -1 && hash.Cmp(job.template.Target) != -1 {
+		return errors.New("share above the target")
+	}
+
+	if hash.Cmp(job.template.Target) == -1 {
+		// A block on a stale tip is still a valid share, an invalid block
+		// is not
+		if err := s.chain.SubmitBlock(block); err == blockchain.ErrStaleTip {
+			return nil
+		} else if err != nil {
+			fmt.Println("Pool block rejected:", err)
+			return err
+		}
+		fmt.Printf("Pool block found by %s\n", sc.worker.Name)
+		s.mutex.Lock()
+		sc.worker.Blocks++
+		s.mutex.Unlock()
+		StopMining()
+		announceBlock(s.chain, block)
+		s.refresh()
+	}
+	return nil
+}
+
+// Workers returns the share accounting of every worker login
+func (s *StratumServer) Workers() []StratumWorker {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var workers []StratumWorker
+	for _, worker := range s.workers {
+		workers = append(workers, *worker)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
+	return workers
+}
+
+func rpcGetStratumWorkers(c *blockchain.Chain, params json.RawMessage) (interface{}, error) {
+	if stratumServer == nil {
+		return nil, errors.New("stratum server is not running")
+	}
+	return stratumServer.Workers(), nil
+}
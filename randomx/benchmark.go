@@ -0,0 +1,207 @@
+package randomx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TestVector struct {
+	Key   []byte
+	Input []byte
+	Hash  string
+}
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ChainVectors are hashes of the library built by build-randomx.sh with the
+// chain configuration in configuration.h, one per upstream key and input. It
+// changes the Argon2 salt to "RandomX-EC\x03", so no upstream vector matches it.
+var ChainVectors = []TestVector{
+	{[]byte("test key 000"), []byte("This is a test"), "bc2bcbb0f927bac40faaf98a468f4de5e81b9395ba6c970634abb4d7b1cb007b"},
+	{[]byte("test key 000"), []byte("Lorem ipsum dolor sit amet"), "d8eff46782322079f4f835e6fb39c6891cfa24e13b4b6309fdd934402d88c7ef"},
+	{[]byte("test key 000"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "9f8fab208e816e7a782682d4493da6818595d7a9a2aae938cb96cfe87613e8f3"},
+	{[]byte("test key 001"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "f493f53a13e3432b02e56a43d80ad160d520c419c13b615c267128be4c3f4d85"},
+	{[]byte("test key 001"), mustDecode("0b0b98bea7e805e0010a2126d287a2a0cc833d312cb786385a7c2f9de69d25537f584a9bc9977b00000000666fd8753bf61a8631f12984e3fd44f4014eca629276817b56f32e9b68bd82f416"), "7dc5b4dc3623f326eccfd0f20621747b84e27077ad86ea8658af34ea270ba198"},
+}
+
+// UpstreamVectors are the reference vectors of the RandomX repository, in
+// the order of ChainVectors. They only match a library built with the
+// upstream configuration.h.
+var UpstreamVectors = []TestVector{
+	{[]byte("test key 000"), []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},
+	{[]byte("test key 000"), []byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969"},
+	{[]byte("test key 000"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"},
+	{[]byte("test key 001"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"},
+	{[]byte("test key 001"), mustDecode("0b0b98bea7e805e0010a2126d287a2a0cc833d312cb786385a7c2f9de69d25537f584a9bc9977b00000000666fd8753bf61a8631f12984e3fd44f4014eca629276817b56f32e9b68bd82f416"), "c56414121acda1713c2f2a819d8ae38aed7c80c35c2a769298d34f03833cd5f1"},
+}
+
+// hashVectors hashes the inputs of the vectors on light VMs. Vectors in a row
+// with the same key share one cache.
+func hashVectors(vectors []TestVector, flags Flag) ([][]byte, error) {
+	hashes := make([][]byte, len(vectors))
+	var cache *RxCache
+	defer func() {
+		if cache != nil {
+			cache.Close()
+		}
+	}()
+	for i := 0; i < len(vectors); {
+		key := vectors[i].Key
+		if cache == nil {
+			var err error
+			if cache, err = NewCache(key, flags); err != nil {
+				return nil, err
+			}
+		} else {
+			cache.Init(key)
+		}
+		vm, err := NewVM(cache, nil, flags)
+		if err != nil {
+			return nil, err
+		}
+		for ; i < len(vectors) && bytes.Equal(vectors[i].Key, key); i++ {
+			hashes[i] = make([]byte, RxHashSize)
+			vm.Hash(vectors[i].Input, hashes[i])
+		}
+		vm.Close()
+	}
+	return hashes, nil
+}
+
+// CheckVectors hashes the vectors on light VMs and fails on the first
+// mismatch
+func CheckVectors(vectors []TestVector, flags Flag) error {
+	hashes, err := hashVectors(vectors, flags)
+	if err != nil {
+		return err
+	}
+	for i, vector := range vectors {
+		if !bytes.Equal(hashes[i], mustDecode(vector.Hash)) {
+			return fmt.Errorf("vector %d: hash %x, expected %s", i, hashes[i], vector.Hash)
+		}
+	}
+	return nil
+}
+
+// CheckConfiguration checks that the library hashes the chain vectors. The
+// same hashes tell whether it also matches the upstream vectors, which it
+// would if built without configuration.h.
+func CheckConfiguration(flags Flag) (upstream bool, err error) {
+	hashes, err := hashVectors(ChainVectors, flags)
+	if err != nil {
+		return false, err
+	}
+	upstream = true
+	for i, vector := range ChainVectors {
+		if !bytes.Equal(hashes[i], mustDecode(UpstreamVectors[i].Hash)) {
+			upstream = false
+		}
+		if err == nil && !bytes.Equal(hashes[i], mustDecode(vector.Hash)) {
+			err = fmt.Errorf("chain vector %d: hash %x, expected %s", i, hashes[i], vector.Hash)
+		}
+	}
+	return upstream, err
+}
+
+// LargePagesAvailable tries to allocate a cache in large pages
+func LargePagesAvailable() bool {
+	cache, err := AllocCache(FlagLargePages)
+	if err != nil {
+		return false
+	}
+	ReleaseCache(cache)
+	return true
+}
+
+type BenchmarkResult struct {
+	CacheInit   time.Duration
+	DatasetInit time.Duration
+	// Hashes per second in light and full mode, full is 0 when skipped
+	LightHashrate float64
+	FullHashrate  float64
+}
+
+// Benchmark measures the initialization of a cache and, with full, a dataset
+// and hashes on threads VMs per mode for duration
+func Benchmark(flags Flag, threads int, duration time.Duration, full bool) (BenchmarkResult, error) {
+	var result BenchmarkResult
+	start := time.Now()
+	cache, err := NewCache([]byte("benchmark"), flags)
+	if err != nil {
+		return result, err
+	}
+	defer cache.Close()
+	result.CacheInit = time.Since(start)
+
+	if result.LightHashrate, err = hashrate(cache, nil, flags, threads, duration); err != nil {
+		return result, err
+	}
+	if !full {
+		return result, nil
+	}
+
+	start = time.Now()
+	dataset, err := NewDataset(cache, flags|FlagFullMEM)
+	if err != nil {
+		return result, err
+	}
+	defer dataset.Close()
+	result.DatasetInit = time.Since(start)
+
+	result.FullHashrate, err = hashrate(cache, dataset, flags|FlagFullMEM, threads, duration)
+	return result, err
+}
+
+// hashrate hashes distinct inputs on threads VMs in parallel, pipelined as
+// when mining
+func hashrate(cache *RxCache, dataset *RxDataset, flags Flag, threads int, duration time.Duration) (float64, error) {
+	if threads < 1 {
+		threads = 1
+	}
+	var vms []*RxVM
+	defer func() {
+		for _, vm := range vms {
+			vm.Close()
+		}
+	}()
+	for i := 0; i < threads; i++ {
+		vm, err := NewVM(cache, dataset, flags)
+		if err != nil {
+			return 0, err
+		}
+		vms = append(vms, vm)
+	}
+
+	var hashes uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i, vm := range vms {
+		wg.Add(1)
+		go func(i int, vm *RxVM) {
+			defer wg.Done()
+			input := make([]byte, 16)
+			hash := make([]byte, RxHashSize)
+			binary.BigEndian.PutUint64(input, uint64(i))
+			vm.HashFirst(input)
+			for n := uint64(1); time.Now().Before(deadline); n++ {
+				binary.BigEndian.PutUint64(input[8:], n)
+				vm.HashNext(input, hash)
+				atomic.AddUint64(&hashes, 1)
+			}
+		}(i, vm)
+	}
+	wg.Wait()
+	return float64(hashes) / time.Since(start).Seconds(), nil
+}
@@ -147,7 +147,40 @@ func DestroyVM(vm VM) {
 	C.randomx_destroy_vm(vm)
 }
 
+// bytesPointer passes Go memory to C without copying it, which is allowed for
+// the duration of the call
+func bytesPointer(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+func checkHash(vm VM, out []byte) {
+	if vm == nil {
+		panic("failed hashing: using empty vm")
+	}
+	if len(out) < RxHashSize {
+		panic("failed hashing: output shorter than RxHashSize")
+	}
+}
+
+// CalculateHashTo writes the hash of in to out without allocating
+func CalculateHashTo(vm VM, in, out []byte) {
+	checkHash(vm, out)
+	C.randomx_calculate_hash(vm, bytesPointer(in), C.size_t(len(in)), bytesPointer(out))
+}
+
 func CalculateHash(vm VM, in []byte) []byte {
+	hash := make([]byte, RxHashSize)
+	CalculateHashTo(vm, in, hash)
+	return hash
+}
+
+// CalculateHashCopy hashes in by copying it and the hash through C memory,
+// as CalculateHash did before hashing into Go buffers. It is kept to
+// benchmark the two against each other.
+func CalculateHashCopy(vm VM, in []byte) []byte {
 	if vm == nil {
 		panic("failed hashing: using empty vm")
 	}
@@ -167,22 +200,18 @@ func CalculateHashFirst(vm VM, in []byte) {
 		panic("failed hashing: using empty vm")
 	}
 
-	input := C.CBytes(in)
-	C.randomx_calculate_hash_first(vm, input, C.size_t(len(in)))
-	C.free(unsafe.Pointer(input))
+	C.randomx_calculate_hash_first(vm, bytesPointer(in), C.size_t(len(in)))
 }
 
-func CalculateHashNext(vm VM, in []byte) []byte {
-	if vm == nil {
-		panic("failed hashing: using empty vm")
-	}
-
-	input := C.CBytes(in)
-	output := C.CBytes(make([]byte, RxHashSize))
-	C.randomx_calculate_hash_next(vm, input, C.size_t(len(in)), output)
-	hash := C.GoBytes(output, RxHashSize)
-	C.free(unsafe.Pointer(input))
-	C.free(unsafe.Pointer(output))
+// CalculateHashNextTo writes the hash of the previous input to out and starts
+// hashing in, without allocating
+func CalculateHashNextTo(vm VM, in, out []byte) {
+	checkHash(vm, out)
+	C.randomx_calculate_hash_next(vm, bytesPointer(in), C.size_t(len(in)), bytesPointer(out))
+}
 
+func CalculateHashNext(vm VM, in []byte) []byte {
+	hash := make([]byte, RxHashSize)
+	CalculateHashNextTo(vm, in, hash)
 	return hash
 }
@@ -0,0 +1,243 @@
+package randomx
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// The Rx types own their C memory. Close frees it, a finalizer frees it if
+// Close is forgotten. A VM holds a reference on its cache and dataset, their
+// memory is freed once they are closed and their last VM is closed.
+
+var errClosed = errors.New("randomx: use of closed handle")
+
+func sumFlags(flags []Flag) Flag {
+	sum := FlagDefault
+	for _, flag := range flags {
+		sum |= flag
+	}
+	return sum
+}
+
+type RxCache struct {
+	mutex  sync.Mutex
+	cache  Cache
+	vms    int
+	closed bool
+}
+
+// NewCache allocates a cache and initializes it with a seed
+func NewCache(seed []byte, flags ...Flag) (*RxCache, error) {
+	cache, err := AllocCache(sumFlags(flags))
+	if err != nil {
+		return nil, err
+	}
+	c := &RxCache{cache: cache}
+	runtime.SetFinalizer(c, (*RxCache).Close)
+	InitCache(cache, seed)
+	return c, nil
+}
+
+// Init reinitializes the cache with another seed
+func (c *RxCache) Init(seed []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		panic(errClosed)
+	}
+	InitCache(c.cache, seed)
+}
+
+// Close frees the cache, or leaves it to the last of its VMs
+func (c *RxCache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	c.release()
+	runtime.SetFinalizer(c, nil)
+}
+
+// acquire references the cache for a VM
+func (c *RxCache) acquire() (Cache, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, errClosed
+	}
+	c.vms++
+	return c.cache, nil
+}
+
+func (c *RxCache) leave() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.vms--
+	c.release()
+}
+
+func (c *RxCache) release() {
+	if c.closed && c.vms == 0 && c.cache != nil {
+		ReleaseCache(c.cache)
+		c.cache = nil
+	}
+}
+
+type RxDataset struct {
+	mutex  sync.Mutex
+	ds     Dataset
+	vms    int
+	closed bool
+}
+
+// NewDataset allocates a dataset and initializes it from a cache on all CPUs
+func NewDataset(cache *RxCache, flags ...Flag) (*RxDataset, error) {
+	ds, err := AllocDataset(sumFlags(flags))
+	if err != nil {
+		return nil, err
+	}
+	d := &RxDataset{ds: ds}
+	runtime.SetFinalizer(d, (*RxDataset).Close)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.closed {
+		d.Close()
+		return nil, errClosed
+	}
+	count := DatasetItemCount()
+	var wg sync.WaitGroup
+	workerNum := uint32(runtime.NumCPU())
+	for i := uint32(0); i < workerNum; i++ {
+		wg.Add(1)
+		a := (count * i) / workerNum
+		b := (count * (i + 1)) / workerNum
+		go func() {
+			defer wg.Done()
+			InitDataset(ds, cache.cache, a, b-a)
+		}()
+	}
+	wg.Wait()
+	return d, nil
+}
+
+// Close frees the dataset, or leaves it to the last of its VMs
+func (d *RxDataset) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	d.release()
+	runtime.SetFinalizer(d, nil)
+}
+
+// acquire references the dataset for a VM
+func (d *RxDataset) acquire() (Dataset, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, errClosed
+	}
+	d.vms++
+	return d.ds, nil
+}
+
+func (d *RxDataset) leave() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.vms--
+	d.release()
+}
+
+func (d *RxDataset) release() {
+	if d.closed && d.vms == 0 && d.ds != nil {
+		ReleaseDataset(d.ds)
+		d.ds = nil
+	}
+}
+
+// RxVM hashes on a cache, or on a dataset with FlagFullMEM. Its calls are
+// serialized, a VM hashes one input at a time.
+type RxVM struct {
+	mutex   sync.Mutex
+	vm      VM
+	cache   *RxCache
+	dataset *RxDataset
+}
+
+// NewVM creates a VM, dataset is nil for a light VM
+func NewVM(cache *RxCache, dataset *RxDataset, flags ...Flag) (*RxVM, error) {
+	v := &RxVM{}
+	var c Cache
+	var ds Dataset
+	var err error
+	if cache != nil {
+		if c, err = cache.acquire(); err != nil {
+			return nil, err
+		}
+		v.cache = cache
+	}
+	if dataset != nil {
+		if ds, err = dataset.acquire(); err != nil {
+			v.leave()
+			return nil, err
+		}
+		v.dataset = dataset
+	}
+	if v.vm, err = CreateVM(c, ds, flags...); err != nil {
+		v.leave()
+		return nil, err
+	}
+	runtime.SetFinalizer(v, (*RxVM).Close)
+	return v, nil
+}
+
+// leave drops the references on the cache and dataset
+func (v *RxVM) leave() {
+	if v.cache != nil {
+		v.cache.leave()
+		v.cache = nil
+	}
+	if v.dataset != nil {
+		v.dataset.leave()
+		v.dataset = nil
+	}
+}
+
+func (v *RxVM) handle() VM {
+	if v.vm == nil {
+		panic(errClosed)
+	}
+	return v.vm
+}
+
+// Hash writes the hash of in to out, which must hold RxHashSize bytes
+func (v *RxVM) Hash(in, out []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	CalculateHashTo(v.handle(), in, out)
+}
+
+// HashFirst starts pipelined hashing, HashNext returns the hash of the
+// previous input while starting on the next
+func (v *RxVM) HashFirst(in []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	CalculateHashFirst(v.handle(), in)
+}
+
+func (v *RxVM) HashNext(in, out []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	CalculateHashNextTo(v.handle(), in, out)
+}
+
+func (v *RxVM) Close() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.vm != nil {
+		DestroyVM(v.vm)
+		v.vm = nil
+	}
+	v.leave()
+	runtime.SetFinalizer(v, nil)
+}
@@ -1,12 +1,21 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
 	"fmt"
+	"math/big"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/JI-0/private-cryptocurrency/blockchain"
+	"github.com/JI-0/private-cryptocurrency/randomx"
 	"github.com/JI-0/private-cryptocurrency/wallet"
+	"github.com/dgraph-io/badger"
 )
 
 const (
@@ -39,7 +48,7 @@ func TestCreationOfChainAndBlocks(t *testing.T) {
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
 	UTXOSet.Reindex()
 	//Get balance
-	balance := 0
+	var balance blockchain.Amount
 	UTXOs := UTXOSet.FindUTXO(w0publicKeyHash)
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -97,14 +106,766 @@ func TestCreationOfChainAndBlocks(t *testing.T) {
 		// fmt.Printf("Data: %s\n", block.Transactions)
 		fmt.Printf("Hash: %x\n", block.Hash)
 
-		pow := blockchain.NewProof(chain, block, true)
-		if !pow.Validate() {
+		if !blockchain.VerifyProof(chain, block) {
 			t.Fatalf(`Proof of work returned invalid`)
 		}
-		pow.Destroy()
 
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
 }
+
+func TestOutpointUTXOSet(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_utxo")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "utxo")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+
+	// Spending the first output of a transaction leaves the change at its
+	// position
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 20, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{tx}))
+	spend := blockchain.NewTransaction(w1, string(w0.Address()), 20, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{spend}))
+	change, ok := UTXOSet.GetUTXO(blockchain.Outpoint{ID: tx.ID, Index: 1})
+	if !ok || change.Output.Value != blockchain.CoinbaseReward-20 || change.Height != 1 || change.Coinbase {
+		t.Fatal("Change output not found at its outpoint")
+	}
+	if _, ok := UTXOSet.GetUTXO(blockchain.Outpoint{ID: tx.ID, Index: 0}); ok {
+		t.Fatal("Spent output still in the UTXO set")
+	}
+	spendChange := blockchain.NewTransaction(w0, string(w1.Address()), 90, &UTXOSet)
+	if err := chain.ValidateTransaction(spendChange, chain.GetTopHeight()+1, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spent outputs and outputs listed twice are rejected
+	if err := chain.ValidateTransaction(tx, chain.GetTopHeight()+1, time.Now().Unix()); err == nil {
+		t.Fatal("Replayed spend accepted")
+	}
+	double := *spendChange
+	double.Inputs = append(double.Inputs, spendChange.Inputs[0])
+	double.ID = double.Hash()
+	if err := chain.ValidateTransaction(&double, chain.GetTopHeight()+1, time.Now().Unix()); err == nil {
+		t.Fatal("Duplicate input accepted")
+	}
+
+	// Records of the old layout are replaced by a reindex
+	count := UTXOSet.CountOutputs()
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte("utxo-"), tx.ID...), []byte{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !UTXOSet.Migrate() || UTXOSet.Migrate() || UTXOSet.CountOutputs() != count {
+		t.Fatal("UTXO set not migrated")
+	}
+}
+
+func TestUTXOCache(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_utxocache")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "utxocache")
+	stored := blockchain.UTXOSet{Chain: chain}
+	stored.Reindex()
+	cache := blockchain.NewUTXOCache(chain, blockchain.DefaultUTXOCacheMemory, 10)
+	UTXOSet := blockchain.UTXOSet{Chain: chain, Cache: cache}
+
+	// Outputs stay in memory until the cache is flushed
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 20, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{tx}))
+	outpoint := blockchain.Outpoint{ID: tx.ID, Index: 0}
+	if _, ok := UTXOSet.GetUTXO(outpoint); !ok {
+		t.Fatal("Output not found in the cache")
+	}
+	if _, ok := stored.GetUTXO(outpoint); ok {
+		t.Fatal("Output written before the flush")
+	}
+
+	// Queries read the cache merged with the stored set and do not flush it
+	if len(UTXOSet.FindUTXO(wallet.PublicKeyHash(w1.PublicKey))) != 1 || UTXOSet.CountOutputs() != 2 {
+		t.Fatal("Cached outputs not found by the queries")
+	}
+	info := UTXOSet.Info()
+	if _, ok := stored.GetUTXO(outpoint); ok {
+		t.Fatal("Output written by a query")
+	}
+	if info.Transactions != 1 || info.Outputs != 2 || !bytes.Equal(info.BestBlock, chain.LastHash) {
+		t.Fatal("Wrong set summary from the cache")
+	}
+	cache.Flush()
+	if _, ok := stored.GetUTXO(outpoint); !ok {
+		t.Fatal("Output not written by the flush")
+	}
+	if !bytes.Equal(info.Commitment, stored.Commitment()) || stored.CountOutputs() != 2 {
+		t.Fatal("Cached set differs from the flushed set")
+	}
+
+	// Blocks applied after the last flush are replayed on startup
+	spend := blockchain.NewTransaction(w1, string(w0.Address()), 20, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{spend}))
+	unflushed := blockchain.NewTransaction(w0, string(w1.Address()), 30, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{unflushed}))
+	chain.Database.Close()
+	chain = blockchain.ContinueChain("utxocache")
+	stored = blockchain.UTXOSet{Chain: chain}
+	if _, ok := stored.GetUTXO(blockchain.Outpoint{ID: unflushed.ID, Index: 0}); !ok {
+		t.Fatal("Unflushed block not replayed")
+	}
+	if _, ok := stored.GetUTXO(outpoint); ok {
+		t.Fatal("Spent output restored")
+	}
+
+	// An interrupted flush is finished from its journal
+	interruptFlush(t, chain, chain.MineBlock([]*blockchain.Transaction{blockchain.NewTransaction(w0, string(w1.Address()), 10*blockchain.Coin, &stored)}))
+	chain.Database.Close()
+	chain = blockchain.ContinueChain("utxocache")
+	defer chain.Database.Close()
+	stored = blockchain.UTXOSet{Chain: chain}
+	recovered := stored.Commitment()
+	if info := stored.Info(); !bytes.Equal(info.BestBlock, chain.LastHash) || info.Outputs != 4 {
+		t.Fatal("UTXO set not recovered after an interrupted flush")
+	}
+	stored.Reindex()
+	if !bytes.Equal(recovered, stored.Commitment()) {
+		t.Fatal("Recovered set hash differs from the rebuilt set")
+	}
+}
+
+// interruptFlush journals the changes of a block to the stored set and stops
+// the flush after the first change is written, as a crash would
+func interruptFlush(t *testing.T, chain *blockchain.Chain, block *blockchain.Block) {
+	type coinChange struct {
+		UTXO  blockchain.UTXO
+		Spent bool
+	}
+	stored := blockchain.UTXOSet{Chain: chain}
+	var changes []coinChange
+	for _, tx := range block.Transactions {
+		coinbase := tx.IsCoinbaseTransaction()
+		if !coinbase {
+			for _, in := range tx.Inputs {
+				utxo, ok := stored.GetUTXO(blockchain.Outpoint{ID: in.ID, Index: in.Output})
+				if !ok {
+					t.Fatal("Spent output not stored")
+				}
+				changes = append(changes, coinChange{utxo, true})
+			}
+		}
+		for outId, out := range tx.Outputs {
+			utxo := blockchain.UTXO{Outpoint: blockchain.Outpoint{ID: tx.ID, Index: outId}, Output: out, Height: block.Height, Coinbase: coinbase}
+			changes = append(changes, coinChange{UTXO: utxo})
+		}
+	}
+	coinKey := func(outpoint blockchain.Outpoint) []byte {
+		return binary.BigEndian.AppendUint32(append([]byte("coin-"), outpoint.ID...), uint32(outpoint.Index))
+	}
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		for _, change := range changes {
+			var encoded bytes.Buffer
+			if err := gob.NewEncoder(&encoded).Encode(change); err != nil {
+				return err
+			}
+			if err := txn.Set(append([]byte("coinjournal-"), coinKey(change.UTXO.Outpoint)...), encoded.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte("coinstate-flush"), block.Hash); err != nil {
+			return err
+		}
+		return txn.Delete(coinKey(changes[0].UTXO.Outpoint))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTXOCommitment(t *testing.T) {
+	a, b := blockchain.NewMuHash(), blockchain.NewMuHash()
+	a.Insert([]byte("first"))
+	a.Insert([]byte("second"))
+	b.Insert([]byte("second"))
+	b.Insert([]byte("third"))
+	b.Insert([]byte("first"))
+	b.Remove([]byte("third"))
+	if !bytes.Equal(a.Finalize(), b.Finalize()) {
+		t.Fatal("MuHash depends on insertion order")
+	}
+
+	os.RemoveAll("./tmp/blocks_commitment")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "commitment")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+	genesis := UTXOSet.Commitment()
+
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 20*blockchain.Coin, &UTXOSet)
+	block := chain.MineBlock([]*blockchain.Transaction{tx})
+	UTXOSet.Update(block)
+	cache := blockchain.NewUTXOCache(chain, blockchain.DefaultUTXOCacheMemory, 10)
+	cached := blockchain.UTXOSet{Chain: chain, Cache: cache}
+	spend := blockchain.NewTransaction(w1, string(w0.Address()), 5*blockchain.Coin, &cached)
+	cached.Update(chain.MineBlock([]*blockchain.Transaction{spend}))
+	updated := cached.Commitment()
+	UTXOSet.Reindex()
+	if !bytes.Equal(updated, UTXOSet.Commitment()) {
+		t.Fatal("Rolling commitment differs from a reindex")
+	}
+	info := UTXOSet.Info()
+	if info.Outputs != 3 || info.TotalAmount != blockchain.CoinbaseReward || info.Height != 2 || !bytes.Equal(info.Commitment, updated) {
+		t.Fatal("Wrong UTXO set info")
+	}
+
+	lastBlock, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UTXOSet.Disconnect(&lastBlock)
+	UTXOSet.Disconnect(block)
+	if !bytes.Equal(genesis, UTXOSet.Commitment()) || UTXOSet.CountOutputs() != 1 {
+		t.Fatal("Disconnecting blocks did not restore the commitment")
+	}
+}
+
+func TestUTXOSnapshot(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_snapsrc")
+	os.RemoveAll("./tmp/blocks_snapdst")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	source := blockchain.NewChain(string(w0.Address()), "snapsrc")
+	defer source.Database.Close()
+	sourceSet := blockchain.UTXOSet{Chain: source}
+	sourceSet.Reindex()
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 20*blockchain.Coin, &sourceSet)
+	first := source.MineBlock([]*blockchain.Transaction{tx, blockchain.CoinbaseTransaction(string(w0.Address()), "")})
+	sourceSet.Update(first)
+	tx = blockchain.NewTransaction(w0, string(w1.Address()), 30*blockchain.Coin, &sourceSet)
+	sourceSet.Update(source.MineBlock([]*blockchain.Transaction{tx, blockchain.CoinbaseTransaction(string(w0.Address()), "")}))
+
+	// Sets before the tip are rebuilt from the blocks
+	var older bytes.Buffer
+	header, err := sourceSet.ExportSnapshot(first.Hash, &older)
+	if err != nil || header.Outputs != 3 {
+		t.Fatal("Snapshot of an older block not exported", err)
+	}
+	var snapshot bytes.Buffer
+	header, err = sourceSet.ExportSnapshot(source.LastHash, &snapshot)
+	if err != nil || !bytes.Equal(header.Commitment, sourceSet.Commitment()) {
+		t.Fatal("Snapshot of the tip not exported", err)
+	}
+
+	// A snapshot is only loaded with the MuHash the user trusts, the
+	// commitment in the file is not
+	tampered := header
+	tampered.Commitment = make([]byte, 64)
+	var forged bytes.Buffer
+	if err := gob.NewEncoder(&forged).Encode(tampered); err != nil {
+		t.Fatal(err)
+	}
+	forged.Write(snapshot.Bytes()[len(snapshot.Bytes())-snapshotOutputsLen(t, snapshot.Bytes()):])
+	if _, err := blockchain.LoadSnapshot(&forged, "snapdst", tampered.Commitment); err == nil {
+		t.Fatal("Snapshot with a wrong commitment loaded")
+	}
+	if _, err := blockchain.LoadSnapshot(bytes.NewReader(older.Bytes()), "snapdst", header.Commitment); err == nil {
+		t.Fatal("Snapshot loaded with another MuHash")
+	}
+
+	chain, err := blockchain.LoadSnapshot(bytes.NewReader(snapshot.Bytes()), "snapdst", header.Commitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	info := UTXOSet.Info()
+	if info.Height != 2 || !bytes.Equal(info.Commitment, header.Commitment) {
+		t.Fatal("Wrong UTXO set loaded from the snapshot")
+	}
+
+	// Outputs from below the snapshot can be spent
+	spend := blockchain.NewTransaction(w1, string(w0.Address()), 40*blockchain.Coin, &UTXOSet)
+	if err := chain.ValidateTransaction(spend, 3, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flush interrupted on a snapshot node is finished without the blocks
+	// below the base
+	interruptFlush(t, chain, chain.MineBlock([]*blockchain.Transaction{spend}))
+	chain.Database.Close()
+	chain = blockchain.ContinueChain("snapdst")
+	defer chain.Database.Close()
+	UTXOSet = blockchain.UTXOSet{Chain: chain}
+	recovered := UTXOSet.Commitment()
+	if info := UTXOSet.Info(); info.Height != 3 || info.Outputs != 5 {
+		t.Fatal("UTXO set of the snapshot not recovered after an interrupted flush")
+	}
+
+	if err := chain.ValidateSnapshot(); err != blockchain.ErrSnapshotHistory {
+		t.Fatal("Snapshot validated without its history")
+	}
+	iter := source.Iterator()
+	for {
+		block := iter.Next()
+		chain.StoreBlock(block)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	// Blocks below the base are validated like blocks on the tip
+	invalid := *first
+	invalid.Transactions = []*blockchain.Transaction{{ID: first.Transactions[0].ID, Inputs: first.Transactions[0].Inputs, Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(1000, string(w1.Address()))}}}
+	storeBlock := func(block *blockchain.Block) {
+		if err := chain.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(block.Hash, block.Serialize())
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeBlock(&invalid)
+	if err := chain.ValidateSnapshot(); err == nil || err == blockchain.ErrSnapshotHistory || chain.SnapshotBase() == nil {
+		t.Fatal("Snapshot validated with an invalid block below it", err)
+	}
+	storeBlock(first)
+
+	if err := chain.ValidateSnapshot(); err != nil || chain.SnapshotBase() != nil {
+		t.Fatal("Snapshot history not validated", err)
+	}
+	UTXOSet.Reindex()
+	if UTXOSet.CountOutputs() != 5 || !bytes.Equal(recovered, UTXOSet.Commitment()) {
+		t.Fatal("Reindex after validating the snapshot history failed")
+	}
+}
+
+// snapshotOutputsLen returns the length of the outputs following the header
+func snapshotOutputsLen(t *testing.T, data []byte) int {
+	reader := bytes.NewReader(data)
+	var header blockchain.SnapshotHeader
+	if err := gob.NewDecoder(reader).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	return reader.Len()
+}
+
+func TestCoinSelection(t *testing.T) {
+	var candidates []blockchain.UTXO
+	for i, value := range []blockchain.Amount{50, 10, 30, 5, 20} {
+		candidates = append(candidates, blockchain.UTXO{
+			Outpoint: blockchain.Outpoint{ID: []byte{byte(i)}, Index: 0},
+			Output:   blockchain.TransactionOutput{Value: value},
+			Height:   5 - i,
+		})
+	}
+	values := func(UTXOs []blockchain.UTXO) []int64 {
+		var v []int64
+		for _, utxo := range UTXOs {
+			v = append(v, int64(utxo.Output.Value))
+		}
+		return v
+	}
+
+	selected, err := blockchain.BranchAndBound{}.Select(candidates, 45)
+	if err != nil || fmt.Sprint(values(selected)) != "[30 10 5]" {
+		t.Fatal("Branch and bound found no exact match", values(selected), err)
+	}
+	if _, err := (blockchain.BranchAndBound{}).Select(candidates, 116); err != blockchain.ErrInsufficientFunds {
+		t.Fatal("Branch and bound selected more than the candidates")
+	}
+	if _, err := (blockchain.BranchAndBound{}).Select(candidates, 4); err != blockchain.ErrNoExactMatch {
+		t.Fatal("Branch and bound matched an impossible amount")
+	}
+	if selected, _ := (blockchain.BranchAndBound{CostOfChange: 1}).Select(candidates, 4); fmt.Sprint(values(selected)) != "[5]" {
+		t.Fatal("Branch and bound ignored the cost of change")
+	}
+	if selected, _ := (blockchain.LargestFirst{}).Select(candidates, 60); fmt.Sprint(values(selected)) != "[50 30]" {
+		t.Fatal("Largest first selected", values(selected))
+	}
+	if selected, _ := (blockchain.OldestFirst{}).Select(candidates, 24); fmt.Sprint(values(selected)) != "[20 5]" {
+		t.Fatal("Oldest first selected", values(selected))
+	}
+	if selected, _ := blockchain.DefaultCoinSelector.Select(candidates, 4); fmt.Sprint(values(selected)) != "[50]" {
+		t.Fatal("Default selection did not fall back to largest first", values(selected))
+	}
+	manual := blockchain.ManualSelector{Outpoints: []blockchain.Outpoint{candidates[3].Outpoint}, Fallback: blockchain.LargestFirst{}}
+	if selected, _ := manual.Select(candidates, 40); fmt.Sprint(values(selected)) != "[5 50]" {
+		t.Fatal("Manual selection did not spend the pinned output", values(selected))
+	}
+	manual.Fallback = nil
+	if _, err := manual.Select(candidates, 40); err != blockchain.ErrInsufficientFunds {
+		t.Fatal("Manual selection without fallback spent other outputs")
+	}
+
+	// Transactions spend the pinned outputs
+	os.RemoveAll("./tmp/blocks_coins")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "coins")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+	split := blockchain.NewTransactionWithOutputs(w0, []blockchain.TransactionOutput{
+		*blockchain.NewTxOutput(30, string(w0.Address())),
+		*blockchain.NewTxOutput(30, string(w0.Address())),
+	}, &UTXOSet)
+	UTXOSet.Update(chain.MineBlock([]*blockchain.Transaction{split}))
+	pinned := blockchain.Outpoint{ID: split.ID, Index: 1}
+	UTXOSet.Selector = blockchain.ManualSelector{Outpoints: []blockchain.Outpoint{pinned}}
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 30, &UTXOSet)
+	if len(tx.Inputs) != 1 || !bytes.Equal(tx.Inputs[0].ID, split.ID) || tx.Inputs[0].Output != 1 || len(tx.Outputs) != 1 {
+		t.Fatal("Transaction did not spend the pinned output without change")
+	}
+}
+
+func TestAmounts(t *testing.T) {
+	for text, units := range map[string]blockchain.Amount{
+		"0":          0,
+		"1":          blockchain.Coin,
+		"1.5":        blockchain.Coin + blockchain.Coin/2,
+		"0.00000001": 1,
+		".25":        blockchain.Coin / 4,
+		"21000000":   blockchain.MaxMoney,
+	} {
+		amount, err := blockchain.ParseAmount(text)
+		if err != nil || amount != units {
+			t.Fatal("Amount parsed wrong:", text, amount, err)
+		}
+	}
+	for _, text := range []string{"", ".", "-1", "1.000000001", "1e3", "21000000.00000001", "99999999999999999999"} {
+		if _, err := blockchain.ParseAmount(text); err == nil {
+			t.Fatal("Invalid amount parsed:", text)
+		}
+	}
+	if s := (blockchain.Coin*12 + 3400000).String(); s != "12.034" {
+		t.Fatal("Amount formatted as", s)
+	}
+	if _, err := blockchain.AddAmounts(blockchain.MaxMoney, 1); err != blockchain.ErrAmountRange {
+		t.Fatal("Sum above MaxMoney accepted")
+	}
+	if _, err := blockchain.AddAmounts(5, -1); err != blockchain.ErrAmountRange {
+		t.Fatal("Negative amount accepted")
+	}
+
+	w := wallet.NewWallet()
+	previousTxs := map[string]blockchain.Transaction{
+		"70726576696f7573": {ID: []byte("previous"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(blockchain.MaxMoney, string(w.Address()))}},
+	}
+	spend := func(values ...blockchain.Amount) *blockchain.Transaction {
+		tx := &blockchain.Transaction{Inputs: []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0, Sequence: blockchain.SequenceFinal}}}
+		for _, value := range values {
+			tx.Outputs = append(tx.Outputs, *blockchain.NewTxOutput(value, string(w.Address())))
+		}
+		return tx
+	}
+	if err := spend(blockchain.MaxMoney-1, 1).CheckAssets(previousTxs); err != nil {
+		t.Fatal(err)
+	}
+	if spend(blockchain.MaxMoney, blockchain.MaxMoney).CheckAssets(previousTxs) == nil {
+		t.Fatal("Outputs above MaxMoney accepted")
+	}
+	// Overflowing int64 must not wrap around to a small sum
+	if spend(1<<62, 1<<62, 1<<62, 1<<62).CheckAssets(previousTxs) == nil {
+		t.Fatal("Overflowing outputs accepted")
+	}
+	if spend(-1).CheckAssets(previousTxs) == nil {
+		t.Fatal("Negative output accepted")
+	}
+	if !spend(blockchain.DustThreshold-1).HasDust() || spend(blockchain.DustThreshold).HasDust() {
+		t.Fatal("Wrong dust threshold")
+	}
+}
+
+func TestMiner(t *testing.T) {
+	block := &blockchain.Block{Timestamp: time.Now().Unix(), Transactions: []*blockchain.Transaction{blockchain.CoinbaseTransaction(string(wallet.NewWallet().Address()), "")}, PrevHash: []byte("previous"), Height: 1}
+	pow := blockchain.NewProof(nil, block, true)
+	defer pow.Destroy()
+	nonce, hash, err := pow.Mine(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Nonce = nonce
+	if !pow.Validate() {
+		t.Fatal("Mined nonce is invalid")
+	}
+	if len(hash) == 0 {
+		t.Fatal("No hash returned")
+	}
+
+	// Nothing meets a zero target, mining only ends when canceled
+	pow.Target = big.NewInt(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := pow.Mine(ctx, 4); err != blockchain.ErrMiningCanceled {
+		t.Fatal("Mining was not canceled", err)
+	}
+}
+
+func TestSeedManager(t *testing.T) {
+	epochs := map[int]int{0: 0, 63: 0, 64: 1, 2047: 1, 2048: 1, 2111: 1, 2112: 2}
+	for height, epoch := range epochs {
+		if blockchain.SeedEpoch(height) != epoch {
+			t.Fatalf("Wrong seed epoch at height %d", height)
+		}
+	}
+
+	block := &blockchain.Block{Timestamp: time.Now().Unix(), Transactions: []*blockchain.Transaction{blockchain.CoinbaseTransaction(string(wallet.NewWallet().Address()), "")}, PrevHash: []byte("previous"), Height: 1}
+	pow := blockchain.NewProof(nil, block, true)
+	block.Nonce, _ = pow.Run()
+	vm := pow.VM
+	pow.Destroy()
+
+	// Released VMs are handed out again instead of creating new ones
+	pow = blockchain.NewProof(nil, block, true)
+	if pow.VM != vm {
+		t.Fatal("VM was not reused")
+	}
+	defer pow.Destroy()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(fullMem bool) {
+			defer wg.Done()
+			other := blockchain.NewProof(nil, block, fullMem)
+			defer other.Destroy()
+			if other.VM == pow.VM {
+				t.Error("VM in use was handed out")
+			}
+			if !other.Validate() {
+				t.Error("Proof of work returned invalid")
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+
+	// Epochs are matched on their seed, chains with another seed block do
+	// not share them. The seed is taken from the ancestry of the block, a
+	// block off the tip uses its own.
+	os.RemoveAll("./tmp/blocks_seeda")
+	os.RemoveAll("./tmp/blocks_seedb")
+	os.MkdirAll("./tmp/wallets", 0700)
+	chains := []*blockchain.Chain{
+		blockchain.NewChain(string(wallet.NewWallet().Address()), "seeda"),
+		blockchain.NewChain(string(wallet.NewWallet().Address()), "seedb"),
+	}
+	for _, chain := range chains {
+		defer chain.Database.Close()
+	}
+	seeded := func(chain *blockchain.Chain) *blockchain.Block {
+		return &blockchain.Block{Timestamp: block.Timestamp, Transactions: block.Transactions, PrevHash: chain.LastHash, Height: blockchain.SeedEpochLag}
+	}
+	hash := func(chain *blockchain.Chain, block *blockchain.Block) string {
+		pow := blockchain.NewProof(chain, block, false)
+		defer pow.Destroy()
+		return fmt.Sprintf("%x", pow.Hash())
+	}
+	a := seeded(chains[0])
+	first := hash(chains[0], a)
+	hash(chains[1], seeded(chains[1]))
+	if hash(chains[0], a) != first {
+		t.Fatal("Epoch of another seed reused")
+	}
+	genesis, _ := chains[0].GetBlock(chains[0].LastHash)
+	chains[1].StoreBlock(&genesis)
+	if hash(chains[1], a) != first {
+		t.Fatal("Seed not taken from the ancestry of the block")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Seed of a later epoch found without a chain")
+		}
+	}()
+	blockchain.NewProof(nil, a, false)
+}
+
+func TestLightVerification(t *testing.T) {
+	block := &blockchain.Block{Timestamp: time.Now().Unix(), Transactions: []*blockchain.Transaction{blockchain.CoinbaseTransaction(string(wallet.NewWallet().Address()), "")}, PrevHash: []byte("previous"), Height: 1}
+	pow := blockchain.NewProof(nil, block, true)
+	defer pow.Destroy()
+	for nonce := 0; nonce < 32; nonce++ {
+		block.Nonce = nonce
+		block.Hash = pow.Hash()
+		if blockchain.VerifyProof(nil, block) != pow.Validate() {
+			t.Fatalf("Light and full VMs disagree on nonce %d", nonce)
+		}
+	}
+}
+
+func TestBlockTemplate(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_template")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "template")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+
+	// Solve a template as an external miner would, from the hashing data.
+	// Without valid the first nonce missing the target is used.
+	solve := func(template *blockchain.BlockTemplate, valid bool) {
+		pow := blockchain.NewProof(chain, template.Block, false)
+		defer pow.Destroy()
+		data := template.Block.Header()
+		out := make([]byte, randomx.RxHashSize)
+		for nonce := 0; ; nonce++ {
+			binary.BigEndian.PutUint32(data[blockchain.HeaderNonceOffset:], uint32(nonce))
+			pow.VM.Hash(data, out)
+			hash := new(big.Int).SetBytes(out)
+			if (hash.Cmp(template.Target) == -1) == valid {
+				template.Block.Nonce = nonce
+				return
+			}
+		}
+	}
+
+	tx := blockchain.NewTransaction(w0, string(w1.Address()), 20, &UTXOSet)
+	if err := chain.AdmitTransaction(tx, 1, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	template := chain.NewBlockTemplate([]*blockchain.Transaction{tx}, string(w1.Address()))
+	block := template.Block
+	if block.Height != 1 || !bytes.Equal(block.PrevHash, chain.LastHash) || len(block.Transactions) != 2 {
+		t.Fatal("Wrong template")
+	}
+
+	// The block is checked with the signatures cached at admission, a
+	// signature that was not admitted is still verified
+	forged := *tx
+	forged.Inputs = append([]blockchain.TransactionInput{}, tx.Inputs...)
+	pushes := forged.Inputs[0].UnlockingScript.PushedData()
+	signature := append([]byte{}, pushes[0]...)
+	signature[0] ^= 1
+	forged.Inputs[0].UnlockingScript = blockchain.PayToPublicKeyHashUnlockingScript(signature, pushes[1])
+	forged.ID = forged.Hash()
+	block.Transactions[0] = &forged
+	solve(template, true)
+	if err := chain.SubmitBlock(block); err == nil || err == blockchain.ErrInvalidProof {
+		t.Fatal("Block with an invalid signature accepted", err)
+	}
+	block.Transactions[0] = tx
+	solve(template, true)
+	if err := chain.SubmitBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, block.Hash) || !blockchain.VerifyProof(chain, block) {
+		t.Fatal("Submitted block is not the tip")
+	}
+	if err := chain.SubmitBlock(block); err != blockchain.ErrStaleTip {
+		t.Fatal("Block accepted twice", err)
+	}
+
+	template = chain.NewBlockTemplate(nil, string(w1.Address()))
+	solve(template, false)
+	if err := chain.SubmitBlock(template.Block); err != blockchain.ErrInvalidProof {
+		t.Fatal("Block missing the target accepted", err)
+	}
+
+	// Native change below the dust threshold is left as fee
+	UTXOSet.Update(block)
+	fee := blockchain.DustThreshold - 1
+	spend := blockchain.NewTransaction(w0, string(w1.Address()), blockchain.CoinbaseReward-20-fee, &UTXOSet)
+	if len(spend.Outputs) != 1 || spend.HasDust() {
+		t.Fatal("Dust change not left as fee")
+	}
+
+	// Of two transactions spending the same output only the first is taken
+	double := blockchain.NewTransaction(w0, string(w1.Address()), 30, &UTXOSet)
+	template = chain.NewBlockTemplate([]*blockchain.Transaction{spend, double}, string(w1.Address()))
+	if len(template.Block.Transactions) != 2 || template.Block.Transactions[0] != spend {
+		t.Fatal("Conflicting transactions in one template")
+	}
+
+	// A block has one coinbase, which claims at most the reward and fees
+	coinbase := template.Block.Coinbase()
+	claim := func(value blockchain.Amount) {
+		coinbase.Outputs[0].Value = value
+		coinbase.ID = coinbase.Hash()
+		solve(template, true)
+	}
+	claim(blockchain.CoinbaseReward + fee + 1)
+	if err := chain.SubmitBlock(template.Block); err == nil || err == blockchain.ErrInvalidProof {
+		t.Fatal("Coinbase above the reward and fees accepted", err)
+	}
+	template.Block.Transactions = append([]*blockchain.Transaction{blockchain.CoinbaseTransaction(string(w1.Address()), "")}, template.Block.Transactions...)
+	claim(blockchain.CoinbaseReward)
+	if err := chain.SubmitBlock(template.Block); err == nil || err == blockchain.ErrInvalidProof {
+		t.Fatal("Block with two coinbases accepted", err)
+	}
+	template.Block.Transactions = template.Block.Transactions[1:]
+	claim(blockchain.CoinbaseReward + fee)
+	if err := chain.SubmitBlock(template.Block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderCommitment(t *testing.T) {
+	coinbase := blockchain.CoinbaseTransaction(string(wallet.NewWallet().Address()), "")
+	block := &blockchain.Block{Timestamp: time.Now().Unix(), Transactions: []*blockchain.Transaction{coinbase}, PrevHash: []byte("previous"), Height: 1}
+	header := block.Header()
+	if len(header) != blockchain.HeaderLength {
+		t.Fatal("Wrong header length")
+	}
+
+	// Every header field and the extranonce change the proof of work input
+	changed := []*blockchain.Block{block.WithExtranonce(1)}
+	for _, change := range []func(*blockchain.Block){
+		func(b *blockchain.Block) { b.Timestamp++ },
+		func(b *blockchain.Block) { b.Height++ },
+		func(b *blockchain.Block) { b.Nonce++ },
+		func(b *blockchain.Block) { b.PrevHash = []byte("other") },
+	} {
+		other := *block
+		change(&other)
+		changed = append(changed, &other)
+	}
+	for i, other := range changed {
+		if bytes.Equal(other.Header(), header) {
+			t.Fatalf("Change %d is not committed to", i)
+		}
+	}
+	extended := block.WithExtranonce(1)
+	if block.Coinbase().Extranonce != 0 || !bytes.Equal(block.Transactions[0].ID, coinbase.ID) {
+		t.Fatal("Extranonce changed the original block")
+	}
+	if bytes.Equal(extended.HashTransactions(), block.HashTransactions()) || !extended.Coinbase().IsCoinbaseTransaction() {
+		t.Fatal("Extranonce does not change the merkle root")
+	}
+
+	os.RemoveAll("./tmp/blocks_header")
+	os.MkdirAll("./tmp/wallets", 0700)
+	chain := blockchain.NewChain(string(wallet.NewWallet().Address()), "header")
+	defer chain.Database.Close()
+	template := chain.NewBlockTemplate(nil, string(wallet.NewWallet().Address()))
+	template.Block.Nonce = blockchain.MaxNonce + 1
+	if err := chain.SubmitBlock(template.Block); err == nil {
+		t.Fatal("Nonce outside the nonce space accepted")
+	}
+	template.Block.Nonce = 0
+	template.Block.Timestamp = time.Now().Unix() + blockchain.MaxFutureBlockTime + 60
+	if err := chain.SubmitBlock(template.Block); err == nil {
+		t.Fatal("Block from the future accepted")
+	}
+	template.Block.Timestamp = chain.MedianTimePast(chain.LastHash)
+	if err := chain.SubmitBlock(template.Block); err != blockchain.ErrTimeTooOld {
+		t.Fatal("Block at the median time past accepted", err)
+	}
+
+	// Extranonces are only allowed in the coinbase
+	tx := *coinbase
+	tx.Inputs = []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0, Sequence: blockchain.SequenceFinal}}
+	tx.Extranonce = 1
+	tx.ID = tx.Hash()
+	if err := chain.ValidateTransaction(&tx, 1, time.Now().Unix()); err == nil {
+		t.Fatal("Extranonce accepted outside the coinbase")
+	}
+}
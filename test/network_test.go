@@ -0,0 +1,193 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/JI-0/private-cryptocurrency/blockchain"
+	"github.com/JI-0/private-cryptocurrency/network"
+	"github.com/JI-0/private-cryptocurrency/randomx"
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+func TestStratum(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_stratum")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "stratum")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+
+	pool := network.NewStratumServer(chain, string(w0.Address()), 1)
+	go pool.Listen("localhost:3999")
+	defer pool.Close()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", "localhost:3999"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	call := func(method string, params interface{}) (json.RawMessage, string) {
+		encoded, _ := json.Marshal(params)
+		json.NewEncoder(conn).Encode(map[string]interface{}{"id": 1, "method": method, "params": json.RawMessage(encoded)})
+		for lines.Scan() {
+			var response struct {
+				Method string
+				Result json.RawMessage
+				Error  *struct{ Message string }
+			}
+			json.Unmarshal(lines.Bytes(), &response)
+			if response.Method != "" {
+				// Job notifications are not responses
+				continue
+			}
+			if response.Error != nil {
+				return nil, response.Error.Message
+			}
+			return response.Result, ""
+		}
+		t.Fatal("Connection closed")
+		return nil, ""
+	}
+
+	var login struct {
+		Job network.StratumJob
+	}
+	result, errMessage := call("login", map[string]string{"login": "rig-1"})
+	if errMessage != "" {
+		t.Fatal(errMessage)
+	}
+	json.Unmarshal(result, &login)
+	job := login.Job
+	if job.Height != 1 || len(job.Extranonce) != 16 || job.NonceOffset != blockchain.HeaderNonceOffset {
+		t.Fatal("Wrong job", job)
+	}
+
+	// Search the header of the connection for a share that is or is not a block
+	blob, _ := hex.DecodeString(job.Blob)
+	shareTarget, _ := new(big.Int).SetString(job.Target, 16)
+	blockTarget := chain.NewBlockTemplate(nil, string(w0.Address())).Target
+	pow := blockchain.NewProof(chain, &blockchain.Block{Height: job.Height}, false)
+	defer pow.Destroy()
+	search := func(block bool) []byte {
+		nonce := make([]byte, 4)
+		out := make([]byte, randomx.RxHashSize)
+		for i := uint32(0); ; i++ {
+			binary.BigEndian.PutUint32(nonce, i)
+			copy(blob[job.NonceOffset:], nonce)
+			pow.VM.Hash(blob, out)
+			hash := new(big.Int).SetBytes(out)
+			if hash.Cmp(shareTarget) == -1 && (hash.Cmp(blockTarget) == -1) == block {
+				return nonce
+			}
+		}
+	}
+
+	nonce := search(false)
+	share := map[string]string{"job_id": job.ID, "nonce": hex.EncodeToString(nonce)}
+	if _, errMessage := call("submit", share); errMessage != "" {
+		t.Fatal(errMessage)
+	}
+	if _, errMessage := call("submit", share); errMessage != "duplicate share" {
+		t.Fatal("Duplicate share accepted", errMessage)
+	}
+	share["nonce"] = hex.EncodeToString(append(nonce, 0))
+	if _, errMessage := call("submit", share); errMessage != "nonce must be 4 hex encoded bytes" {
+		t.Fatal("Malformed nonce accepted", errMessage)
+	}
+
+	workers := pool.Workers()
+	if len(workers) != 1 || workers[0].Name != "rig-1" || workers[0].Accepted != 1 || workers[0].Rejected != 2 {
+		t.Fatal("Wrong share accounting", workers)
+	}
+
+	// Shares meeting the block target extend the chain while peers keep
+	// adding transactions to the memory pool
+	tx := blockchain.NewTransaction(w0, string(wallet.NewWallet().Address()), blockchain.Coin, &UTXOSet)
+	request := append(network.CmdToBytes("tx"), network.GobEncode(network.Transaction{Transaction: tx.Serialize()})...)
+	relaying := make(chan struct{})
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		for {
+			select {
+			case <-relaying:
+				return
+			default:
+				network.HandleTransaction(request, chain)
+			}
+		}
+	}()
+	share["nonce"] = hex.EncodeToString(search(true))
+	_, errMessage = call("submit", share)
+	close(relaying)
+	<-relayed
+	if errMessage != "" {
+		t.Fatal(errMessage)
+	}
+	if chain.GetTopHeight() != 1 || pool.Workers()[0].Blocks != 1 {
+		t.Fatal("Pool block not submitted")
+	}
+}
+
+func TestHandleBlock(t *testing.T) {
+	os.RemoveAll("./tmp/blocks_handleblock")
+	os.MkdirAll("./tmp/wallets", 0700)
+	w0 := wallet.NewWallet()
+	chain := blockchain.NewChain(string(w0.Address()), "handleblock")
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	UTXOSet.Reindex()
+	genesis := chain.LastHash
+	send := func(block *blockchain.Block) {
+		request := append(network.CmdToBytes("block"), network.GobEncode(network.Block{Block: block.Serialize()})...)
+		network.HandleBlock(request, chain)
+	}
+
+	// A block off the tip claiming a large height is stored but not the tip
+	coinbase := blockchain.CoinbaseTransaction(string(w0.Address()), "")
+	forged := &blockchain.Block{Timestamp: time.Now().Unix(), Hash: []byte("forged"), Transactions: []*blockchain.Transaction{coinbase}, PrevHash: []byte("elsewhere"), Height: 100}
+	send(forged)
+	if !bytes.Equal(chain.LastHash, genesis) || chain.GetTopHeight() != 0 {
+		t.Fatal("Unvalidated block became the tip")
+	}
+
+	// A solved block extending the tip is validated and becomes the tip
+	template := chain.NewBlockTemplate(nil, string(w0.Address()))
+	pow := blockchain.NewProof(chain, template.Block, false)
+	defer pow.Destroy()
+	for nonce := 0; ; nonce++ {
+		template.Block.Nonce = nonce
+		if pow.Validate() {
+			break
+		}
+	}
+	// The hash the block is stored and linked by must be its proof of work
+	block := template.Block
+	block.Hash = []byte("forged")
+	send(block)
+	if !bytes.Equal(chain.LastHash, genesis) {
+		t.Fatal("Block with a forged hash accepted")
+	}
+	block.Hash = pow.Hash()
+	send(block)
+	if !bytes.Equal(chain.LastHash, block.Hash) || chain.GetTopHeight() != 1 {
+		t.Fatal("Valid block not added to the tip")
+	}
+}
@@ -6,18 +6,19 @@ import (
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/JI-0/private-cryptocurrency/randomx"
 )
 
-var testPairs = [][][]byte{
-	// randomX
-	{
-		[]byte("test key 000"),
-		[]byte("This is a test"),
-		[]byte("bc2bcbb0f927bac40faaf98a468f4de5e81b9395ba6c970634abb4d7b1cb007b"),
-	},
-}
+// The chain vectors as key, input and hex encoded hash
+var testPairs = func() [][][]byte {
+	var pairs [][][]byte
+	for _, vector := range randomx.ChainVectors {
+		pairs = append(pairs, [][]byte{vector.Key, vector.Input, []byte(vector.Hash)})
+	}
+	return pairs
+}()
 
 func TestAllocCache(t *testing.T) {
 	cache, _ := randomx.AllocCache(randomx.FlagDefault)
@@ -157,3 +158,102 @@ func TestCreateRecommendedFlagVM(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRxHandles(t *testing.T) {
+	var tp = testPairs[0]
+	cache, err := randomx.NewCache(tp[0], randomx.GetFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	vm, err := randomx.NewVM(cache, nil, randomx.GetFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashes go to the caller's buffer without allocating
+	hash := make([]byte, randomx.RxHashSize)
+	vm.Hash(tp[1], hash)
+	if allocs := testing.AllocsPerRun(100, func() { vm.Hash(tp[1], hash) }); allocs != 0 {
+		t.Fatalf("Hashing allocates %v times", allocs)
+	}
+
+	// Pipelined hashes match single ones
+	next := make([]byte, randomx.RxHashSize)
+	vm.HashFirst(tp[1])
+	vm.HashNext(tp[0], next)
+	if !bytes.Equal(next, hash) {
+		t.Fatal("Pipelined hash differs")
+	}
+
+	// A closed cache stays usable by its VMs but takes no new ones
+	cache.Close()
+	vm.Hash(tp[1], next)
+	if !bytes.Equal(next, hash) {
+		t.Fatal("Cache freed under its VM")
+	}
+	if _, err := randomx.NewVM(cache, nil, randomx.GetFlags()); err == nil {
+		t.Fatal("VM created on a closed cache")
+	}
+
+	vm.Close()
+	vm.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Closed VM used")
+		}
+	}()
+	vm.Hash(tp[1], hash)
+}
+
+// Hashes by copying through C memory as before, for comparison with
+// BenchmarkRxVMHash
+func BenchmarkCalculateHashCopy(b *testing.B) {
+	cache, _ := randomx.AllocCache(randomx.GetFlags())
+	randomx.InitCache(cache, testPairs[0][0])
+	defer randomx.ReleaseCache(cache)
+	vm, _ := randomx.CreateVM(cache, nil, randomx.GetFlags())
+	defer randomx.DestroyVM(vm)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		randomx.CalculateHashCopy(vm, testPairs[0][1])
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "H/s")
+}
+
+func BenchmarkRxVMHash(b *testing.B) {
+	cache, _ := randomx.NewCache(testPairs[0][0], randomx.GetFlags())
+	defer cache.Close()
+	vm, _ := randomx.NewVM(cache, nil, randomx.GetFlags())
+	defer vm.Close()
+	hash := make([]byte, randomx.RxHashSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.Hash(testPairs[0][1], hash)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "H/s")
+}
+
+func TestReferenceVectors(t *testing.T) {
+	upstream, err := randomx.CheckConfiguration(randomx.GetFlags())
+	if upstream {
+		t.Fatal("built with the upstream configuration")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	result, err := randomx.Benchmark(randomx.GetFlags(), 2, 50*time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LightHashrate <= 0 || result.FullHashrate != 0 || result.DatasetInit != 0 {
+		t.Fatal("Wrong light benchmark", result)
+	}
+}
@@ -0,0 +1,610 @@
+package test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JI-0/private-cryptocurrency/blockchain"
+	"github.com/JI-0/private-cryptocurrency/wallet"
+)
+
+func TestScriptEvaluation(t *testing.T) {
+	cases := []struct {
+		name      string
+		unlocking blockchain.Script
+		locking   blockchain.Script
+		valid     bool
+	}{
+		{"true", nil, blockchain.Script{}.AddInt(1), true},
+		{"false", nil, blockchain.Script{}.AddInt(0), false},
+		{"equal", blockchain.Script{}.AddData([]byte("abc")),
+			blockchain.Script{}.AddData([]byte("abc")).AddOp(blockchain.OpEqual), true},
+		{"not equal", blockchain.Script{}.AddData([]byte("abc")),
+			blockchain.Script{}.AddData([]byte("abd")).AddOp(blockchain.OpEqual), false},
+		{"if branch", blockchain.Script{}.AddInt(1),
+			blockchain.Script{}.AddOp(blockchain.OpIf).AddInt(2).AddOp(blockchain.OpElse).AddInt(0).AddOp(blockchain.OpEndIf), true},
+		{"else branch", blockchain.Script{}.AddInt(0),
+			blockchain.Script{}.AddOp(blockchain.OpIf).AddInt(2).AddOp(blockchain.OpElse).AddInt(0).AddOp(blockchain.OpEndIf), false},
+		{"unbalanced", blockchain.Script{}.AddInt(1),
+			blockchain.Script{}.AddOp(blockchain.OpIf).AddInt(1), false},
+		{"return", nil, blockchain.Script{}.AddOp(blockchain.OpReturn), false},
+		{"not push only", blockchain.Script{}.AddInt(1).AddOp(blockchain.OpDup),
+			blockchain.Script{}.AddOp(blockchain.OpEqual), false},
+		{"underflow", nil, blockchain.Script{}.AddOp(blockchain.OpDup), false},
+	}
+	for _, c := range cases {
+		err := blockchain.VerifyScripts(c.unlocking, c.locking, nil)
+		if (err == nil) != c.valid {
+			t.Fatalf("%s: expected valid=%t, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestPayToPublicKeyHash(t *testing.T) {
+	w := wallet.NewWallet()
+	previous := blockchain.Transaction{ID: []byte("previous")}
+	previous.Outputs = []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w.Address()))}
+	previousTxs := map[string]blockchain.Transaction{"70726576696f7573": previous}
+
+	tx := blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: previous.ID, Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w.Address()))},
+	}
+	tx.Sign(w.PrivateKey, w.PublicKey, previousTxs)
+	if !tx.Verify(previousTxs) {
+		t.Fatal("Signed transaction does not verify")
+	}
+
+	tx.Outputs[0].Value = 11
+	if tx.Verify(previousTxs) {
+		t.Fatal("Modified transaction verifies")
+	}
+
+	other := wallet.NewWallet()
+	tx.Sign(other.PrivateKey, other.PublicKey, previousTxs)
+	if tx.Verify(previousTxs) {
+		t.Fatal("Transaction signed with a foreign key verifies")
+	}
+}
+
+func TestMultisigPartialSigning(t *testing.T) {
+	w0 := wallet.NewWallet()
+	w1 := wallet.NewWallet()
+	w2 := wallet.NewWallet()
+	redeemScript := blockchain.MultisigScript(2, [][]byte{w0.PublicKey, w1.PublicKey, w2.PublicKey})
+	multisig := wallet.MultisigWallet{Required: 2, PublicKeys: [][]byte{w0.PublicKey, w1.PublicKey, w2.PublicKey}, RedeemScript: redeemScript}
+	address := multisig.Address()
+	if !wallet.ValidateAddress(string(address)) {
+		t.Fatal("Multisig address invalid")
+	}
+	if address[0] == w0.Address()[0] {
+		t.Fatal("Multisig address shares the single key prefix")
+	}
+
+	previousOut := *blockchain.NewTxOutput(10, string(address))
+	tx := blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w0.Address()))},
+	}
+	tx.ID = tx.Hash()
+	ptx := blockchain.PartialTransaction{
+		Transaction:     tx,
+		PreviousOutputs: []blockchain.TransactionOutput{previousOut},
+		RedeemScript:    redeemScript,
+		Signatures:      make([]map[string][]byte, 1),
+	}
+
+	// Cosigners sign separate copies
+	copy0, _ := blockchain.DeserializePartialTransaction(ptx.Serialize())
+	copy2, _ := blockchain.DeserializePartialTransaction(ptx.Serialize())
+	if err := copy0.Sign(w0.PrivateKey, w0.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copy0.Finalize(); err == nil {
+		t.Fatal("Finalized with a single signature")
+	}
+	if err := copy2.Sign(w2.PrivateKey, w2.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := copy2.Sign(wallet.NewWallet().PrivateKey, wallet.NewWallet().PublicKey); err == nil {
+		t.Fatal("Signed with a key outside the multisig")
+	}
+
+	if err := copy0.Combine(copy2); err != nil {
+		t.Fatal(err)
+	}
+	final, err := copy0.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := final.VerifyInput(0, previousOut); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeLockedOutputs(t *testing.T) {
+	w := wallet.NewWallet()
+	previousOut := *blockchain.NewTimeLockedTxOutput(10, string(w.Address()), 100)
+	if lockTime, ok := previousOut.LockingScript.LockTime(); !ok || lockTime != 100 {
+		t.Fatal("Lock time not found in locking script")
+	}
+	if !previousOut.IsLockedWithKey(wallet.PublicKeyHash(w.PublicKey)) {
+		t.Fatal("Time locked output not recognized as owned")
+	}
+	previousTxs := map[string]blockchain.Transaction{
+		"70726576696f7573": {ID: []byte("previous"), Outputs: []blockchain.TransactionOutput{previousOut}},
+	}
+
+	spend := func(lockTime uint32, sequence uint32) blockchain.Transaction {
+		tx := blockchain.Transaction{
+			Inputs:   []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0, Sequence: sequence}},
+			Outputs:  []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w.Address()))},
+			LockTime: lockTime,
+		}
+		tx.Sign(w.PrivateKey, w.PublicKey, previousTxs)
+		return tx
+	}
+
+	tx := spend(100, blockchain.SequenceFinal-1)
+	if !tx.Verify(previousTxs) {
+		t.Fatal("Spend at lock time does not verify")
+	}
+	if tx.IsFinal(100, 0) || !tx.IsFinal(101, 0) {
+		t.Fatal("Transaction finality ignores the lock time")
+	}
+	if tx := spend(99, blockchain.SequenceFinal-1); tx.Verify(previousTxs) {
+		t.Fatal("Spend before lock time verifies")
+	}
+	if tx := spend(100, blockchain.SequenceFinal); tx.Verify(previousTxs) {
+		t.Fatal("Spend with final sequence verifies")
+	}
+	if tx := spend(blockchain.LockTimeThreshold+100, blockchain.SequenceFinal-1); tx.Verify(previousTxs) {
+		t.Fatal("Spend with timestamp lock time verifies against height lock")
+	}
+
+	relativeOut := *blockchain.NewRelativeLockedTxOutput(10, string(w.Address()), 5)
+	previousTxs["70726576696f7573"].Outputs[0] = relativeOut
+	if tx := spend(0, 5); !tx.Verify(previousTxs) {
+		t.Fatal("Spend with matching sequence does not verify")
+	}
+	if tx := spend(0, 4); tx.Verify(previousTxs) {
+		t.Fatal("Spend with short sequence verifies")
+	}
+	previousBlock := &blockchain.Block{Height: 10}
+	input := blockchain.TransactionInput{Sequence: 5}
+	if blockchain.RelativeLockSatisfied(input, previousBlock, 14, 0) || !blockchain.RelativeLockSatisfied(input, previousBlock, 15, 0) {
+		t.Fatal("Relative lock ignores block height")
+	}
+}
+
+func TestHashTimeLockedContract(t *testing.T) {
+	sender := wallet.NewWallet()
+	recipient := wallet.NewWallet()
+	secret := bytes.Repeat([]byte{7}, blockchain.HTLCSecretSize)
+	contract := blockchain.NewHTLC(blockchain.HTLCSecretHash(secret), string(recipient.Address()), string(sender.Address()), 50)
+	if parsed, ok := contract.Script().ParseHTLC(); !ok || parsed.LockTime != 50 {
+		t.Fatal("Contract script not recognized")
+	}
+	contractTx := blockchain.Transaction{
+		ID:      []byte("contract"),
+		Outputs: []blockchain.TransactionOutput{{Value: 10, LockingScript: contract.Script()}},
+	}
+	previousTxs := map[string]blockchain.Transaction{"636f6e7472616374": contractTx}
+
+	if _, err := blockchain.NewHTLCRedeemTransaction(recipient, &contractTx, []byte("wrong")); err == nil {
+		t.Fatal("Redeemed with a wrong secret")
+	}
+	redeem, err := blockchain.NewHTLCRedeemTransaction(recipient, &contractTx, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redeem.Verify(previousTxs) {
+		t.Fatal("Redeem transaction does not verify")
+	}
+	extracted, err := blockchain.ExtractHTLCSecret(redeem, contractTx.ID)
+	if err != nil || !bytes.Equal(extracted, secret) {
+		t.Fatal("Secret not extracted from redeem transaction")
+	}
+
+	refund, err := blockchain.NewHTLCRefundTransaction(sender, &contractTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refund.Verify(previousTxs) {
+		t.Fatal("Refund transaction does not verify")
+	}
+	if refund.IsFinal(50, 0) || !refund.IsFinal(51, 0) {
+		t.Fatal("Refund is not held back by the lock time")
+	}
+	if _, err := blockchain.NewHTLCRefundTransaction(recipient, &contractTx); err == nil {
+		t.Fatal("Recipient refunded the contract")
+	}
+}
+
+func TestDataCarrierOutputs(t *testing.T) {
+	payload := []byte("invoice 2024-0042")
+	out := blockchain.NewDataTxOutput(payload)
+	if !out.LockingScript.IsUnspendable() || out.Value != 0 {
+		t.Fatal("Data output is spendable or carries value")
+	}
+	if data, ok := out.LockingScript.NullData(); !ok || !bytes.Equal(data, payload) {
+		t.Fatal("Payload not recovered from data output")
+	}
+	if err := blockchain.VerifyScripts(blockchain.Script{}.AddInt(1), out.LockingScript, nil); err == nil {
+		t.Fatal("Data output can be spent")
+	}
+
+	// Every unspendable output is a data output, whether or not it is a push
+	os.RemoveAll("./tmp/blocks_datacarrier")
+	os.MkdirAll("./tmp/wallets", 0700)
+	chain := blockchain.NewChain(string(wallet.NewWallet().Address()), "datacarrier")
+	defer chain.Database.Close()
+	raw := blockchain.Script{}.AddOp(blockchain.OpReturn).AddOp(blockchain.OpDup)
+	for _, outputs := range [][]blockchain.TransactionOutput{
+		{*out, {Value: 0, LockingScript: raw}},
+		{{Value: 1, LockingScript: raw}},
+		{{Value: 0, LockingScript: append(raw, make([]byte, blockchain.MaxDataCarrierSize)...)}},
+	} {
+		tx := blockchain.Transaction{
+			Inputs:  []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0, Sequence: blockchain.SequenceFinal}},
+			Outputs: outputs,
+		}
+		tx.ID = tx.Hash()
+		if err := chain.ValidateTransaction(&tx, 1, time.Now().Unix()); err == nil || !strings.Contains(err.Error(), "data output") {
+			t.Fatal("Unspendable output escaped the data carrier rules", err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Oversized payload accepted")
+		}
+	}()
+	blockchain.NewDataTxOutput(make([]byte, blockchain.MaxDataCarrierSize+1))
+}
+
+func TestAssetIssuanceAndConservation(t *testing.T) {
+	issuer := wallet.NewWallet()
+	issuance := &blockchain.AssetIssuance{Name: "points", Issuer: issuer.PublicKey}
+	asset := issuance.AssetID()
+	previousTxs := map[string]blockchain.Transaction{
+		"70726576696f7573": {ID: []byte("previous"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(issuer.Address()))}},
+	}
+	issue := blockchain.Transaction{
+		Inputs: []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0, Sequence: blockchain.SequenceFinal}},
+		Outputs: []blockchain.TransactionOutput{
+			*blockchain.NewAssetTxOutput(1000, string(issuer.Address()), asset),
+			*blockchain.NewTxOutput(10, string(issuer.Address())),
+		},
+		Issuance: issuance,
+	}
+	issue.Issuance.Signature = blockchain.SignHash(issuer.PrivateKey, issue.IssuanceHash())
+	issue.Sign(issuer.PrivateKey, issuer.PublicKey, previousTxs)
+	if err := issue.CheckAssets(previousTxs); err != nil {
+		t.Fatal(err)
+	}
+	if !issue.Verify(previousTxs) {
+		t.Fatal("Issuance does not verify")
+	}
+	forged := issue
+	forged.Issuance = &blockchain.AssetIssuance{Name: "points", Issuer: wallet.NewWallet().PublicKey, Signature: issuance.Signature}
+	if forged.Verify(previousTxs) {
+		t.Fatal("Issuance verifies for another issuer")
+	}
+
+	issue.ID = []byte("issue")
+	previousTxs["6973737565"] = issue
+	spend := func(outputs ...blockchain.TransactionOutput) blockchain.Transaction {
+		return blockchain.Transaction{
+			Inputs:  []blockchain.TransactionInput{{ID: []byte("issue"), Output: 0}, {ID: []byte("issue"), Output: 1}},
+			Outputs: outputs,
+		}
+	}
+	tx := spend(*blockchain.NewAssetTxOutput(1000, string(issuer.Address()), asset), *blockchain.NewTxOutput(9, string(issuer.Address())))
+	if err := tx.CheckAssets(previousTxs); err != nil {
+		t.Fatal(err)
+	}
+	if tx := spend(*blockchain.NewAssetTxOutput(1001, string(issuer.Address()), asset)); tx.CheckAssets(previousTxs) == nil {
+		t.Fatal("Asset created without issuance")
+	}
+	if tx := spend(*blockchain.NewAssetTxOutput(999, string(issuer.Address()), asset)); tx.CheckAssets(previousTxs) == nil {
+		t.Fatal("Asset burned")
+	}
+	if tx := spend(*blockchain.NewTxOutput(11, string(issuer.Address())), *blockchain.NewAssetTxOutput(1000, string(issuer.Address()), asset)); tx.CheckAssets(previousTxs) == nil {
+		t.Fatal("Native coins created")
+	}
+
+	// The issuer adds to the supply while spending earlier units
+	reissue := spend(*blockchain.NewAssetTxOutput(1500, string(issuer.Address()), asset), *blockchain.NewTxOutput(9, string(issuer.Address())))
+	reissue.Issuance = &blockchain.AssetIssuance{Name: "points", Issuer: issuer.PublicKey}
+	if err := reissue.CheckAssets(previousTxs); err != nil {
+		t.Fatal(err)
+	}
+	reissue.Outputs[0].Value = 999
+	if reissue.CheckAssets(previousTxs) == nil {
+		t.Fatal("Asset burned by a reissue")
+	}
+
+	os.RemoveAll("./tmp/blocks_assets")
+	os.MkdirAll("./tmp/wallets", 0700)
+	chain := blockchain.NewChain(string(issuer.Address()), "assets")
+	defer chain.Database.Close()
+	coinbase := blockchain.CoinbaseTransaction(string(issuer.Address()), "assets")
+	coinbase.Outputs[0].Asset = asset
+	coinbase.ID = coinbase.Hash()
+	if err := chain.ValidateTransaction(coinbase, 1, time.Now().Unix()); err == nil {
+		t.Fatal("Coinbase minted an asset")
+	}
+}
+
+func TestSignatureHashTypes(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	previousTxs := map[string]blockchain.Transaction{
+		"616c696365": {ID: []byte("alice"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(alice.Address()))}},
+		"626f62":     {ID: []byte("bob"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(bob.Address()))}},
+	}
+	sign := func(tx *blockchain.Transaction, inId int, w *wallet.Wallet, hashType blockchain.SigHashType) {
+		previousTx := previousTxs[hex.EncodeToString(tx.Inputs[inId].ID)]
+		signature, err := tx.SignInput(inId, w.PrivateKey, previousTx.Outputs[0].LockingScript, hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Inputs[inId].UnlockingScript = blockchain.PayToPublicKeyHashUnlockingScript(signature, w.PublicKey)
+	}
+
+	// Crowdfunding, each backer only commits to their own input and the goal
+	goal := *blockchain.NewTxOutput(20, string(alice.Address()))
+	tx := blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("alice"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{goal},
+	}
+	sign(&tx, 0, alice, blockchain.SigHashAll|blockchain.SigHashAnyoneCanPay)
+	tx.Inputs = append(tx.Inputs, blockchain.TransactionInput{ID: []byte("bob"), Output: 0})
+	sign(&tx, 1, bob, blockchain.SigHashAll|blockchain.SigHashAnyoneCanPay)
+	if !tx.Verify(previousTxs) {
+		t.Fatal("Co-funded transaction does not verify")
+	}
+	tx.Outputs[0].Value = 19
+	if tx.Verify(previousTxs) {
+		t.Fatal("Outputs changed after signing with all")
+	}
+
+	// Single only fixes the output of the same index
+	tx = blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("alice"), Output: 0}, {ID: []byte("bob"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(alice.Address())), *blockchain.NewTxOutput(10, string(bob.Address()))},
+	}
+	sign(&tx, 0, alice, blockchain.SigHashSingle)
+	sign(&tx, 1, bob, blockchain.SigHashAll)
+	tx.Outputs[1].Value = 9
+	if err := tx.VerifyInput(0, previousTxs["616c696365"].Outputs[0]); err != nil {
+		t.Fatal("Single signature covers other outputs")
+	}
+	tx.Outputs[0].Value = 9
+	if err := tx.VerifyInput(0, previousTxs["616c696365"].Outputs[0]); err == nil {
+		t.Fatal("Single signature does not cover its output")
+	}
+
+	// None leaves all outputs open
+	sign(&tx, 0, alice, blockchain.SigHashNone)
+	tx.Outputs = tx.Outputs[:1]
+	if err := tx.VerifyInput(0, previousTxs["616c696365"].Outputs[0]); err != nil {
+		t.Fatal("None signature covers outputs")
+	}
+	if _, err := tx.SignInput(1, bob.PrivateKey, previousTxs["626f62"].Outputs[0].LockingScript, blockchain.SigHashSingle); err == nil {
+		t.Fatal("Single signed without matching output")
+	}
+	if _, err := tx.SignInput(0, alice.PrivateKey, previousTxs["616c696365"].Outputs[0].LockingScript, 0x04); err == nil {
+		t.Fatal("Signed with unknown hash type")
+	}
+}
+
+func TestTransactionIDExcludesSignatures(t *testing.T) {
+	w := wallet.NewWallet()
+	previousTxs := map[string]blockchain.Transaction{
+		"70726576696f7573": {ID: []byte("previous"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w.Address()))}},
+	}
+	tx := blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(w.Address()))},
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(w.PrivateKey, w.PublicKey, previousTxs)
+	resigned := tx
+	resigned.Inputs = append([]blockchain.TransactionInput{}, tx.Inputs...)
+	resigned.Sign(w.PrivateKey, w.PublicKey, previousTxs)
+	if !resigned.Verify(previousTxs) {
+		t.Fatal("Re-signed transaction does not verify")
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) || !bytes.Equal(tx.Hash(), resigned.Hash()) {
+		t.Fatal("Transaction ID depends on signatures")
+	}
+	if bytes.Equal(tx.WitnessHash(), resigned.WitnessHash()) {
+		t.Fatal("Witness hash does not cover signatures")
+	}
+
+	block := blockchain.Block{Transactions: []*blockchain.Transaction{&tx}}
+	resignedBlock := blockchain.Block{Transactions: []*blockchain.Transaction{&resigned}}
+	if !bytes.Equal(block.HashTransactions(), resignedBlock.HashTransactions()) {
+		t.Fatal("Transaction root depends on signatures")
+	}
+	if bytes.Equal(block.HashWitnesses(), resignedBlock.HashWitnesses()) {
+		t.Fatal("Witness root does not commit to signatures")
+	}
+}
+
+func TestSchnorrAggregation(t *testing.T) {
+	// Cached signatures are not added to a batch
+	blockchain.SetSignatureCacheSize(0)
+	defer blockchain.SetSignatureCacheSize(blockchain.DefaultSignatureCacheSize)
+
+	// MuSig, two cosigners spend an output locked to their aggregate key
+	alice := wallet.NewWalletWithType(wallet.KeyTypeSchnorr)
+	bob := wallet.NewWalletWithType(wallet.KeyTypeSchnorr)
+	keys := [][]byte{alice.PublicKey, bob.PublicKey}
+	aggregateKey, err := wallet.AggregatePublicKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed, _ := wallet.AggregatePublicKeys([][]byte{bob.PublicKey, alice.PublicKey})
+	if !bytes.Equal(aggregateKey, reversed) {
+		t.Fatal("Aggregate key depends on key order")
+	}
+	address := wallet.EncodeAddress(wallet.SchnorrKeyHashVersion, wallet.PublicKeyHash(aggregateKey))
+	previousOut := *blockchain.NewTxOutput(10, string(address))
+	tx := blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("previous"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(alice.Address()))},
+	}
+	hash, err := tx.SignatureHash(0, previousOut.LockingScript, blockchain.SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceNonce, bobNonce := wallet.NewMuSigNonce(), wallet.NewMuSigNonce()
+	nonces := [][]byte{aliceNonce.Public, bobNonce.Public}
+	aliceShare, err := wallet.MuSigPartialSign(alice.PrivateKey, aliceNonce, keys, nonces, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobShare, err := wallet.MuSigPartialSign(bob.PrivateKey, bobNonce, keys, nonces, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := wallet.MuSigCombine(nonces, [][]byte{aliceShare, bobShare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature = append(signature, byte(blockchain.SigHashAll))
+	tx.Inputs[0].UnlockingScript = blockchain.PayToPublicKeyHashUnlockingScript(signature, aggregateKey)
+	if err := tx.VerifyInput(0, previousOut); err != nil {
+		t.Fatal(err)
+	}
+	incomplete, _ := wallet.MuSigCombine(nonces, [][]byte{aliceShare})
+	tx.Inputs[0].UnlockingScript = blockchain.PayToPublicKeyHashUnlockingScript(append(incomplete, byte(blockchain.SigHashAll)), aggregateKey)
+	if err := tx.VerifyInput(0, previousOut); err == nil {
+		t.Fatal("Spent with a single cosigner")
+	}
+
+	// The cosigners sign in rounds through a session passed between them
+	musig, err := wallet.NewMuSigWallet(keys)
+	if err != nil || !bytes.Equal(musig.Address(), address) {
+		t.Fatal("MuSig wallet has another address", err)
+	}
+	session := &blockchain.MuSigSession{
+		Transaction:       tx,
+		PreviousOutputs:   []blockchain.TransactionOutput{previousOut},
+		PublicKeys:        keys,
+		Commitments:       make([]map[string][]byte, 1),
+		Nonces:            make([]map[string][]byte, 1),
+		PartialSignatures: make([]map[string][]byte, 1),
+	}
+	roundTrip := func() {
+		if session, err = blockchain.DeserializeMuSigSession(session.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceNonces, err := session.Commit(alice.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip()
+	if err := session.Reveal(alice.PublicKey, aliceNonces); err == nil {
+		t.Fatal("Nonce revealed before every commitment")
+	}
+	bobNonces, _ := session.Commit(bob.PublicKey)
+	roundTrip()
+	// Nonces are kept by each cosigner between the rounds
+	stored, err := wallet.DeserializeMuSigNonce(aliceNonces[0].Serialize())
+	if err != nil || !bytes.Equal(stored.Public, aliceNonces[0].Public) {
+		t.Fatal("Nonce not restored", err)
+	}
+	if err := session.Reveal(alice.PublicKey, bobNonces); err == nil {
+		t.Fatal("Nonce revealed against another commitment")
+	}
+	if err := session.Reveal(alice.PublicKey, []wallet.MuSigNonce{stored}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Reveal(bob.PublicKey, bobNonces); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip()
+	if err := session.Sign(alice.PrivateKey, []wallet.MuSigNonce{stored}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Finalize(); err == nil {
+		t.Fatal("Session finalized with a single cosigner")
+	}
+	if err := session.Sign(bob.PrivateKey, bobNonces); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip()
+	cosigned, err := session.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One aggregate signature for all inputs of the keys of a wallet
+	carol := wallet.NewWalletWithType(wallet.KeyTypeSchnorr)
+	previousTxs := map[string]blockchain.Transaction{
+		"6f6e65":     {ID: []byte("one"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(alice.Address()))}},
+		"74776f":     {ID: []byte("two"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(alice.Address()))}},
+		"7468726565": {ID: []byte("three"), Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(10, string(carol.Address()))}},
+	}
+	tx = blockchain.Transaction{
+		Inputs:  []blockchain.TransactionInput{{ID: []byte("one"), Output: 0}, {ID: []byte("two"), Output: 0}, {ID: []byte("three"), Output: 0}},
+		Outputs: []blockchain.TransactionOutput{*blockchain.NewTxOutput(30, string(bob.Address()))},
+	}
+	tx.SignAggregated([]wallet.PrivateKey{alice.PrivateKey, carol.PrivateKey}, previousTxs)
+	if !tx.Verify(previousTxs) {
+		t.Fatal("Aggregated transaction does not verify")
+	}
+	aggregated, _ := wallet.AggregatePublicKeys([][]byte{alice.PublicKey, carol.PublicKey})
+	if !wallet.VerifySignature(aggregated, tx.AggregateSignature, tx.AggregateSignatureHash()) {
+		t.Fatal("Aggregate signature is not for the aggregate key")
+	}
+	if wallet.VerifySignature(alice.PublicKey, tx.AggregateSignature, tx.AggregateSignatureHash()) {
+		t.Fatal("Aggregate signature verifies for a single key")
+	}
+	// The aggregate signature is batched once for the three inputs
+	batch := wallet.NewSchnorrBatch()
+	cosignedPrevious := map[string]blockchain.Transaction{"70726576696f7573": {ID: []byte("previous"), Outputs: []blockchain.TransactionOutput{previousOut}}}
+	if !tx.VerifyWithBatch(previousTxs, batch) || !cosigned.VerifyWithBatch(cosignedPrevious, batch) || batch.Len() != 2 || !batch.Verify() {
+		t.Fatal("Aggregated transaction does not verify in a batch")
+	}
+	tx.Outputs[0].Value = 19
+	if tx.Verify(previousTxs) {
+		t.Fatal("Aggregate signature does not cover outputs")
+	}
+	batch = wallet.NewSchnorrBatch()
+	if !tx.VerifyWithBatch(previousTxs, batch) || batch.Verify() {
+		t.Fatal("Batch accepted an invalid signature")
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	cache := blockchain.NewSignatureCache(2)
+	cache.Add([]byte("hash1"), []byte("key"), []byte("sig"))
+	if !cache.Contains([]byte("hash1"), []byte("key"), []byte("sig")) {
+		t.Fatal("Cached signature not found")
+	}
+	if cache.Contains([]byte("hash1"), []byte("key"), []byte("other")) {
+		t.Fatal("Uncached signature found")
+	}
+	cache.Add([]byte("hash2"), []byte("key"), []byte("sig"))
+	cache.Add([]byte("hash3"), []byte("key"), []byte("sig"))
+	if cache.Len() != 2 {
+		t.Fatal("Signature cache grew past its size")
+	}
+
+	// Fields are length-prefixed, moving bytes between them is another entry
+	cache = blockchain.NewSignatureCache(2)
+	cache.Add([]byte("hash"), []byte("1key"), []byte("sig"))
+	if cache.Contains([]byte("hash1"), []byte("key"), []byte("sig")) || cache.Contains([]byte("hash"), []byte("1ke"), []byte("ysig")) {
+		t.Fatal("Signature cache key is ambiguous")
+	}
+}
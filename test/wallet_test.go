@@ -1,6 +1,10 @@
 package test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"fmt"
 	"os"
@@ -78,20 +82,85 @@ func TestWalletCreationAndSavingLoading(t *testing.T) {
 		t.Fatal("Public keys do not match")
 	}
 	//Check private key match
-	privateKeyBuffer, err := x509.MarshalECPrivateKey(&wallets.Wallets[address].PrivateKey)
-	if err != nil {
-		t.Fatal(err)
-	}
-	privateKeyBuffer1, err := x509.MarshalECPrivateKey(&wallets1.Wallets[address].PrivateKey)
-	if err != nil {
-		t.Fatal(err)
-	}
+	privateKeyBuffer := wallets.Wallets[address].PrivateKey.Serialize()
+	privateKeyBuffer1 := wallets1.Wallets[address].PrivateKey.Serialize()
 	if string(privateKeyBuffer) != string(privateKeyBuffer1) {
 		t.Fatal("Private keys do not match")
 	}
 
+	// Wallets from before typed keys keep their address. Their keys were only
+	// usable with coordinates of equal length.
+	legacyKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	for len(legacyKey.X.Bytes()) != len(legacyKey.Y.Bytes()) {
+		legacyKey, _ = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	}
+	legacyPublicKey := append(legacyKey.X.Bytes(), legacyKey.Y.Bytes()...)
+	legacyAddress := string(wallet.EncodeAddress(wallet.PublicKeyHashVersion, wallet.PublicKeyHash(legacyPublicKey)))
+	legacyPrivateKey, _ := x509.MarshalECPrivateKey(legacyKey)
+	os.WriteFile("./tmp/wallets/"+legacyAddress+".priv", legacyPrivateKey, 0644)
+	os.WriteFile("./tmp/wallets/"+legacyAddress+".pub", legacyPublicKey, 0644)
+	for i := 0; i < 2; i++ {
+		legacy, err := wallet.NewWallets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := legacy.Wallets[legacyAddress]
+		if !ok {
+			t.Fatal("Legacy wallet loaded under a new address")
+		}
+		hash := make([]byte, 64)
+		if !wallet.VerifySignature(w.PublicKey, w.PrivateKey.Sign(hash), hash) {
+			t.Fatal("Legacy wallet signature does not verify")
+		}
+		// Saved again in the typed format
+		legacy.Save()
+	}
+
 	// fmt.Printf("Wallet1 public key: %s\n", string(wallets.Wallets[address].PublicKey))
 	// fmt.Printf("Wallet2 public key: %s\n", string(wallets1.Wallets[address].PublicKey))
 	// fmt.Printf("Wallet1 private key: %s\n", string(privateKeyBuffer))
 	// fmt.Printf("Wallet2 private key: %s\n", string(privateKeyBuffer1))
 }
+
+func TestWalletKeyTypes(t *testing.T) {
+	hash := make([]byte, 64)
+	versions := map[wallet.KeyType]byte{
+		wallet.KeyTypeP521:    wallet.PublicKeyHashVersion,
+		wallet.KeyTypeEd25519: wallet.Ed25519KeyHashVersion,
+		wallet.KeyTypeEd448:   wallet.Ed448KeyHashVersion,
+		wallet.KeyTypeSchnorr: wallet.SchnorrKeyHashVersion,
+	}
+	for keyType, version := range versions {
+		w := wallet.NewWalletWithType(keyType)
+		address := string(w.Address())
+		if !wallet.ValidateAddress(address) {
+			t.Fatalf("%s address invalid", keyType)
+		}
+		if v, _ := wallet.DecodeAddress(address); v != version {
+			t.Fatalf("%s address has version %x", keyType, v)
+		}
+		if kt, ok := wallet.PublicKeyType(w.PublicKey); !ok || kt != keyType {
+			t.Fatalf("%s public key has wrong type or length", keyType)
+		}
+		signature := w.PrivateKey.Sign(hash)
+		if !wallet.VerifySignature(w.PublicKey, signature, hash) {
+			t.Fatalf("%s signature does not verify", keyType)
+		}
+		other := wallet.NewWalletWithType(keyType)
+		if wallet.VerifySignature(other.PublicKey, signature, hash) {
+			t.Fatalf("%s signature verifies with another key", keyType)
+		}
+		loaded, err := wallet.DeserializePrivateKey(w.PrivateKey.Serialize())
+		if err != nil || !bytes.Equal(loaded.PublicKey(), w.PublicKey) {
+			t.Fatalf("%s private key not restored", keyType)
+		}
+	}
+
+	// Fixed width keys never lose leading zero bytes
+	for i := 0; i < 200; i++ {
+		w := wallet.NewWallet()
+		if len(w.PublicKey) != 133 || len(w.PrivateKey.Sign(hash)) != 132 {
+			t.Fatal("P-521 encoding is not fixed width")
+		}
+	}
+}
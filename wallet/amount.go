@@ -0,0 +1,67 @@
+package wallet
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Amounts are counted in base units, a coin has AmountDecimals of them
+	AmountDecimals = 8
+	Coin           = int64(100000000)
+)
+
+var ErrAmountFormat = errors.New("invalid amount")
+
+// FormatAmount writes base units as a decimal number of coins without
+// trailing zeros
+func FormatAmount(units int64) string {
+	sign := ""
+	abs := uint64(units)
+	if units < 0 {
+		sign = "-"
+		abs = uint64(-units)
+	}
+	whole := strconv.FormatUint(abs/uint64(Coin), 10)
+	fraction := strconv.FormatUint(abs%uint64(Coin), 10)
+	fraction = strings.Repeat("0", AmountDecimals-len(fraction)) + fraction
+	fraction = strings.TrimRight(fraction, "0")
+	if fraction == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + fraction
+}
+
+// ParseAmount reads a non-negative decimal number of coins with at most
+// AmountDecimals digits after the point and returns it in base units
+func ParseAmount(s string) (int64, error) {
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" && fraction == "" || len(fraction) > AmountDecimals {
+		return 0, ErrAmountFormat
+	}
+	for _, part := range []string{whole, fraction} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, ErrAmountFormat
+			}
+		}
+	}
+	units := int64(0)
+	if whole != "" {
+		coins, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || coins > (1<<63-1)/Coin {
+			return 0, ErrAmountFormat
+		}
+		units = coins * Coin
+	}
+	if fraction != "" {
+		fraction += strings.Repeat("0", AmountDecimals-len(fraction))
+		parsed, err := strconv.ParseInt(fraction, 10, 64)
+		if err != nil || units > 1<<63-1-parsed {
+			return 0, ErrAmountFormat
+		}
+		units += parsed
+	}
+	return units, nil
+}
@@ -0,0 +1,253 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	"github.com/cloudflare/circl/sign/ed448"
+)
+
+// KeyType is the first byte of every encoded public and private key
+type KeyType byte
+
+const (
+	KeyTypeP521    KeyType = 0x01
+	KeyTypeEd25519 KeyType = 0x02
+	KeyTypeEd448   KeyType = 0x03
+	KeyTypeSchnorr KeyType = 0x04
+
+	// Coordinates and scalars of P-521 are padded to this width
+	p521Size = 66
+)
+
+var ErrKeyType = errors.New("unknown key type")
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeP521:
+		return "p521"
+	case KeyTypeEd25519:
+		return "ed25519"
+	case KeyTypeEd448:
+		return "ed448"
+	case KeyTypeSchnorr:
+		return "schnorr"
+	}
+	return "unknown"
+}
+
+func ParseKeyType(name string) (KeyType, error) {
+	for _, t := range []KeyType{KeyTypeP521, KeyTypeEd25519, KeyTypeEd448, KeyTypeSchnorr} {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, ErrKeyType
+}
+
+// AddressVersion is the version byte of addresses paying to a key type
+func (t KeyType) AddressVersion() byte {
+	switch t {
+	case KeyTypeEd25519:
+		return Ed25519KeyHashVersion
+	case KeyTypeEd448:
+		return Ed448KeyHashVersion
+	case KeyTypeSchnorr:
+		return SchnorrKeyHashVersion
+	}
+	return PublicKeyHashVersion
+}
+
+func (t KeyType) publicKeySize() int {
+	switch t {
+	case KeyTypeP521, KeyTypeSchnorr:
+		return 2 * p521Size
+	case KeyTypeEd25519:
+		return ed25519.PublicKeySize
+	case KeyTypeEd448:
+		return ed448.PublicKeySize
+	}
+	return -1
+}
+
+func (t KeyType) privateKeySize() int {
+	switch t {
+	case KeyTypeP521, KeyTypeSchnorr:
+		return p521Size
+	case KeyTypeEd25519:
+		return ed25519.SeedSize
+	case KeyTypeEd448:
+		return ed448.SeedSize
+	}
+	return -1
+}
+
+// PrivateKey holds the P-521 scalar, also used for Schnorr, or the
+// Ed25519/Ed448 seed
+type PrivateKey struct {
+	Type KeyType
+	Key  []byte
+}
+
+func GeneratePrivateKey(keyType KeyType) PrivateKey {
+	switch keyType {
+	case KeyTypeP521, KeyTypeSchnorr:
+		private, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		key := p521PrivateKey(private)
+		key.Type = keyType
+		return key
+	case KeyTypeEd25519, KeyTypeEd448:
+		seed := make([]byte, keyType.privateKeySize())
+		if _, err := rand.Read(seed); err != nil {
+			panic(err)
+		}
+		return PrivateKey{keyType, seed}
+	}
+	panic(ErrKeyType)
+}
+
+func p521PrivateKey(private *ecdsa.PrivateKey) PrivateKey {
+	key := make([]byte, p521Size)
+	private.D.FillBytes(key)
+	return PrivateKey{KeyTypeP521, key}
+}
+
+func (k PrivateKey) ecdsa() *ecdsa.PrivateKey {
+	curve := elliptic.P521()
+	private := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(k.Key)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(k.Key)
+	return private
+}
+
+// PublicKey returns the typed encoding of the public key
+func (k PrivateKey) PublicKey() []byte {
+	public := []byte{byte(k.Type)}
+	switch k.Type {
+	case KeyTypeP521, KeyTypeSchnorr:
+		private := k.ecdsa()
+		return append(public, pointBytes(private.X, private.Y)...)
+	case KeyTypeEd25519:
+		return append(public, ed25519.NewKeyFromSeed(k.Key).Public().(ed25519.PublicKey)...)
+	case KeyTypeEd448:
+		return append(public, ed448.NewKeyFromSeed(k.Key).Public().(ed448.PublicKey)...)
+	}
+	panic(ErrKeyType)
+}
+
+func (k PrivateKey) Sign(hash []byte) []byte {
+	switch k.Type {
+	case KeyTypeP521:
+		r, s, err := ecdsa.Sign(rand.Reader, k.ecdsa(), hash)
+		if err != nil {
+			panic(err)
+		}
+		signature := make([]byte, 2*p521Size)
+		r.FillBytes(signature[:p521Size])
+		s.FillBytes(signature[p521Size:])
+		return signature
+	case KeyTypeSchnorr:
+		return schnorrSign(new(big.Int).SetBytes(k.Key), k.PublicKey()[1:], hash)
+	case KeyTypeEd25519:
+		return ed25519.Sign(ed25519.NewKeyFromSeed(k.Key), hash)
+	case KeyTypeEd448:
+		return ed448.Sign(ed448.NewKeyFromSeed(k.Key), hash, "")
+	}
+	panic(ErrKeyType)
+}
+
+func (k PrivateKey) Serialize() []byte {
+	return append([]byte{byte(k.Type)}, k.Key...)
+}
+
+func DeserializePrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) == 0 || KeyType(data[0]).privateKeySize() != len(data)-1 {
+		return PrivateKey{}, ErrKeyType
+	}
+	return PrivateKey{KeyType(data[0]), append([]byte{}, data[1:]...)}, nil
+}
+
+// PublicKeyType returns the type of an encoded public key and whether its
+// length matches the type
+func PublicKeyType(publicKey []byte) (KeyType, bool) {
+	if len(publicKey) == 0 {
+		return 0, false
+	}
+	keyType := KeyType(publicKey[0])
+	return keyType, keyType.publicKeySize() == len(publicKey)-1
+}
+
+// ValidPublicKey reports whether a public key is a typed key of the right
+// length or a legacy P-521 key
+func ValidPublicKey(publicKey []byte) bool {
+	if _, ok := PublicKeyType(publicKey); ok {
+		return true
+	}
+	_, _, legacy := legacyPoint(publicKey)
+	return legacy
+}
+
+// VerifySignature checks a signature made by PrivateKey.Sign against the
+// typed public key
+func VerifySignature(publicKey, signature, hash []byte) bool {
+	keyType, ok := PublicKeyType(publicKey)
+	if !ok {
+		x, y, legacy := legacyPoint(publicKey)
+		return legacy && verifyP521(x, y, signature, hash)
+	}
+	key := publicKey[1:]
+	switch keyType {
+	case KeyTypeP521:
+		x := new(big.Int).SetBytes(key[:p521Size])
+		y := new(big.Int).SetBytes(key[p521Size:])
+		return verifyP521(x, y, signature, hash)
+	case KeyTypeSchnorr:
+		return schnorrVerify(key, signature, hash)
+	case KeyTypeEd25519:
+		return len(signature) == ed25519.SignatureSize && ed25519.Verify(ed25519.PublicKey(key), hash, signature)
+	case KeyTypeEd448:
+		return len(signature) == ed448.SignatureSize && ed448.Verify(ed448.PublicKey(key), hash, signature, "")
+	}
+	return false
+}
+
+func verifyP521(x, y *big.Int, signature, hash []byte) bool {
+	curve := elliptic.P521()
+	if len(signature) != 2*p521Size || !curve.IsOnCurve(x, y) {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:p521Size])
+	s := new(big.Int).SetBytes(signature[p521Size:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash, r, s)
+}
+
+// legacyPoint parses the public keys of wallets from before typed keys, the
+// unpadded P-521 coordinates split in halves
+func legacyPoint(publicKey []byte) (*big.Int, *big.Int, bool) {
+	if _, typed := PublicKeyType(publicKey); typed || len(publicKey) == 0 ||
+		len(publicKey)%2 != 0 || len(publicKey) > 2*p521Size {
+		return nil, nil, false
+	}
+	half := len(publicKey) / 2
+	x := new(big.Int).SetBytes(publicKey[:half])
+	y := new(big.Int).SetBytes(publicKey[half:])
+	return x, y, elliptic.P521().IsOnCurve(x, y)
+}
+
+// IsLegacyPublicKey reports whether a public key is the legacy encoding of
+// the P-521 key of a private key
+func IsLegacyPublicKey(publicKey []byte, privateKey PrivateKey) bool {
+	x, y, ok := legacyPoint(publicKey)
+	if !ok || privateKey.Type != KeyTypeP521 {
+		return false
+	}
+	private := privateKey.ecdsa()
+	return x.Cmp(private.X) == 0 && y.Cmp(private.Y) == 0
+}
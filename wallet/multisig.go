@@ -0,0 +1,91 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// MultisigWallet describes an m-of-n address. It holds no private keys, every
+// cosigner signs with the wallet of one of the listed public keys.
+type MultisigWallet struct {
+	Required     int
+	PublicKeys   [][]byte
+	RedeemScript []byte
+}
+
+func (m MultisigWallet) Address() []byte {
+	return EncodeAddress(ScriptHashVersion, PublicKeyHash(m.RedeemScript))
+}
+
+func (m MultisigWallet) HasKey(publicKey []byte) bool {
+	for _, key := range m.PublicKeys {
+		if bytes.Equal(key, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MultisigWallet) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(m); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeMultisigWallet(data []byte) (*MultisigWallet, error) {
+	var m MultisigWallet
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// MuSigWallet is an n-of-n address locked to the MuSig aggregate of the
+// cosigner keys, on chain it looks like a single Schnorr key
+type MuSigWallet struct {
+	PublicKeys   [][]byte
+	AggregateKey []byte
+}
+
+func NewMuSigWallet(publicKeys [][]byte) (*MuSigWallet, error) {
+	aggregateKey, err := AggregatePublicKeys(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &MuSigWallet{publicKeys, aggregateKey}, nil
+}
+
+func (m MuSigWallet) Address() []byte {
+	return EncodeAddress(SchnorrKeyHashVersion, PublicKeyHash(m.AggregateKey))
+}
+
+func (m MuSigWallet) HasKey(publicKey []byte) bool {
+	for _, key := range m.PublicKeys {
+		if bytes.Equal(key, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MuSigWallet) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(m); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeMuSigWallet(data []byte) (*MuSigWallet, error) {
+	var m MuSigWallet
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
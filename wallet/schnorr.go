@@ -0,0 +1,403 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+// Schnorr signatures on P-521 are the x coordinate of the nonce point and a
+// scalar, the nonce point is always chosen with an even y coordinate.
+// They have the size of an ECDSA signature but keys and signatures can be
+// added up, which allows MuSig key aggregation and batch verification.
+
+var (
+	ErrMuSigKeys   = errors.New("musig needs schnorr public keys")
+	ErrMuSigNonces = errors.New("musig nonces are malformed")
+)
+
+var (
+	p521       = elliptic.P521()
+	p521Order  = p521.Params().N
+	p521Prime  = p521.Params().P
+	p521Sqrt   = new(big.Int).Rsh(new(big.Int).Add(p521Prime, big.NewInt(1)), 2)
+	p521Curveb = p521.Params().B
+)
+
+func hashToScalar(data ...[]byte) *big.Int {
+	hash := sha512.Sum512(bytes.Join(data, nil))
+	return new(big.Int).Mod(new(big.Int).SetBytes(hash[:]), p521Order)
+}
+
+func scalarBytes(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, p521Size))
+}
+
+func pointBytes(x, y *big.Int) []byte {
+	point := make([]byte, 2*p521Size)
+	x.FillBytes(point[:p521Size])
+	y.FillBytes(point[p521Size:])
+	return point
+}
+
+func parsePoint(point []byte) (*big.Int, *big.Int, bool) {
+	if len(point) != 2*p521Size {
+		return nil, nil, false
+	}
+	x := new(big.Int).SetBytes(point[:p521Size])
+	y := new(big.Int).SetBytes(point[p521Size:])
+	return x, y, p521.IsOnCurve(x, y)
+}
+
+// liftX returns the point with the even y coordinate for x
+func liftX(x *big.Int) (*big.Int, bool) {
+	if x.Cmp(p521Prime) >= 0 {
+		return nil, false
+	}
+	// y^2 = x^3 - 3x + b
+	y2 := new(big.Int).Exp(x, big.NewInt(3), p521Prime)
+	y2.Sub(y2, new(big.Int).Mul(x, big.NewInt(3)))
+	y2.Add(y2, p521Curveb)
+	y2.Mod(y2, p521Prime)
+	y := new(big.Int).Exp(y2, p521Sqrt, p521Prime)
+	if new(big.Int).Exp(y, big.NewInt(2), p521Prime).Cmp(y2) != 0 {
+		return nil, false
+	}
+	if y.Bit(0) == 1 {
+		y.Sub(p521Prime, y)
+	}
+	return y, true
+}
+
+func schnorrChallenge(rx, publicKey, hash []byte) *big.Int {
+	return hashToScalar(rx, publicKey, hash)
+}
+
+func schnorrNonce(d *big.Int, hash []byte) *big.Int {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	for {
+		k := hashToScalar(scalarBytes(d), hash, random)
+		if k.Sign() != 0 {
+			return k
+		}
+		random[0]++
+	}
+}
+
+func schnorrSign(d *big.Int, publicKey, hash []byte) []byte {
+	k := schnorrNonce(d, hash)
+	rx, ry := p521.ScalarBaseMult(scalarBytes(k))
+	if ry.Bit(0) == 1 {
+		k.Sub(p521Order, k)
+	}
+	e := schnorrChallenge(scalarBytes(rx), publicKey, hash)
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, p521Order)
+	return append(scalarBytes(rx), scalarBytes(s)...)
+}
+
+func parseSchnorrSignature(signature []byte) (*big.Int, *big.Int, bool) {
+	if len(signature) != 2*p521Size {
+		return nil, nil, false
+	}
+	r := new(big.Int).SetBytes(signature[:p521Size])
+	s := new(big.Int).SetBytes(signature[p521Size:])
+	return r, s, r.Cmp(p521Prime) < 0 && s.Cmp(p521Order) < 0
+}
+
+func schnorrVerify(publicKey, signature, hash []byte) bool {
+	px, py, ok := parsePoint(publicKey)
+	if !ok {
+		return false
+	}
+	r, s, ok := parseSchnorrSignature(signature)
+	if !ok {
+		return false
+	}
+	e := schnorrChallenge(signature[:p521Size], publicKey, hash)
+	// R = sG - eP
+	sx, sy := p521.ScalarBaseMult(scalarBytes(s))
+	ex, ey := p521.ScalarMult(px, py, scalarBytes(new(big.Int).Sub(p521Order, e)))
+	rx, ry := p521.Add(sx, sy, ex, ey)
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return false
+	}
+	return ry.Bit(0) == 0 && rx.Cmp(r) == 0
+}
+
+// AggregatePublicKeys combines Schnorr public keys into a single MuSig key.
+// Every key is weighted by a hash of all keys, so no cosigner can pick a key
+// that cancels the others out. The order of the keys does not matter.
+func AggregatePublicKeys(publicKeys [][]byte) ([]byte, error) {
+	coefficients, err := muSigCoefficients(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	var qx, qy *big.Int
+	for i, publicKey := range publicKeys {
+		px, py, _ := parsePoint(publicKey[1:])
+		x, y := p521.ScalarMult(px, py, scalarBytes(coefficients[i]))
+		if qx == nil {
+			qx, qy = x, y
+		} else {
+			qx, qy = p521.Add(qx, qy, x, y)
+		}
+	}
+	return append([]byte{byte(KeyTypeSchnorr)}, pointBytes(qx, qy)...), nil
+}
+
+func muSigCoefficients(publicKeys [][]byte) ([]*big.Int, error) {
+	if len(publicKeys) == 0 {
+		return nil, ErrMuSigKeys
+	}
+	sorted := make([][]byte, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		if keyType, ok := PublicKeyType(publicKey); !ok || keyType != KeyTypeSchnorr {
+			return nil, ErrMuSigKeys
+		}
+		if _, _, ok := parsePoint(publicKey[1:]); !ok {
+			return nil, ErrMuSigKeys
+		}
+		sorted[i] = publicKey
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	keysHash := sha512.Sum512(bytes.Join(sorted, nil))
+
+	coefficients := make([]*big.Int, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		coefficients[i] = hashToScalar(keysHash[:], publicKey)
+	}
+	return coefficients, nil
+}
+
+// MuSigNonce is the secret nonce of one cosigner for one signing session.
+// Cosigners exchange commitments to their public nonces before revealing
+// them, and a nonce must never be used for two sessions.
+type MuSigNonce struct {
+	secret *big.Int
+	Public []byte
+}
+
+func NewMuSigNonce() MuSigNonce {
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(p521Order, big.NewInt(1)))
+	if err != nil {
+		panic(err)
+	}
+	k.Add(k, big.NewInt(1))
+	x, y := p521.ScalarBaseMult(scalarBytes(k))
+	return MuSigNonce{k, pointBytes(x, y)}
+}
+
+func (n MuSigNonce) Commitment() []byte {
+	hash := sha512.Sum512(n.Public)
+	return hash[:]
+}
+
+// Serialize encodes the secret and the public nonce so a cosigner can keep
+// the nonce between the rounds of a session. It must stay private.
+func (n MuSigNonce) Serialize() []byte {
+	return append(scalarBytes(n.secret), n.Public...)
+}
+
+func DeserializeMuSigNonce(data []byte) (MuSigNonce, error) {
+	if len(data) != 3*p521Size {
+		return MuSigNonce{}, ErrMuSigNonces
+	}
+	k := new(big.Int).SetBytes(data[:p521Size])
+	if k.Sign() == 0 || k.Cmp(p521Order) >= 0 {
+		return MuSigNonce{}, ErrMuSigNonces
+	}
+	x, y := p521.ScalarBaseMult(data[:p521Size])
+	if !bytes.Equal(pointBytes(x, y), data[p521Size:]) {
+		return MuSigNonce{}, ErrMuSigNonces
+	}
+	return MuSigNonce{k, append([]byte{}, data[p521Size:]...)}, nil
+}
+
+func aggregateNonces(publicNonces [][]byte) (*big.Int, *big.Int, error) {
+	var rx, ry *big.Int
+	for _, nonce := range publicNonces {
+		x, y, ok := parsePoint(nonce)
+		if !ok {
+			return nil, nil, ErrMuSigNonces
+		}
+		if rx == nil {
+			rx, ry = x, y
+		} else {
+			rx, ry = p521.Add(rx, ry, x, y)
+		}
+	}
+	if rx == nil || (rx.Sign() == 0 && ry.Sign() == 0) {
+		return nil, nil, ErrMuSigNonces
+	}
+	return rx, ry, nil
+}
+
+// MuSigPartialSign returns the share of one cosigner of the signature for the
+// aggregate of publicKeys
+func MuSigPartialSign(privateKey PrivateKey, nonce MuSigNonce, publicKeys, publicNonces [][]byte, hash []byte) ([]byte, error) {
+	coefficients, err := muSigCoefficients(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := privateKey.PublicKey()
+	var coefficient *big.Int
+	for i, key := range publicKeys {
+		if bytes.Equal(key, publicKey) {
+			coefficient = coefficients[i]
+		}
+	}
+	if coefficient == nil {
+		return nil, ErrMuSigKeys
+	}
+	aggregateKey, _ := AggregatePublicKeys(publicKeys)
+	rx, ry, err := aggregateNonces(publicNonces)
+	if err != nil {
+		return nil, err
+	}
+	k := new(big.Int).Set(nonce.secret)
+	if ry.Bit(0) == 1 {
+		k.Sub(p521Order, k)
+	}
+	e := schnorrChallenge(scalarBytes(rx), aggregateKey[1:], hash)
+	s := new(big.Int).Mul(e, coefficient)
+	s.Mul(s, new(big.Int).SetBytes(privateKey.Key))
+	s.Add(s, k)
+	s.Mod(s, p521Order)
+	return scalarBytes(s), nil
+}
+
+// MuSigCombine adds up the partial signatures into a Schnorr signature that
+// verifies against the aggregate key
+func MuSigCombine(publicNonces, partialSignatures [][]byte) ([]byte, error) {
+	rx, _, err := aggregateNonces(publicNonces)
+	if err != nil {
+		return nil, err
+	}
+	s := new(big.Int)
+	for _, partial := range partialSignatures {
+		if len(partial) != p521Size {
+			return nil, ErrMuSigNonces
+		}
+		s.Add(s, new(big.Int).SetBytes(partial))
+	}
+	s.Mod(s, p521Order)
+	return append(scalarBytes(rx), scalarBytes(s)...), nil
+}
+
+// MuSigSign signs for the aggregate of keys held by a single signer, every
+// cosigner of the session is run locally
+func MuSigSign(privateKeys []PrivateKey, hash []byte) ([]byte, error) {
+	publicKeys := make([][]byte, len(privateKeys))
+	nonces := make([]MuSigNonce, len(privateKeys))
+	publicNonces := make([][]byte, len(privateKeys))
+	for i, privateKey := range privateKeys {
+		publicKeys[i] = privateKey.PublicKey()
+		nonces[i] = NewMuSigNonce()
+		publicNonces[i] = nonces[i].Public
+	}
+	partialSignatures := make([][]byte, len(privateKeys))
+	for i, privateKey := range privateKeys {
+		var err error
+		partialSignatures[i], err = MuSigPartialSign(privateKey, nonces[i], publicKeys, publicNonces, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return MuSigCombine(publicNonces, partialSignatures)
+}
+
+type schnorrEntry struct {
+	px, py *big.Int
+	rx, ry *big.Int
+	s, e   *big.Int
+}
+
+// SchnorrBatch collects Schnorr signatures and verifies them together.
+// A random weight per signature keeps invalid signatures from cancelling
+// each other out.
+type SchnorrBatch struct {
+	mutex   sync.Mutex
+	entries []schnorrEntry
+}
+
+func NewSchnorrBatch() *SchnorrBatch {
+	return &SchnorrBatch{}
+}
+
+// Add queues a signature, it returns false if the key or signature cannot
+// be parsed
+func (b *SchnorrBatch) Add(publicKey, signature, hash []byte) bool {
+	keyType, ok := PublicKeyType(publicKey)
+	if !ok || keyType != KeyTypeSchnorr {
+		return false
+	}
+	px, py, ok := parsePoint(publicKey[1:])
+	if !ok {
+		return false
+	}
+	r, s, ok := parseSchnorrSignature(signature)
+	if !ok {
+		return false
+	}
+	ry, ok := liftX(r)
+	if !ok {
+		return false
+	}
+	e := schnorrChallenge(signature[:p521Size], publicKey[1:], hash)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries = append(b.entries, schnorrEntry{px, py, r, ry, s, e})
+	return true
+}
+
+func (b *SchnorrBatch) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.entries)
+}
+
+// Verify checks sum(a*s)G == sum(a*R) + sum(a*e*P)
+func (b *SchnorrBatch) Verify() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.entries) == 0 {
+		return true
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	sum := new(big.Int)
+	var x, y *big.Int
+	for i, entry := range b.entries {
+		a := big.NewInt(1)
+		if i > 0 {
+			var err error
+			if a, err = rand.Int(rand.Reader, limit); err != nil {
+				panic(err)
+			}
+		}
+		sum.Add(sum, new(big.Int).Mul(a, entry.s))
+
+		ae := new(big.Int).Mul(a, entry.e)
+		ae.Mod(ae, p521Order)
+		rx, ry := p521.ScalarMult(entry.rx, entry.ry, scalarBytes(a))
+		ex, ey := p521.ScalarMult(entry.px, entry.py, scalarBytes(ae))
+		rx, ry = p521.Add(rx, ry, ex, ey)
+		if x == nil {
+			x, y = rx, ry
+		} else {
+			x, y = p521.Add(x, y, rx, ry)
+		}
+	}
+	sum.Mod(sum, p521Order)
+	sx, sy := p521.ScalarBaseMult(scalarBytes(sum))
+	return sx.Cmp(x) == 0 && sy.Cmp(y) == 0
+}
@@ -2,9 +2,6 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha512"
 	"fmt"
 
@@ -13,33 +10,37 @@ import (
 
 const (
 	ChecksumLen = 4
-	version     = byte(0x00)
+
+	// Address versions, every key type and multisig addresses start with a
+	// different Base58 character
+	PublicKeyHashVersion  = byte(0x00)
+	ScriptHashVersion     = byte(0x05)
+	Ed25519KeyHashVersion = byte(0x1c)
+	Ed448KeyHashVersion   = byte(0x21)
+	SchnorrKeyHashVersion = byte(0x3f)
 )
 
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
+	PrivateKey PrivateKey
 	PublicKey  []byte
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P521()
-
-	private, err := ecdsa.GenerateKey(curve, rand.Reader)
-	if err != nil {
-		panic(err)
-	}
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-
-	return *private, public
+func NewKeyPair(keyType KeyType) (PrivateKey, []byte) {
+	private := GeneratePrivateKey(keyType)
+	return private, private.PublicKey()
 }
 
 func NewWallet() *Wallet {
-	private, public := NewKeyPair()
+	return NewWalletWithType(KeyTypeP521)
+}
+
+func NewWalletWithType(keyType KeyType) *Wallet {
+	private, public := NewKeyPair(keyType)
 	return &Wallet{private, public}
 }
 
-func OpenWallet(privateKey ecdsa.PrivateKey, publicKey []byte) *Wallet {
-	return &Wallet{privateKey, publicKey}
+func OpenWallet(privateKey PrivateKey) *Wallet {
+	return &Wallet{privateKey, privateKey.PublicKey()}
 }
 
 func PublicKeyHash(publicKey []byte) []byte {
@@ -62,24 +63,46 @@ func CheckSum(payload []byte) []byte {
 }
 
 func (w Wallet) Address() []byte {
-	publicHash := PublicKeyHash(w.PublicKey)
-	versionedHash := append([]byte{version}, publicHash...)
-	checksum := CheckSum(versionedHash)
-
-	fullHash := append(versionedHash, checksum...)
-	address := Base58Encode(fullHash)
+	address := w.address()
 
 	fmt.Printf("Public key: %x\n", w.PublicKey)
-	fmt.Printf("Public hash: %x\n", publicHash)
+	fmt.Printf("Public hash: %x\n", PublicKeyHash(w.PublicKey))
 	fmt.Printf("Address: %x\n", address)
 
 	return address
 }
 
+// address is Address without printing the keys
+func (w Wallet) address() []byte {
+	return EncodeAddress(w.PrivateKey.Type.AddressVersion(), PublicKeyHash(w.PublicKey))
+}
+
+func EncodeAddress(version byte, hash []byte) []byte {
+	versionedHash := append([]byte{version}, hash...)
+	checksum := CheckSum(versionedHash)
+
+	fullHash := append(versionedHash, checksum...)
+	return Base58Encode(fullHash)
+}
+
+// DecodeAddress returns the version and the hash encoded in an address
+func DecodeAddress(address string) (byte, []byte) {
+	fullHash := Base58Decode([]byte(address))
+	return fullHash[0], fullHash[1 : len(fullHash)-ChecksumLen]
+}
+
 func ValidateAddress(address string) bool {
 	publicKeyHash := Base58Decode([]byte(address))
+	if len(publicKeyHash) <= ChecksumLen+1 {
+		return false
+	}
 	actualChecksum := publicKeyHash[len(publicKeyHash)-ChecksumLen:]
 	version := publicKeyHash[0]
+	switch version {
+	case PublicKeyHashVersion, ScriptHashVersion, Ed25519KeyHashVersion, Ed448KeyHashVersion, SchnorrKeyHashVersion:
+	default:
+		return false
+	}
 	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-ChecksumLen]
 	targetChecksum := CheckSum(append([]byte{version}, publicKeyHash...))
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
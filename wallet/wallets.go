@@ -9,45 +9,85 @@ import (
 const walletsFolder = "./tmp/wallets/"
 
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets   map[string]*Wallet
+	Multisigs map[string]*MultisigWallet
+	MuSigs    map[string]*MuSigWallet
 }
 
 func NewWallets() (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Multisigs = make(map[string]*MultisigWallet)
+	wallets.MuSigs = make(map[string]*MuSigWallet)
 	err := wallets.Load()
 	return &wallets, err
 }
 
 func (ws *Wallets) AddWallet() string {
-	wallet := NewWallet()
+	return ws.AddWalletWithType(KeyTypeP521)
+}
+
+func (ws *Wallets) AddWalletWithType(keyType KeyType) string {
+	wallet := NewWalletWithType(keyType)
 	address := string(wallet.Address())
 	ws.Wallets[address] = wallet
 	return address
 }
 
+func (ws *Wallets) AddMultisig(multisig *MultisigWallet) string {
+	address := string(multisig.Address())
+	ws.Multisigs[address] = multisig
+	return address
+}
+
+func (ws *Wallets) AddMuSig(musig *MuSigWallet) string {
+	address := string(musig.Address())
+	ws.MuSigs[address] = musig
+	return address
+}
+
 func (ws *Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+func (ws *Wallets) GetMultisig(address string) *MultisigWallet {
+	return ws.Multisigs[address]
+}
+
+func (ws *Wallets) GetMuSig(address string) *MuSigWallet {
+	return ws.MuSigs[address]
+}
+
 func (ws *Wallets) GetAllAddresses() []string {
 	var addresses []string
 	for address := range ws.Wallets {
 		addresses = append(addresses, address)
 	}
+	for address := range ws.Multisigs {
+		addresses = append(addresses, address)
+	}
+	for address := range ws.MuSigs {
+		addresses = append(addresses, address)
+	}
 	return addresses
 }
 
 func (ws *Wallets) Save() {
 	for address, wallet := range ws.Wallets {
-		privateKeyBuffer, err := x509.MarshalECPrivateKey(&wallet.PrivateKey)
-		if err != nil {
+		if err := os.WriteFile(walletsFolder+address+".priv", wallet.PrivateKey.Serialize(), 0644); err != nil {
 			panic(err)
 		}
-		if err := os.WriteFile(walletsFolder+address+".priv", privateKeyBuffer, 0644); err != nil {
+		if err := os.WriteFile(walletsFolder+address+".pub", wallet.PublicKey, 0644); err != nil {
 			panic(err)
 		}
-		if err := os.WriteFile(walletsFolder+address+".pub", wallet.PublicKey, 0644); err != nil {
+	}
+	for address, multisig := range ws.Multisigs {
+		if err := os.WriteFile(walletsFolder+address+".msig", multisig.Serialize(), 0644); err != nil {
+			panic(err)
+		}
+	}
+	for address, musig := range ws.MuSigs {
+		if err := os.WriteFile(walletsFolder+address+".musig", musig.Serialize(), 0644); err != nil {
 			panic(err)
 		}
 	}
@@ -68,17 +108,47 @@ func (ws *Wallets) Load() error {
 				println("CRASH1", err.Error())
 				continue
 			}
-			privateKey, err := x509.ParseECPrivateKey(privateKeyBuffer)
+			privateKey, err := DeserializePrivateKey(privateKeyBuffer)
 			if err != nil {
-				println("CRASH2", err.Error())
-				continue
+				// Wallets from before typed keys hold a P-521 key in x509
+				// format
+				legacyKey, err := x509.ParseECPrivateKey(privateKeyBuffer)
+				if err != nil {
+					println("CRASH2", err.Error())
+					continue
+				}
+				privateKey = p521PrivateKey(legacyKey)
 			}
+			wallet := OpenWallet(privateKey)
+			// Their unpadded public key is kept, the outputs paid to its
+			// address stay spendable
 			publicKey, err := os.ReadFile(walletsFolder + address + ".pub")
+			if err == nil && IsLegacyPublicKey(publicKey, privateKey) {
+				wallet.PublicKey = publicKey
+			}
+			ws.Wallets[string(wallet.address())] = wallet
+		} else if strings.HasSuffix(name, ".msig") {
+			address := name[:strings.IndexByte(name, '.')]
+			data, err := os.ReadFile(walletsFolder + name)
+			if err != nil {
+				continue
+			}
+			multisig, err := DeserializeMultisigWallet(data)
+			if err != nil {
+				continue
+			}
+			ws.Multisigs[address] = multisig
+		} else if strings.HasSuffix(name, ".musig") {
+			address := name[:strings.IndexByte(name, '.')]
+			data, err := os.ReadFile(walletsFolder + name)
+			if err != nil {
+				continue
+			}
+			musig, err := DeserializeMuSigWallet(data)
 			if err != nil {
-				println("CRASH3", err.Error())
 				continue
 			}
-			ws.Wallets[address] = OpenWallet(*privateKey, publicKey)
+			ws.MuSigs[address] = musig
 		}
 	}
 	return nil